@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	usageExportDir      = flag.String("usage-export-dir", "", "directory to write usage accounting files to, each covering the usage since the one before; none when empty")
+	usageExportInterval = flag.Duration("usage-export-interval", time.Hour, "how often to write a usage accounting file to -usage-export-dir")
+	usageExportFormat   = flag.String("usage-export-format", "csv", "format of the usage accounting files, csv or json")
+)
+
+// accountingStart is when usage started being counted.
+var accountingStart = time.Now()
+
+// usageRecord is the usage of one room of a tenant. The lobby, room "",
+// has all the tenant's clients as members and the broadcasts to everyone.
+type usageRecord struct {
+	Tenant string `json:"tenant"`
+	Room   string `json:"room"`
+	// ConnectionMinutes adds up the time each member was in the room.
+	ConnectionMinutes float64 `json:"connectionMinutes"`
+	Messages          int64   `json:"messages"`
+	Bytes             int64   `json:"bytes"`
+	// since tells rooms created again after they were evicted apart, see
+	// runUsageExport.
+	since time.Time
+}
+
+// usageReport is the usage of every room between From and To.
+type usageReport struct {
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	Records []usageRecord `json:"records"`
+}
+
+// accrue adds the time the members spent in the room since it was last
+// called. It is called with r.mu held, before the members change.
+func (r *room) accrue(now time.Time) {
+	if !r.accruedAt.IsZero() {
+		r.memberTime += time.Duration(len(r.members)) * now.Sub(r.accruedAt)
+	}
+	r.accruedAt = now
+}
+
+func (r *room) usage(now time.Time) usageRecord {
+	r.mu.Lock()
+	r.accrue(now)
+	memberTime := r.memberTime
+	r.mu.Unlock()
+
+	return usageRecord{
+		Tenant:            r.hub.tenant,
+		Room:              r.name,
+		ConnectionMinutes: memberTime.Minutes(),
+		Messages:          r.messages.Load(),
+		Bytes:             r.bytes.Load(),
+		since:             r.since,
+	}
+}
+
+// usageRecords returns the usage of every room of every tenant since the
+// server started, by tenant and room.
+func usageRecords(now time.Time) []usageRecord {
+	var records []usageRecord
+	for _, h := range allHubs() {
+		h.mu.Lock()
+		rooms := make([]*room, 0, len(h.rooms))
+		for _, r := range h.rooms {
+			rooms = append(rooms, r)
+		}
+		for name, old := range h.retired {
+			records = append(records, usageRecord{
+				Tenant:            h.tenant,
+				Room:              name,
+				ConnectionMinutes: old.memberTime.Minutes(),
+				Messages:          old.messages,
+				Bytes:             old.bytes,
+				since:             old.since,
+			})
+		}
+		if old := h.evicted; old.memberTime > 0 || old.messages > 0 {
+			records = append(records, usageRecord{
+				Tenant:            h.tenant,
+				Room:              evictedRooms,
+				ConnectionMinutes: old.memberTime.Minutes(),
+				Messages:          old.messages,
+				Bytes:             old.bytes,
+			})
+		}
+		h.mu.Unlock()
+
+		for _, r := range rooms {
+			records = append(records, r.usage(now))
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Tenant != records[j].Tenant {
+			return records[i].Tenant < records[j].Tenant
+		}
+		return records[i].Room < records[j].Room
+	})
+	return records
+}
+
+// writeUsage writes report as JSON or as CSV with a header row.
+func writeUsage(w io.Writer, format string, report usageReport) error {
+	if format == "json" {
+		return json.NewEncoder(w).Encode(report)
+	}
+	out := csv.NewWriter(w)
+	out.Write([]string{"from", "to", "tenant", "room", "connection_minutes", "messages", "bytes"})
+	from, to := report.From.UTC().Format(time.RFC3339), report.To.UTC().Format(time.RFC3339)
+	for _, u := range report.Records {
+		out.Write([]string{
+			from, to, u.Tenant, u.Room,
+			strconv.FormatFloat(u.ConnectionMinutes, 'f', 2, 64),
+			strconv.FormatInt(u.Messages, 10),
+			strconv.FormatInt(u.Bytes, 10),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// usageHandler serves GET /admin/usage, the usage since the server started
+// as JSON or, with format=csv, CSV.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json":
+		format = "json"
+		w.Header().Set("Content-Type", "application/json")
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+	default:
+		httpError(w, r, "Invalid format, expected json or csv", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	writeUsage(w, format, usageReport{From: accountingStart, To: now, Records: usageRecords(now)})
+}
+
+// runUsageExport writes the usage of each -usage-export-interval to a file
+// in -usage-export-dir.
+func runUsageExport() {
+	if *usageExportDir == "" {
+		return
+	}
+	if *usageExportFormat != "csv" && *usageExportFormat != "json" {
+		log.Fatalf("invalid -usage-export-format %q, expected csv or json", *usageExportFormat)
+	}
+	exported := make(map[[2]string]usageRecord)
+	last := accountingStart
+	ticker := time.NewTicker(*usageExportInterval)
+	for now := range ticker.C {
+		report := usageReport{From: last, To: now}
+		records := usageRecords(now)
+		totals := make(map[[2]string]usageRecord)
+		for _, u := range records {
+			totals[[2]string{u.Tenant, u.Room}] = u
+		}
+		// Rooms evicted since the last export count in their tenant's
+		// evictedRooms record now, with what was exported of them, even
+		// when they were created again.
+		prevs := maps.Clone(exported)
+		for key, prev := range exported {
+			if u, ok := totals[key]; key[1] == evictedRooms || ok && u.since.Equal(prev.since) {
+				continue
+			}
+			delete(prevs, key)
+			all := [2]string{key[0], evictedRooms}
+			sum := prevs[all]
+			sum.ConnectionMinutes += prev.ConnectionMinutes
+			sum.Messages += prev.Messages
+			sum.Bytes += prev.Bytes
+			prevs[all] = sum
+		}
+		for _, u := range records {
+			key := [2]string{u.Tenant, u.Room}
+			prev := prevs[key]
+			u.ConnectionMinutes -= prev.ConnectionMinutes
+			u.Messages -= prev.Messages
+			u.Bytes -= prev.Bytes
+			if u.ConnectionMinutes > 0 || u.Messages > 0 {
+				report.Records = append(report.Records, u)
+			}
+		}
+		if err := exportUsage(report); err != nil {
+			log.Println("Cannot export usage:", err)
+			continue
+		}
+		exported, last = totals, now
+	}
+}
+
+// exportUsage writes report to a file named after its end, replacing it
+// in one go so readers never see half of it.
+func exportUsage(report usageReport) error {
+	name := fmt.Sprintf("usage-%s.%s", report.To.UTC().Format("20060102T150405Z"), *usageExportFormat)
+	f, err := os.CreateTemp(*usageExportDir, ".usage-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := writeUsage(f, *usageExportFormat, report); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(*usageExportDir, name))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFdsStart is the first file descriptor systemd passes to an activated
+// service, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+type activatedSocket struct {
+	name string
+	ln   net.Listener
+}
+
+var (
+	activationOnce    sync.Once
+	activationSockets []activatedSocket
+	activationErr     error
+)
+
+// systemdSockets returns the listening sockets inherited through systemd
+// socket activation, in the order systemd passed them.
+func systemdSockets() ([]activatedSocket, error) {
+	activationOnce.Do(func() {
+		activationSockets, activationErr = inheritSockets()
+	})
+	return activationSockets, activationErr
+}
+
+func inheritSockets() ([]activatedSocket, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	sockets := make([]activatedSocket, n)
+	for i := range sockets {
+		f := os.NewFile(uintptr(listenFdsStart+i), "LISTEN_FD_"+strconv.Itoa(listenFdsStart+i))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited socket %d: %v", i, err)
+		}
+
+		sockets[i].ln = ln
+		if i < len(names) {
+			sockets[i].name = names[i]
+		}
+	}
+	return sockets, nil
+}
+
+// systemdListener finds an inherited socket by its FileDescriptorName= or by
+// its position.
+func systemdListener(name string) (net.Listener, error) {
+	sockets, err := systemdSockets()
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range sockets {
+		if s.name == name || strconv.Itoa(i) == name {
+			return s.ln, nil
+		}
+	}
+	return nil, fmt.Errorf("no socket %q passed by systemd", name)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errBanned = errors.New("you are banned")
+
+// ban keeps clients matching it from connecting until it expires. Exactly
+// one of IP, Identity and Nick is set. Bans by admins of a tenant only
+// cover its clients, those by admins of the default tenant everyone's.
+type ban struct {
+	IP       string    `json:"ip,omitempty"`
+	Identity string    `json:"identity,omitempty"`
+	Nick     string    `json:"nick,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+}
+
+func (b ban) key() string {
+	prefix := ""
+	if b.Tenant != "" {
+		prefix = "+" + b.Tenant + "/"
+	}
+	switch {
+	case b.IP != "":
+		return prefix + "ip:" + b.IP
+	case b.Identity != "":
+		return prefix + "id:" + b.Identity
+	}
+	return prefix + "nick:" + b.Nick
+}
+
+func (b ban) covers(c *Client) bool {
+	if b.Tenant != "" && b.Tenant != c.hub.tenant {
+		return false
+	}
+	return (b.IP != "" && b.IP == c.addr) ||
+		(b.Identity != "" && b.Identity == c.identity) ||
+		(b.Nick != "" && b.Nick == c.nick)
+}
+
+var bans = struct {
+	sync.Mutex
+	byKey map[string]ban
+}{byKey: make(map[string]ban)}
+
+func (b ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// banned reports whether a ban covers c. Bans are looked up by the keys
+// c could be banned under rather than looked through.
+func banned(c *Client) bool {
+	bans.Lock()
+	defer bans.Unlock()
+
+	now := time.Now()
+	for _, tenant := range []string{"", c.hub.tenant} {
+		for _, b := range []ban{{IP: c.addr}, {Identity: c.identity}, {Nick: c.nick}} {
+			if b.IP == "" && b.Identity == "" && b.Nick == "" {
+				continue
+			}
+			b.Tenant = tenant
+			found, ok := bans.byKey[b.key()]
+			switch {
+			case !ok:
+			case found.expired(now):
+				delete(bans.byKey, b.key())
+			default:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientInfo describes a connected client for the admin API.
+type clientInfo struct {
+	Nick     string   `json:"nick,omitempty"`
+	Identity string   `json:"identity,omitempty"`
+	Role     string   `json:"role,omitempty"`
+	Addr     string   `json:"addr,omitempty"`
+	Rooms    []string `json:"rooms"`
+	Queued   int      `json:"queued"`
+	// ConnectedAt tells how long the client has been connected.
+	ConnectedAt time.Time `json:"connectedAt"`
+	// Meta is what the client declared about itself, see clientMeta.
+	Meta map[string][]string `json:"meta,omitempty"`
+}
+
+func (h *Hub) clientInfos() []clientInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	infos := []clientInfo{}
+	h.clients.each(func(c *Client) {
+		info := clientInfo{Nick: c.nick, Identity: c.identity, Role: c.role, Addr: c.addr, Rooms: []string{}, Queued: c.queue.len(), ConnectedAt: c.connectedAt.UTC(), Meta: c.meta}
+		for room := range c.rooms {
+			info.Rooms = append(info.Rooms, room)
+		}
+		infos = append(infos, info)
+	})
+	return infos
+}
+
+// disconnect closes the connections of the clients match selects, for
+// reason, and returns how many there were.
+func (h *Hub) disconnect(reason string, match func(*Client) bool) int {
+	var victims []*Client
+	h.clients.each(func(c *Client) {
+		if match(c) {
+			victims = append(victims, c)
+		}
+	})
+
+	n := 0
+	for _, c := range victims {
+		if _, ok := c.connection.(io.Closer); ok {
+			c.closeWith(reason)
+			n++
+		}
+	}
+	return n
+}
+
+// adminClientsHandler serves GET /admin/clients.
+func adminClientsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hubFor(r).clientInfos())
+}
+
+// adminKickHandler serves POST /admin/kick?nick=NICK, disconnecting the
+// client. It may reconnect.
+func adminKickHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nick := r.URL.Query().Get("nick")
+	if nick == "" {
+		httpError(w, r, "Missing nick", http.StatusBadRequest)
+		return
+	}
+
+	n := hubFor(r).disconnect(reasonKicked, func(c *Client) bool { return c.nick == nick })
+	if n == 0 {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	log.Println("Kicked", nick)
+	auditAction(requestActor(r), "kick", nick, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminBansHandler serves /admin/bans: GET lists the bans, POST adds the
+// JSON encoded ban, with an optional duration such as "1h", and disconnects
+// the clients it covers, DELETE lifts the ban given in the same way. Admins
+// of a tenant see and manage its bans only.
+func adminBansHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+	switch r.Method {
+	case http.MethodGet:
+		bans.Lock()
+		list := []ban{}
+		now := time.Now()
+		for k, b := range bans.byKey {
+			if b.expired(now) {
+				delete(bans.byKey, k)
+				continue
+			}
+			if tenant == "" || b.Tenant == tenant {
+				list = append(list, b)
+			}
+		}
+		bans.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+
+	case http.MethodPost, http.MethodDelete:
+	default:
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var in struct {
+		ban
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&in); err != nil {
+		httpError(w, r, "Invalid ban", decodeStatus(err))
+		return
+	}
+	b := in.ban
+	b.Tenant = tenant
+	set := 0
+	for _, v := range []string{b.IP, b.Identity, b.Nick} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		httpError(w, r, "A ban names exactly one of ip, identity or nick", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		bans.Lock()
+		delete(bans.byKey, b.key())
+		bans.Unlock()
+		auditAction(requestActor(r), "unban", b.key(), "")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	b.Expires = time.Time{}
+	if in.Duration != "" {
+		d, err := time.ParseDuration(in.Duration)
+		if err != nil || d <= 0 {
+			httpError(w, r, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+		b.Expires = time.Now().Add(d)
+	}
+	bans.Lock()
+	bans.byKey[b.key()] = b
+	bans.Unlock()
+
+	// What the banned clients scheduled is not delivered either; address
+	// bans only know owners through the clients they disconnect.
+	owners := map[string]bool{b.Identity: b.Identity != "", b.Nick: b.Nick != ""}
+	covers := func(c *Client) bool {
+		if !b.covers(c) {
+			return false
+		}
+		owners[c.reader()] = true
+		return true
+	}
+	var n int
+	if tenant == "" {
+		n = disconnectAll(reasonKicked, covers)
+	} else {
+		n = hubFor(r).disconnect(reasonKicked, covers)
+	}
+	purged, err := purgeScheduled(r.Context(), func(s *scheduledMessage) bool {
+		return (tenant == "" || s.Tenant == tenant) && s.Owner != "" && owners[s.Owner]
+	})
+	if err != nil {
+		log.Println("Cannot cancel scheduled messages of ban:", err)
+	}
+	log.Printf("Banned %s, disconnected %d clients, cancelled %d scheduled messages", b.key(), n, purged)
+	auditAction(requestActor(r), "ban", b.key(), in.Duration)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(b)
+}
+
+// adminStatsHandler serves GET /admin/stats. The message rate is left
+// out, it is only measured between posts to the #stats room.
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	s := hubFor(r).stats(time.Second, 0)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// adminEvent is one entry of the /admin/ws operations feed.
+type adminEvent struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Client string    `json:"client,omitempty"`
+	Addr   string    `json:"addr,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Kinds of admin events. Moderation and administrative actions are
+// reported as they are written to the audit log.
+const (
+	adminConnect    = "connect"
+	adminDisconnect = "disconnect"
+	adminAction     = "action"
+	adminError      = "error"
+)
+
+var adminFeeds = struct {
+	sync.Mutex
+	chans map[chan adminEvent]bool
+}{chans: make(map[chan adminEvent]bool)}
+
+// emitAdminEvent sends e to every connected operations console. Slow
+// consoles miss events rather than hold up the server.
+func emitAdminEvent(e adminEvent) {
+	e.Time = time.Now().UTC()
+
+	adminFeeds.Lock()
+	defer adminFeeds.Unlock()
+
+	for ch := range adminFeeds.chans {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func clientEvent(typ string, c *Client, detail string) {
+	emitAdminEvent(adminEvent{Type: typ, Client: c.nick, Addr: c.addr, Detail: detail})
+}
+
+var adminWsHandler = requireServerAdmin(websocket.Server{Handshake: adminHandshake, Handler: onAdminWsConnect})
+
+// adminHandshake accepts tools that send no Origin, but browsers only from
+// pages of our own origin, as they send session cookies along.
+func adminHandshake(config *websocket.Config, req *http.Request) error {
+	if req.Header.Get("Origin") == "" {
+		return nil
+	}
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil || origin.Host != req.Host {
+		return errors.New("cross-origin admin connection")
+	}
+	config.Origin = origin
+	return nil
+}
+
+func onAdminWsConnect(ws *websocket.Conn) {
+	defer ws.Close()
+
+	ch := make(chan adminEvent, 100)
+	adminFeeds.Lock()
+	adminFeeds.chans[ch] = true
+	adminFeeds.Unlock()
+	defer func() {
+		adminFeeds.Lock()
+		delete(adminFeeds.chans, ch)
+		adminFeeds.Unlock()
+	}()
+
+	log.Println("Operations console connected from", clientIP(ws.Request()))
+	closed := make(chan struct{})
+	go func() {
+		// Consoles only listen; reading notices when they go away.
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+		close(closed)
+	}()
+
+	for {
+		select {
+		case e := <-ch:
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
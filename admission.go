@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	connectRate       = flag.Float64("connect-rate", 0, "new websocket and WebTransport connections per second the server accepts on average, smoothing reconnect storms; 0 for no limit")
+	connectBurst      = flag.Int("connect-burst", 100, "new connections the server accepts at once before -connect-rate applies")
+	connectRatePerIP  = flag.Float64("connect-rate-per-ip", 0, "new connections per second each address may open on average; 0 for no limit")
+	connectBurstPerIP = flag.Int("connect-burst-per-ip", 10, "new connections an address may open at once before -connect-rate-per-ip applies")
+)
+
+// connectBucket admits new connections to the server, connectBuckets
+// those of each address.
+var (
+	connectBucket  tokenBucket
+	connectBuckets = struct {
+		sync.Mutex
+		byAddr map[string]*tokenBucket
+		sweep  sweeper
+	}{byAddr: make(map[string]*tokenBucket)}
+)
+
+func addrConnectBucket(addr string) *tokenBucket {
+	connectBuckets.Lock()
+	defer connectBuckets.Unlock()
+
+	// Buckets idle long enough to be full again are as good as new ones.
+	// During a reconnect storm there are many, so they are not looked
+	// through on every attempt.
+	idle := time.Duration(float64(*connectBurstPerIP) / *connectRatePerIP * float64(time.Second))
+	now := time.Now()
+	if connectBuckets.sweep.due(now, idle) {
+		for a, b := range connectBuckets.byAddr {
+			b.mu.Lock()
+			if now.Sub(b.last) > idle {
+				delete(connectBuckets.byAddr, a)
+			}
+			b.mu.Unlock()
+		}
+	}
+	b := connectBuckets.byAddr[addr]
+	if b == nil {
+		b = &tokenBucket{}
+		connectBuckets.byAddr[addr] = b
+	}
+	return b
+}
+
+// admitConnections turns away connection attempts beyond -connect-rate-per-ip
+// with 429 Too Many Requests, and beyond -connect-rate with 503 Service
+// Unavailable, both with Retry-After. Addresses are limited first, so one
+// reconnecting in a loop does not use up everyone's allowance.
+func admitConnections(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *connectRatePerIP > 0 {
+			if ok, _, wait := addrConnectBucket(clientIP(r)).take(*connectRatePerIP, *connectBurstPerIP, 1); !ok {
+				connectionsRefused.WithLabelValues("address").Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				httpError(w, r, "Too many connections", http.StatusTooManyRequests)
+				return
+			}
+		}
+		if *connectRate > 0 {
+			if ok, _, wait := connectBucket.take(*connectRate, *connectBurst, 1); !ok {
+				connectionsRefused.WithLabelValues("server").Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				httpError(w, r, "Too many connections, try again later", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
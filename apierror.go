@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// errorResponse is the body of every failed HTTP API request.
+type errorResponse struct {
+	// Code is the status text in snake case, e.g. too_many_requests.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details say more about what was wrong, e.g. which message of a
+	// batch.
+	Details   any    `json:"details,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// httpError replies to r with message and status, like http.Error but as
+// an errorResponse.
+func httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	httpErrorDetails(w, r, message, status, nil)
+}
+
+func httpErrorDetails(w http.ResponseWriter, r *http.Request, message string, status int, details any) {
+	code := strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{code, message, details, requestID(r)})
+}
+
+// decodeStatus is the status for a request body that failed to decode:
+// 413 when it was cut off by http.MaxBytesReader, 400 otherwise.
+func decodeStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"sync"
+)
+
+// storeKeyEnv holds the base64 encoded 32 byte AES key that data written to
+// Redis is encrypted with. Without it data is stored in the clear.
+const storeKeyEnv = "CHAT_STORE_KEY"
+
+// sealedPrefix marks encrypted values, so data written before a key was
+// configured can still be read.
+var sealedPrefix = []byte("aesgcm1:")
+
+var (
+	storeCipherOnce sync.Once
+	storeCipher     cipher.AEAD
+)
+
+func loadStoreCipher() cipher.AEAD {
+	storeCipherOnce.Do(func() {
+		encoded := os.Getenv(storeKeyEnv)
+		if encoded == "" {
+			return
+		}
+		os.Unsetenv(storeKeyEnv)
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			log.Fatal(storeKeyEnv + " must be 32 base64 encoded bytes")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storeCipher, err = cipher.NewGCM(block)
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+	return storeCipher
+}
+
+// seal encrypts data before it is stored. The key name is authenticated
+// along with it, so values cannot be swapped between keys.
+func seal(name string, data []byte) []byte {
+	aead := loadStoreCipher()
+	if aead == nil {
+		return data
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	out := append(append([]byte{}, sealedPrefix...), nonce...)
+	return aead.Seal(out, nonce, data, []byte(name))
+}
+
+// unseal reverses seal. Values stored in the clear are returned as they
+// are while no key is configured, or were written before it was.
+func unseal(name string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, sealedPrefix) {
+		return data, nil
+	}
+	aead := loadStoreCipher()
+	if aead == nil {
+		return nil, errors.New("encrypted value found but " + storeKeyEnv + " is not set")
+	}
+
+	data = data[len(sealedPrefix):]
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("truncated encrypted value")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	pttRooms   = flag.String("ptt-rooms", "", "comma separated rooms in push-to-talk mode, where the member holding the floor relays audio frames to the others")
+	pttIdle    = flag.Duration("ptt-idle", 2*time.Second, "how long a push-to-talk speaker may send no audio before others can take the floor")
+	pttMaxTalk = flag.Duration("ptt-max-talk", time.Minute, "longest a push-to-talk speaker holds the floor before others can take it")
+)
+
+const (
+	// typeFloor asks for the floor of a push-to-talk room with the body
+	// "take", or gives it back with "release". The server announces who
+	// speaks with a floor message whose body is their nickname, empty when
+	// nobody does.
+	typeFloor = "floor"
+	// typeAudio carries a frame of the speaker's audio, such as an Opus
+	// packet. It is relayed to the members as it comes, never remembered.
+	typeAudio = "audio"
+
+	floorTake    = "take"
+	floorRelease = "release"
+
+	// maxAudioFrame is the largest audio frame relayed, a few Opus
+	// packets.
+	maxAudioFrame = 4000
+	// maxAudioBacklog is how many messages a member may have queued and
+	// still be sent audio. Audio that would arrive late is dropped.
+	maxAudioBacklog = 8
+)
+
+var (
+	errNotPushToTalk = &clientError{codeInvalid, "room is not in push-to-talk mode"}
+	errFloorTaken    = &clientError{codeBusy, "someone else is speaking"}
+	errNoFloor       = &clientError{codeUnauthorized, "take the floor before sending audio"}
+)
+
+// pttRoom reports whether room is in push-to-talk mode.
+func pttRoom(room string) bool {
+	if room == "" || *pttRooms == "" {
+		return false
+	}
+	for _, r := range strings.Split(*pttRooms, ",") {
+		if strings.TrimSpace(r) == room {
+			return true
+		}
+	}
+	return false
+}
+
+// floorExpired reports whether the speaker went quiet or talked too long.
+// It is called with r.mu held.
+func (r *room) floorExpired(now time.Time) bool {
+	return now.Sub(r.lastAudio) > *pttIdle || now.Sub(r.floorSince) > *pttMaxTalk
+}
+
+// setSpeaker gives the floor to c, or frees it when c is nil, and tells
+// the members. It is called with r.mu held.
+func (r *room) setSpeaker(c *Client, now time.Time) {
+	r.speaker, r.floorSince, r.lastAudio = c, now, now
+	floor := &Message{Type: typeFloor, Author: "Server", Room: r.name}
+	if c != nil {
+		floor.Body = c.nick
+	}
+	for m := range r.members {
+		m.queue.push(floor)
+	}
+}
+
+// floor takes or releases the floor of a push-to-talk room for c. The
+// floor is only taken from another speaker who went quiet or talked too
+// long.
+func (h *Hub) floor(c *Client, msg *Message) error {
+	if !pttRoom(msg.Room) {
+		return errNotPushToTalk
+	}
+	if msg.Body != floorTake && msg.Body != floorRelease {
+		return &validationError{"floor needs a body of take or release"}
+	}
+	r := h.existingRoom(msg.Room)
+	if r == nil || !c.joined(msg.Room) {
+		return &validationError{"floor needs a room the client is in"}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case msg.Body == floorRelease:
+		if r.speaker == c {
+			r.setSpeaker(nil, now)
+		}
+	case r.speaker == c:
+		r.lastAudio = now
+	case r.speaker != nil && !r.floorExpired(now):
+		return errFloorTaken
+	default:
+		r.setSpeaker(c, now)
+	}
+	return nil
+}
+
+// relayAudio passes an audio frame from the speaker straight to the other
+// members. Members too far behind to play it in time miss it.
+func (h *Hub) relayAudio(c *Client, msg *Message) error {
+	if !pttRoom(msg.Room) {
+		return errNotPushToTalk
+	}
+	if len(msg.Audio) > maxAudioFrame {
+		return clientErrorf(codeTooLarge, "audio frame is larger than %d bytes", maxAudioFrame)
+	}
+	r := h.existingRoom(msg.Room)
+	if r == nil {
+		return errNoFloor
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	if r.speaker != c || r.floorExpired(now) {
+		r.mu.Unlock()
+		return errNoFloor
+	}
+	r.lastAudio = now
+	r.mu.Unlock()
+
+	frame := &Message{Type: typeAudio, Author: c.nick, Room: msg.Room, Audio: msg.Audio}
+	for _, m := range *r.snapshot.Load() {
+		if m != c && m.queue.len() < maxAudioBacklog {
+			m.queue.push(frame)
+		}
+	}
+	return nil
+}
+
+// Audio travels in binary websocket frames rather than JSON envelopes on
+// chat.v2.json: a byte with the length of the room name, the room name, a
+// byte with the length of the author, the author and then the audio.
+// Clients leave the author empty, the server fills it in.
+
+// decodeAudioFrame reads a binary audio frame into msg.
+func decodeAudioFrame(data []byte, msg *Message) error {
+	var fields [2]string
+	for i := range fields {
+		if len(data) == 0 || len(data) < 1+int(data[0]) {
+			return &validationError{"truncated audio frame"}
+		}
+		fields[i], data = string(data[1:1+data[0]]), data[1+data[0]:]
+	}
+	*msg = Message{Type: typeAudio, Room: fields[0], Author: fields[1], Audio: data}
+	return nil
+}
+
+// encodeAudioFrame writes msg as a binary audio frame.
+func encodeAudioFrame(buf *bytes.Buffer, msg *Message) (byte, error) {
+	room, author := msg.Room, msg.Author
+	if len(room) > 255 || len(author) > 255 {
+		return 0, &validationError{"room or author too long for an audio frame"}
+	}
+	buf.WriteByte(byte(len(room)))
+	buf.WriteString(room)
+	buf.WriteByte(byte(len(author)))
+	buf.WriteString(author)
+	buf.Write(msg.Audio)
+	return websocket.BinaryFrame, nil
+}
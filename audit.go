@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var auditLogFile = flag.String("audit-log", "", "append administrative actions to this file, each entry chained to the previous one by its hash; disabled when empty")
+
+// auditEntry is one line of the audit log. Hash covers the entry with an
+// empty Hash field and includes Prev, the hash of the entry before, so
+// editing or dropping a line breaks the chain from there on.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Prev   string    `json:"prev"`
+	Hash   string    `json:"hash"`
+}
+
+func (e auditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+var audit struct {
+	sync.Mutex
+	once sync.Once
+	file *os.File
+	last string
+}
+
+func openAuditLog() {
+	f, err := os.OpenFile(*auditLogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, _, err := readAuditLog(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(entries) > 0 {
+		audit.last = entries[len(entries)-1].Hash
+	}
+	audit.file = f
+}
+
+// auditAction records that actor did action to target, and reports it to
+// operations consoles.
+func auditAction(actor, action, target, detail string) {
+	emitAdminEvent(adminEvent{Type: adminAction, Client: actor, Detail: strings.TrimSpace(action + " " + target)})
+	if *auditLogFile == "" {
+		return
+	}
+	audit.once.Do(openAuditLog)
+
+	audit.Lock()
+	defer audit.Unlock()
+
+	e := auditEntry{Time: time.Now().UTC(), Actor: actor, Action: action, Target: target, Detail: detail, Prev: audit.last}
+	e.Hash = e.computeHash()
+	data, _ := json.Marshal(e)
+	if _, err := audit.file.Write(append(data, '\n')); err != nil {
+		log.Println("Cannot write audit log:", err)
+		return
+	}
+	audit.last = e.Hash
+}
+
+// readAuditLog returns all entries of f and whether their hash chain is
+// intact.
+func readAuditLog(f *os.File) ([]auditEntry, bool, error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, false, err
+	}
+
+	var entries []auditEntry
+	valid := true
+	prev := ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			valid = false
+			continue
+		}
+		if e.Prev != prev || e.computeHash() != e.Hash {
+			valid = false
+		}
+		prev = e.Hash
+		entries = append(entries, e)
+	}
+	return entries, valid, scanner.Err()
+}
+
+// requestActor names who made r for the audit log.
+func requestActor(r *http.Request) string {
+	if name := requestIdentity(r); name != "" {
+		return name
+	}
+	if user := basicAuthUser(r); user != "" {
+		return user
+	}
+	return clientIP(r)
+}
+
+// auditHandler serves GET /admin/audit, optionally filtered by the action
+// and actor query parameters. The X-Audit-Chain header says whether the
+// log is intact.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if *auditLogFile == "" {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	audit.once.Do(openAuditLog)
+
+	audit.Lock()
+	entries, valid, err := readAuditLog(audit.file)
+	audit.Unlock()
+	if err != nil {
+		log.Println("Cannot read audit log:", err)
+		httpError(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	action, actor := r.URL.Query().Get("action"), r.URL.Query().Get("actor")
+	matching := []auditEntry{}
+	for _, e := range entries {
+		if (action == "" || e.Action == action) && (actor == "" || e.Actor == actor) {
+			matching = append(matching, e)
+		}
+	}
+
+	if valid {
+		w.Header().Set("X-Audit-Chain", "ok")
+	} else {
+		w.Header().Set("X-Audit-Chain", "broken")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matching)
+}
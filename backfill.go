@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// typeBackfill asks for the messages of a room with sequence numbers in
+// Range, after a client noticed a gap. They are sent again as they were,
+// as far as they are still remembered.
+const typeBackfill = "backfill"
+
+// maxBackfill is the most messages a backfill request can ask for. Longer
+// gaps are filled a page at a time.
+const maxBackfill = 100
+
+// seqRange is an inclusive range of sequence numbers.
+type seqRange struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// backfill returns the messages of room within sr the store still has,
+// oldest first, so gaps can be filled after the room itself is gone.
+func (h *Hub) backfill(name string, sr seqRange) ([]*Message, error) {
+	return dataStore().History(context.Background(), h.storeKey(name), sr.From, sr.To)
+}
+
+// checkBackfill returns an error unless c may ask for the messages of room
+// within sr: the range is at most maxBackfill long, c is in the room and
+// within its rate limit, which backfill requests count against.
+func checkBackfill(c *Client, room string, sr *seqRange) error {
+	if sr == nil || sr.From > sr.To {
+		return &validationError{"backfill needs a range with from <= to"}
+	}
+	if sr.To-sr.From >= maxBackfill {
+		return &validationError{fmt.Sprintf("backfill ranges cover at most %d messages", maxBackfill)}
+	}
+	if room != "" && !c.joined(room) {
+		return &validationError{"not in room " + room}
+	}
+	return checkRate(c)
+}
+
+// sendBackfill answers a backfill request of c. The messages are queued
+// like any others, so a client asking for more than it reads is not sent
+// them all.
+func sendBackfill(c *Client, req *Message) {
+	if err := checkBackfill(c, req.Room, req.Range); err != nil {
+		sendError(c, err)
+		return
+	}
+	msgs, err := c.hub.backfill(req.Room, *req.Range)
+	if err != nil {
+		log.Println("Cannot backfill:", err)
+		sendError(c, clientErrorf(codeInternal, "cannot backfill room"))
+		return
+	}
+	for _, msg := range msgs {
+		if !c.queue.push(msg) {
+			sendError(c, clientErrorf(codeBusy, "too many messages queued, backfill cut short"))
+			return
+		}
+	}
+}
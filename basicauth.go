@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var basicAuthFile = flag.String("basic-auth-file", "", "file with user:password lines, or tenant/user:password for users of one of -tenants; when set, /broadcast requires HTTP basic auth, and credentials only work for their own tenant")
+
+// basicAuthKey names a user of a tenant.
+type basicAuthKey struct {
+	tenant, user string
+}
+
+var (
+	basicAuthOnce  sync.Once
+	basicAuthUsers map[basicAuthKey][32]byte
+)
+
+// loadBasicAuth reads the credentials once. Passwords are only kept hashed so
+// comparing them takes the same time whatever their length.
+func loadBasicAuth() map[basicAuthKey][32]byte {
+	basicAuthOnce.Do(func() {
+		f, err := os.Open(*basicAuthFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		basicAuthUsers = make(map[basicAuthKey][32]byte)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, password, ok := strings.Cut(line, ":")
+			if !ok {
+				log.Fatalf("invalid line in %s, expected user:password", *basicAuthFile)
+			}
+			// Tenant names have no slashes.
+			tenant, name, found := strings.Cut(user, "/")
+			if !found {
+				tenant, name = "", user
+			} else if tenant == "" || !knownTenant(tenant) {
+				log.Fatalf("unknown tenant %q in %s", tenant, *basicAuthFile)
+			}
+			basicAuthUsers[basicAuthKey{tenant, name}] = sha256.Sum256([]byte(password))
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+	})
+	return basicAuthUsers
+}
+
+// basicAuthUser returns the user r authenticated as with credentials from
+// -basic-auth-file for the tenant of r, or an empty string.
+func basicAuthUser(r *http.Request) string {
+	if *basicAuthFile == "" {
+		return ""
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+	want, known := loadBasicAuth()[basicAuthKey{requestTenant(r), user}]
+	got := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare(want[:], got[:]) != 1 || !known {
+		return ""
+	}
+	return user
+}
+
+// requireBasicAuth lets through only requests with credentials listed in
+// -basic-auth-file, or every request when no file is configured.
+func requireBasicAuth(h http.Handler) http.Handler {
+	if *basicAuthFile == "" {
+		return h
+	}
+	loadBasicAuth()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if basicAuthUser(r) == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chat", charset="UTF-8"`)
+			httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requireAdmin lets through admins of the tenant of the request, logged in
+// with a session and, when -basic-auth-file is set, holders of its
+// credentials.
+func requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sessionRole(r) != adminRole && basicAuthUser(r) == "" {
+			if *basicAuthFile != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="chat", charset="UTF-8"`)
+			}
+			httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requireServerAdmin lets through admins of the default tenant, who manage
+// what all tenants share, such as settings, features and the audit log.
+func requireServerAdmin(h http.Handler) http.Handler {
+	return requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestTenant(r) != "" {
+			httpError(w, r, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
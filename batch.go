@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxBatchSize  = 1000
+	maxBatchBytes = 1 << 20
+)
+
+// batchIndex details which message of a batch an error is about.
+func batchIndex(i int) any {
+	return map[string]int{"index": i}
+}
+
+// batchMessage is one entry of a POST /broadcast/batch request, or the
+// body of a room broadcast.
+type batchMessage struct {
+	Author string `json:"author"`
+	Body   string `json:"body"`
+	Room   string `json:"room"`
+	Retain bool   `json:"retain"`
+	QoS    int    `json:"qos"`
+	// Priority is urgent, system, normal or bulk.
+	Priority string `json:"priority"`
+	// Select holds key=value criteria clients must match, see selector.
+	Select []string `json:"select"`
+}
+
+// batchBroadcastHandler broadcasts a JSON array of messages, each to its
+// own room or to everyone. Either all of them are sent or, when any is
+// invalid, none.
+func batchBroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var batch []batchMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&batch); err != nil {
+		httpError(w, r, "Invalid batch: "+err.Error(), decodeStatus(err))
+		return
+	}
+	if len(batch) == 0 || len(batch) > maxBatchSize {
+		httpError(w, r, "A batch holds 1 to "+strconv.Itoa(maxBatchSize)+" messages", http.StatusBadRequest)
+		return
+	}
+
+	corr, err := requestCorrelationID(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msgs := make([]*Message, len(batch))
+	for i, b := range batch {
+		if b.Body == "" && !b.Retain {
+			httpErrorDetails(w, r, "Missing body", http.StatusBadRequest, batchIndex(i))
+			return
+		}
+		if b.QoS != qosAtMostOnce && b.QoS != qosAtLeastOnce {
+			httpErrorDetails(w, r, "Invalid qos", http.StatusBadRequest, batchIndex(i))
+			return
+		}
+		if hasWildcard(b.Room) {
+			httpErrorDetails(w, r, "Wildcard room", http.StatusBadRequest, batchIndex(i))
+			return
+		}
+		priority, err := parsePriority(b.Priority)
+		if err != nil {
+			httpErrorDetails(w, r, err.Error(), http.StatusBadRequest, batchIndex(i))
+			return
+		}
+		if b.Author == "" {
+			b.Author = "Server"
+		}
+		sel, err := parseSelector(b.Select)
+		if err != nil {
+			httpErrorDetails(w, r, err.Error(), http.StatusBadRequest, batchIndex(i))
+			return
+		}
+		msgs[i] = &Message{Author: b.Author, Body: b.Body, Room: b.Room, Retain: b.Retain, QoS: b.QoS, Priority: priority, Select: sel, RequestID: requestID(r), CorrelationID: corr}
+	}
+
+	log.Printf("Batch of %d messages requested by %s, correlation %s", len(msgs), clientIP(r), corr)
+	auditAction(requestActor(r), "broadcast-batch", "", strconv.Itoa(len(msgs))+" messages")
+	ds := hubFor(r).broadcastBatch(msgs)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ds)
+}
+
+// roomBroadcastHandler serves POST /rooms/{room}/broadcast, sending the
+// JSON encoded {author, body} message to the clients in room. Room may be a
+// topic spanning several path segments.
+func roomBroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	room := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/broadcast")
+	if room == "" || hasWildcard(room) {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var in batchMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&in); err != nil {
+		httpError(w, r, "Invalid message", decodeStatus(err))
+		return
+	}
+	if (in.Body == "" && !in.Retain) || (in.QoS != qosAtMostOnce && in.QoS != qosAtLeastOnce) {
+		httpError(w, r, "Invalid message", http.StatusBadRequest)
+		return
+	}
+	priority, err := parsePriority(in.Priority)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if in.Author == "" {
+		in.Author = "Server"
+	}
+	sel, err := parseSelector(append(in.Select, r.URL.Query()["select"]...))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	at, err := requestedDeliveryTime(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	corr, err := requestCorrelationID(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Broadcast to room %s requested by %s, correlation %s", room, clientIP(r), corr)
+	auditAction(requestActor(r), "broadcast", room, in.Body)
+	msg := &Message{Author: in.Author, Body: in.Body, Room: room, Retain: in.Retain, QoS: in.QoS, Priority: priority, Select: sel, RequestID: requestID(r), CorrelationID: corr}
+	if !at.IsZero() {
+		scheduleFromRequest(w, r, msg, at)
+		return
+	}
+	d := hubFor(r).broadcast(msg)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bridgeHTTP calls the APIs of the chats bridged to.
+var bridgeHTTP = &http.Client{Timeout: 10 * time.Second}
+
+var bridgeTenant = flag.String("bridge-tenant", "", "tenant whose rooms the Slack, Discord and Matrix bridges mirror, the default one when empty; their endpoints only answer requests of that tenant")
+
+// bridge mirrors rooms to the channels of another chat. On this side it is
+// a client like any other, named after the bridge, that joined the rooms;
+// its connection hands their messages to send. Messages from the other
+// chat come in through relay.
+type bridge struct {
+	name string
+	hub  *Hub
+	// rooms maps each room to its channel, and channels back.
+	rooms    map[string]string
+	channels map[string]string
+	send     func(channel string, msg *Message) error
+}
+
+// bridgeConn is the connection of a bridge's client.
+type bridgeConn struct {
+	b      *bridge
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Send passes on the chat messages of the bridged rooms, except those the
+// bridge relayed in itself. Failures are logged rather than ending the
+// bridge.
+func (c *bridgeConn) Send(msg *Message) error {
+	if (msg.Type != "" && msg.Type != typeMessage) || msg.Bridge == c.b.name || msg.Body == "" {
+		return nil
+	}
+	channel, ok := c.b.rooms[msg.Room]
+	if !ok {
+		return nil
+	}
+	if err := c.b.send(channel, msg); err != nil {
+		log.Printf("Cannot bridge message %s to %s: %v", msg.ID, c.b.name, err)
+	}
+	return nil
+}
+
+// Receive waits for the bridge to close, nothing is read from it.
+func (c *bridgeConn) Receive(msg *Message) error {
+	<-c.closed
+	return io.EOF
+}
+
+func (c *bridgeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+// startBridge connects the bridge called name, mirroring rooms to their
+// channels with send.
+func startBridge(name string, rooms map[string]string, send func(channel string, msg *Message) error) *bridge {
+	h := tenantHub(*bridgeTenant)
+	if h == nil {
+		log.Fatalf("Cannot start the %s bridge: unknown tenant %q", name, *bridgeTenant)
+	}
+	b := &bridge{name: name, hub: h, rooms: rooms, channels: make(map[string]string), send: send}
+	for room, channel := range rooms {
+		b.channels[channel] = room
+	}
+
+	client := NewClient(&bridgeConn{b: b, closed: make(chan struct{})})
+	client.hub = h
+	client.nick = name
+	if err := h.addClientAndGreet(client); err != nil {
+		log.Fatalf("Cannot start the %s bridge: %v", name, err)
+	}
+	for room := range rooms {
+		if err := h.join(client, room); err != nil {
+			log.Fatalf("Cannot bridge room %s to %s: %v", room, name, err)
+		}
+	}
+	go func() {
+		defer h.removeClient(client)
+		client.listen(context.Background())
+	}()
+	log.Printf("Bridging %d rooms to %s", len(rooms), name)
+	return b
+}
+
+// relay broadcasts a message from channel of the other chat to its room.
+func (b *bridge) relay(channel, author, body string) {
+	room, ok := b.channels[channel]
+	if !ok || body == "" {
+		return
+	}
+	msg := &Message{Author: author, Body: body, Room: room, Bridge: b.name}
+	if err := filterMessage(msg); err != nil {
+		log.Printf("Dropping message from %s on %s: %v", author, b.name, err)
+		return
+	}
+	b.hub.broadcast(msg)
+}
+
+// serves reports whether r, posted to an endpoint of b, comes for the
+// tenant it mirrors.
+func (b *bridge) serves(r *http.Request) bool {
+	return b != nil && requestTenant(r) == b.hub.tenant
+}
+
+// parseBridgeRooms reads comma separated room=channel pairs. Rooms cannot
+// be the lobby or patterns.
+func parseBridgeRooms(name, pairs string) map[string]string {
+	rooms := make(map[string]string)
+	for _, pair := range strings.Split(pairs, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		room, channel, ok := strings.Cut(pair, "=")
+		if !ok || room == "" || channel == "" || hasWildcard(room) || !validPattern(room) {
+			log.Fatalf("invalid %s bridge room %q, expected room=channel", name, pair)
+		}
+		rooms[room] = channel
+	}
+	return rooms
+}
+
+// readSecretFile returns the trimmed contents of a file holding a token or
+// secret.
+func readSecretFile(name string) string {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// retryAfter is how long a rate limited API asks to wait, in seconds, or
+// a second if it does not say.
+func retryAfter(resp *http.Response) time.Duration {
+	if s, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil && s > 0 {
+		return time.Duration(s * float64(time.Second))
+	}
+	return time.Second
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// Buffers larger than this are left to the garbage collector rather than
+// pooled, so one huge message does not pin its memory forever.
+const maxPooledBuffer = 64 << 10
+
+var bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns buf to the pool. Nothing may use its bytes afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// frameEncoder writes msg to buf in the format of a subprotocol and
+// returns the websocket frame type to send it in.
+type frameEncoder func(buf *bytes.Buffer, msg *Message) (byte, error)
+
+// marshalWith adapts enc to a websocket.Codec, for callers that keep the
+// frame.
+func marshalWith(enc frameEncoder) func(v interface{}) ([]byte, byte, error) {
+	return func(v interface{}) ([]byte, byte, error) {
+		var buf bytes.Buffer
+		payloadType, err := enc(&buf, v.(*Message))
+		return buf.Bytes(), payloadType, err
+	}
+}
+
+// encodeJSON writes v to buf the way json.Marshal would.
+func encodeJSON(buf *bytes.Buffer, v interface{}) error {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	// Encode ends with a newline, Marshal does not.
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+// sendFrame writes one frame to ws from a pooled buffer. Calls must not
+// overlap, which the single writer of each client guarantees.
+func sendFrame(ws *websocket.Conn, encode func(buf *bytes.Buffer) (byte, error)) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	payloadType, err := encode(buf)
+	if err != nil {
+		return err
+	}
+	ws.PayloadType = payloadType
+	_, err = ws.Write(buf.Bytes())
+	return err
+}
+
+// sendJSON is websocket.JSON.Send without allocating a buffer per frame.
+func sendJSON(ws *websocket.Conn, v interface{}) error {
+	return sendFrame(ws, func(buf *bytes.Buffer) (byte, error) {
+		return websocket.TextFrame, encodeJSON(buf, v)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate from certFile and keyFile, loading it
+// again when either file changes or the process receives SIGHUP, so rotated
+// certificates are picked up without dropping connections.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	go cr.watch()
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime := cr.lastModified()
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *certReloader) lastModified() time.Time {
+	var latest time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+func (cr *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			cr.mu.RLock()
+			unchanged := cr.lastModified().Equal(cr.modTime)
+			cr.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+
+		// A failed reload, e.g. while the files are half written, keeps the
+		// previous certificate in use.
+		if err := cr.reload(); err != nil {
+			log.Println("Cannot reload TLS certificate:", err)
+			continue
+		}
+		log.Println("Reloaded TLS certificate from", cr.certFile)
+		auditAction("system", "reload-certificate", cr.certFile, "")
+	}
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	return cr.cert, nil
+}
+
+var (
+	certsOnce sync.Once
+	certs     *certReloader
+	certsErr  error
+)
+
+// serverCertificates returns the reloader shared by all tls:// listeners.
+func serverCertificates() (*certReloader, error) {
+	certsOnce.Do(func() {
+		certs, certsErr = newCertReloader(*tlsCert, *tlsKey)
+	})
+	return certs, certsErr
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+)
+
+var chunkTimeout = flag.Duration("chunk-timeout", 30*time.Second, "how long the chunks of a message may take to arrive before what was received is dropped")
+
+// typeChunk carries part of a message too large for one frame, such as a
+// WebTransport datagram. The server puts the parts back together, in the
+// order of their index, and handles the whole as the message the first
+// chunk describes.
+const typeChunk = "chunk"
+
+const (
+	// maxChunks caps the parts of a message, maxChunkedSize their total
+	// size, and maxPartialMessages how many messages a client may be
+	// sending in chunks at once.
+	maxChunks          = 256
+	maxChunkedSize     = 1 << 20
+	maxPartialMessages = 4
+)
+
+// chunk says which part of which message a chunk is.
+type chunk struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+	Total int    `json:"total"`
+}
+
+// partialMessage is a message whose chunks are arriving.
+type partialMessage struct {
+	first   *Message
+	parts   []string
+	have    []bool
+	got     int
+	size    int
+	expires time.Time
+}
+
+var (
+	errChunkInvalid   = &validationError{"chunk needs an id, and an index below a total of at most 256"}
+	errChunkTooLarge  = clientErrorf(codeTooLarge, "chunked message is larger than %d bytes", maxChunkedSize)
+	errChunksTooMany  = clientErrorf(codeRateLimited, "too many chunked messages at once")
+	errChunkDifferent = &validationError{"chunks of a message must agree on its total"}
+)
+
+// addChunk collects msg, a chunk from c, and returns the whole message once
+// its last chunk arrived. It is only called by the reader of c.
+func (c *Client) addChunk(msg *Message) (*Message, error) {
+	ch := msg.Chunk
+	if ch == nil || ch.ID == "" || ch.Total < 1 || ch.Total > maxChunks || ch.Index < 0 || ch.Index >= ch.Total {
+		return nil, errChunkInvalid
+	}
+
+	now := time.Now()
+	for id, p := range c.chunks {
+		if now.After(p.expires) {
+			debugf("Dropping chunked message %s of %s after %d of %d chunks", id, c.nick, p.got, len(p.parts))
+			delete(c.chunks, id)
+		}
+	}
+	p := c.chunks[ch.ID]
+	if p == nil {
+		if len(c.chunks) >= maxPartialMessages {
+			return nil, errChunksTooMany
+		}
+		if c.chunks == nil {
+			c.chunks = make(map[string]*partialMessage)
+		}
+		p = &partialMessage{parts: make([]string, ch.Total), have: make([]bool, ch.Total), expires: now.Add(*chunkTimeout)}
+		c.chunks[ch.ID] = p
+	}
+	if len(p.parts) != ch.Total {
+		delete(c.chunks, ch.ID)
+		return nil, errChunkDifferent
+	}
+	if ch.Index == 0 {
+		p.first = msg
+	}
+	if !p.have[ch.Index] {
+		p.have[ch.Index] = true
+		p.got++
+	}
+	p.size += len(msg.Body) - len(p.parts[ch.Index])
+	if p.size > maxChunkedSize {
+		delete(c.chunks, ch.ID)
+		return nil, errChunkTooLarge
+	}
+	p.parts[ch.Index] = msg.Body
+	if p.got < ch.Total {
+		return nil, nil
+	}
+
+	delete(c.chunks, ch.ID)
+	whole := p.first
+	whole.Type, whole.Chunk = typeMessage, nil
+	whole.Body = strings.Join(p.parts, "")
+	return whole, nil
+}
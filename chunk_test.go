@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func chunkOf(id string, index, total int, body string) *Message {
+	return &Message{Type: typeChunk, Room: "r", Body: body, Chunk: &chunk{ID: id, Index: index, Total: total}}
+}
+
+func TestAddChunkReassemblesInAnyOrder(t *testing.T) {
+	c := &Client{}
+	for _, msg := range []*Message{chunkOf("m", 2, 3, "c"), chunkOf("m", 0, 3, "a"), chunkOf("m", 0, 3, "a")} {
+		if whole, err := c.addChunk(msg); err != nil || whole != nil {
+			t.Fatalf("got %v, %v before the last chunk", whole, err)
+		}
+	}
+	whole, err := c.addChunk(chunkOf("m", 1, 3, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whole == nil || whole.Body != "abc" || whole.Type != typeMessage || whole.Chunk != nil || whole.Room != "r" {
+		t.Errorf("got %+v, want the message abc in room r", whole)
+	}
+	if len(c.chunks) != 0 {
+		t.Errorf("%d partial messages left", len(c.chunks))
+	}
+}
+
+func TestAddChunkLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		// before are sent first, and must be accepted.
+		before []*Message
+		msg    *Message
+		want   error
+	}{
+		{"no chunk", nil, &Message{Type: typeChunk}, errChunkInvalid},
+		{"no id", nil, chunkOf("", 0, 1, "a"), errChunkInvalid},
+		{"index past total", nil, chunkOf("m", 2, 2, "a"), errChunkInvalid},
+		{"negative index", nil, chunkOf("m", -1, 2, "a"), errChunkInvalid},
+		{"too many chunks", nil, chunkOf("m", 0, maxChunks+1, "a"), errChunkInvalid},
+		{"totals differ", []*Message{chunkOf("m", 0, 3, "a")}, chunkOf("m", 1, 4, "b"), errChunkDifferent},
+		{"too large", []*Message{chunkOf("m", 0, 3, strings.Repeat("a", maxChunkedSize/2))},
+			chunkOf("m", 1, 3, strings.Repeat("b", maxChunkedSize/2+1)), errChunkTooLarge},
+		{"too many messages", []*Message{chunkOf("1", 0, 2, "a"), chunkOf("2", 0, 2, "a"), chunkOf("3", 0, 2, "a"), chunkOf("4", 0, 2, "a")},
+			chunkOf("5", 0, 2, "a"), errChunksTooMany},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{}
+			for _, msg := range tt.before {
+				if _, err := c.addChunk(msg); err != nil {
+					t.Fatalf("chunk %+v refused: %v", msg.Chunk, err)
+				}
+			}
+			if _, err := c.addChunk(tt.msg); err != tt.want {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddChunkCountsResentChunksOnce(t *testing.T) {
+	c := &Client{}
+	// Sending a chunk again replaces it rather than adding to the size.
+	big := strings.Repeat("a", maxChunkedSize/2)
+	for i := 0; i < 3; i++ {
+		if _, err := c.addChunk(chunkOf("m", 0, 2, big)); err != nil {
+			t.Fatalf("resent chunk refused: %v", err)
+		}
+	}
+	whole, err := c.addChunk(chunkOf("m", 1, 2, "b"))
+	if err != nil || whole == nil || len(whole.Body) != len(big)+1 {
+		t.Errorf("got %v, %v, want the whole message", whole != nil, err)
+	}
+}
@@ -1,64 +1,467 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"io"
 	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"golang.org/x/net/websocket"
+	"golang.org/x/sync/errgroup"
 )
 
+type Conn interface {
+	Send(msg *Message) error
+	Receive(msg *Message) error
+}
+
 type Client struct {
-	connection *websocket.Conn
-	ch         chan *Message
-	close      chan bool
+	id         uint64
+	connection Conn
+	// hub serves the client's tenant.
+	hub *Hub
+	// vhost configures clients of the host the client connected to, if
+	// any, see lookupVhost.
+	vhost *vhost
+	// queue holds the messages broadcast to the client, by priority.
+	queue *sendQueue
+	// writes queues other frames, such as replies and errors, which must
+	// not be dropped. Only the writer goroutine writes to the connection.
+	writes chan func() error
+	// stopping is closed once the client is told to stop listening, and
+	// done once it did.
+	stopping chan struct{}
+	done     chan struct{}
+	rooms    map[string]bool
+
+	// addr is where the client connects from, when known.
+	addr string
+	// origin is the page a browser client connects from.
+	origin string
+	// identity is who the client authenticated as, if anyone, and name
+	// what they are called.
+	identity string
+	name     string
+	role     string
+	// locale picks the translations of server messages, see
+	// requestLocale. It is empty for English.
+	locale string
+	// nick, when set, replaces whatever author the client puts on its
+	// messages.
+	nick string
+	// meta holds what the client announced about itself when connecting,
+	// see clientMeta, for broadcasts targeting some clients only. It does
+	// not change after registration.
+	meta map[string][]string
+	// mu guards filter, which room goroutines read while delivering,
+	// status and closeReason.
+	mu sync.Mutex
+	// filter, when set, selects the chat messages the client wants.
+	filter map[string]string
+	// status is the one in the client's profile, shown in presence.
+	status string
+	// closeReason says why the connection ended, see closeWith.
+	closeReason string
+	// will is broadcast if the connection drops, see setWill.
+	will *Message
+	// sessionID resumes the rooms, subscription and undelivered messages
+	// of the client after a reconnect, see keepSession.
+	sessionID string
+	// observer clients receive broadcasts but cannot send, see observing.
+	observer bool
+	// heartbeatEvery is how often the client is pinged, see
+	// negotiateHeartbeat. It does not change after registration.
+	heartbeatEvery time.Duration
+	// chunks holds the messages the client is sending in chunks, by ID.
+	// Only its reader uses it.
+	chunks map[string]*partialMessage
+
+	spam    spamState
+	limiter tokenBucket
+
+	connectedAt time.Time
+	// lastActive is when the client last sent anything, and lastSaved
+	// when that was last stored, in Unix nanoseconds.
+	lastActive atomic.Int64
+	lastSaved  atomic.Int64
+	// skipped counts the messages in a row the client's queue had no room
+	// for.
+	skipped atomic.Int32
 }
 
-func NewClient(ws *websocket.Conn) Client {
-	ch := make(chan *Message, 100)
-	close := make(chan bool)
+func NewClient(conn Conn) *Client {
+	c := &Client{
+		id:         lastClientID.Add(1),
+		connection: conn,
+		hub:        hub,
+		queue:      newSendQueue(100),
+		writes:     make(chan func() error, 16),
+		stopping:   make(chan struct{}),
+		done:       make(chan struct{}),
+		rooms:      make(map[string]bool),
 
-	return Client{ws, ch, close}
+		connectedAt:    time.Now(),
+		heartbeatEvery: *heartbeatInterval,
+	}
+	c.lastActive.Store(c.connectedAt.UnixNano())
+	return c
 }
 
-func (c *Client) listen() {
-	go c.listenToWrite()
-	c.listenToRead()
+// listen serves the client until its connection fails or ctx is done. The
+// reader handles what the client sends, the writer is the only goroutine
+// writing to the connection and the heartbeat ends connections of clients
+// that went quiet; when one stops, so do the others.
+func (c *Client) listen(ctx context.Context) {
+	defer close(c.done)
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() (err error) {
+		defer recoverError("read loop", &err)
+		return c.listenToRead()
+	})
+	g.Go(func() (err error) {
+		defer recoverError("write loop", &err)
+		return c.listenToWrite(ctx)
+	})
+	g.Go(func() (err error) {
+		defer recoverError("heartbeat", &err)
+		return c.heartbeat(ctx)
+	})
+	g.Go(func() error {
+		// A blocked Receive only returns once the connection is closed.
+		<-ctx.Done()
+		close(c.stopping)
+		c.closeConnection()
+		return nil
+	})
+	err := g.Wait()
+	if err != io.EOF && !errors.Is(err, context.Canceled) {
+		log.Println("Client connection failed:", err)
+	}
+	c.setCloseReason(closeReasonFor(err))
 }
 
-func (c *Client) listenToWrite() {
+func (c *Client) listenToWrite(ctx context.Context) error {
 	for {
 		select {
-		case msg := <-c.ch:
-			log.Println("Send:", msg)
-			websocket.JSON.Send(c.connection, msg)
+		case write := <-c.writes:
+			if err := write(); err != nil {
+				return err
+			}
 
-		case <-c.close:
-			c.close <- true
-			return
+		case <-c.queue.ready:
+			for msg := c.queue.pop(); msg != nil; msg = c.queue.pop() {
+				if err := c.writeQueued(msg); err != nil {
+					return err
+				}
+				// Replies and errors go ahead of the rest of the queue.
+				select {
+				case write := <-c.writes:
+					if err := write(); err != nil {
+						return err
+					}
+				default:
+				}
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
-func (c *Client) listenToRead() {
+func (c *Client) writeQueued(msg *Message) error {
+	debugf("Send: %v", msg)
+	start := time.Now()
+	err := c.connection.Send(msg)
+	clientWriteDuration.Observe(time.Since(start).Seconds())
+	msg.written()
+	return err
+}
+
+// listenToRead returns io.EOF when the client goes away.
+func (c *Client) listenToRead() error {
 	log.Println("Listening read from client")
 	for {
-		select {
-		case <-c.close:
-			c.close <- true
+		var msg Message
+		err := c.connection.Receive(&msg)
+		var netErr net.Error
+		switch {
+		case err == io.EOF || errors.Is(err, net.ErrClosed):
+			return io.EOF
+		case errors.As(err, &netErr):
+			return err
+		case err != nil:
+			if verr, ok := err.(*validationError); ok {
+				sendError(c, verr)
+			}
+			// Otherwise the frame could not be decoded, skip it.
+		default:
+			debugf("Received: %+v", msg)
+			msg.received = time.Now()
+			c.active()
+			c.handle(&msg)
+		}
+	}
+}
+
+// write queues a frame for the writer goroutine. It is dropped if the
+// client is no longer listening, or stopping: the writer may have exited
+// with writes full, and the reader must not wait for it.
+func (c *Client) write(f func() error) {
+	select {
+	case c.writes <- f:
+	case <-c.stopping:
+	case <-c.done:
+	}
+}
+
+// send queues msg ahead of the broadcast messages.
+func (c *Client) send(msg *Message) {
+	c.write(func() error {
+		return c.connection.Send(msg)
+	})
+}
+
+func (c *Client) closeConnection() {
+	if closer, ok := c.connection.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// handle acts on a message received from the client: control messages are
+// dealt with here, chat messages published and anything else refused.
+func (c *Client) handle(msg *Message) {
+	if c.observer && !observerAllowed(msg) {
+		sendError(c, errObserver)
+		return
+	}
+	switch msg.Type {
+	case typeSubscribe, typeUnsubscribe:
+		if err := validFilter(msg.Filter); err != nil {
+			sendError(c, err)
+		} else if msg.Type == typeSubscribe {
+			c.hub.subscribe(c, msg.Filter)
+		} else {
+			c.hub.subscribe(c, nil)
+		}
+	case typeBackfill:
+		if err := checkFeature(featureHistory); err != nil {
+			sendError(c, err)
+			return
+		}
+		sendBackfill(c, msg)
+	case typeRead:
+		if err := c.hub.markRead(c, msg.Room, msg.Seq); err != nil {
+			sendError(c, err)
+		}
+	case typeReceipts:
+		sendReceipts(c, msg)
+	case typePresence:
+		sendPresence(c, msg)
+	case typeTime:
+		sendTime(c, msg)
+	case typePing:
+		c.send(&Message{Type: typePong, Author: "Server"})
+	case typePong:
+		// Receiving it was all that mattered, see heartbeat.
+	case typeAck:
+		c.hub.ack(c, msg.Ref)
+	case typeWill:
+		if msg.Body != "" {
+			if err := c.check(msg); err != nil {
+				sendError(c, err)
+				return
+			}
+		}
+		c.hub.setWill(c, msg)
+	case typeDisconnect:
+		c.hub.setWill(c, nil)
+	case typeTyping:
+		if err := c.typing(msg.Room); err != nil {
+			sendError(c, err)
+		}
+	case typeReaction:
+		if err := checkReaction(msg); err != nil {
+			sendError(c, err)
+			return
+		}
+		msg.At = nil
+		c.publish(msg, time.Time{})
+	case typeChunk:
+		whole, err := c.addChunk(msg)
+		if err != nil {
+			sendError(c, err)
+		} else if whole != nil {
+			c.handle(whole)
+		}
+	case typeOffer, typeAnswer, typeICECandidate:
+		if err := c.hub.signal(c, msg); err != nil {
+			sendError(c, err)
+		}
+	case typeFloor:
+		if err := c.hub.floor(c, msg); err != nil {
+			sendError(c, err)
+		}
+	case typeAudio:
+		if err := c.hub.relayAudio(c, msg); err != nil {
+			sendError(c, err)
+		}
+	case typeSchedule:
+		if err := checkFeature(featureScheduling); err != nil {
+			sendError(c, err)
+			return
+		}
+		if msg.At == nil {
+			sendError(c, &validationError{"schedule needs a delivery time in at"})
 			return
+		}
+		if c.reader() == "" {
+			sendError(c, &validationError{"scheduling needs a nickname"})
+			return
+		}
+		at := *msg.At
+		msg.Type, msg.At = typeMessage, nil
+		if err := checkDeliveryTime(at); err != nil {
+			sendError(c, err)
+			return
+		}
+		c.publish(msg, at)
+	case typeUnschedule:
+		switch err := c.hub.unschedule(msg.Ref, c.reader()); {
+		case err == errNoScheduled:
+			sendError(c, err)
+		case err != nil:
+			log.Println("Cannot cancel scheduled message:", err)
+			sendError(c, clientErrorf(codeInternal, "cannot cancel scheduled message"))
+		}
+	default:
+		if !publishable[msg.Type] {
+			sendError(c, &validationError{"cannot send messages of type " + msg.Type})
+			return
+		}
+		msg.At = nil
+		c.publish(msg, time.Time{})
+	}
+}
+
+// publishable are the types of messages clients publish as they are. The
+// rest are requests handled above, or only ever sent by the server.
+var publishable = map[string]bool{
+	"":              true,
+	typeMessage:     true,
+	typeKeyExchange: true,
+}
+
+// publish runs a message from the client through the checks and filters
+// and broadcasts it, or schedules it when at is set.
+func (c *Client) publish(msg *Message, at time.Time) {
+	if duplicate(c, msg) {
+		log.Println("Dropping repeated message from", c.nick)
+		return
+	}
+	if err := c.check(msg); err != nil {
+		sendError(c, err)
+		return
+	}
+
+	msg.Author = c.author()
+	msg.Profile = c.profile()
+	if msg.Type != typeReaction {
+		msg.Ref = ""
+	}
+	msg.Preview, msg.Filter, msg.Range, msg.Stats, msg.Features, msg.Receipts, msg.Presence = nil, nil, nil, nil, nil, nil, nil
+	msg.ReconnectAfter, msg.RequestID, msg.Code, msg.PresenceVersion, msg.Change = 0, "", "", 0, ""
+	msg.ServerTime, msg.ClientTime, msg.Bridge, msg.Audio = 0, 0, "", nil
+	msg.Tags, msg.Notes, msg.Encoding, msg.Chunk = nil, nil, "", nil
+	if msg.QoS != qosAtLeastOnce {
+		msg.QoS = qosAtMostOnce
+	}
 
+	if !applyRules(c, msg) {
+		return
+	}
+	if err := scriptMessage(c, msg); err != nil {
+		sendError(c, err)
+		return
+	}
+	if err := extensionsMessage(c, msg); err != nil {
+		sendError(c, err)
+		return
+	}
+	if held(c, msg) {
+		if err := c.hub.hold(c, msg, at); err != nil {
+			sendError(c, err)
+		}
+		return
+	}
+	if !at.IsZero() {
+		id, err := c.hub.scheduleMessage(msg, at, c.reader())
+		switch {
+		case err == errTooManyScheduled:
+			sendError(c, err)
+		case err != nil:
+			log.Println("Cannot schedule message:", err)
+			sendError(c, clientErrorf(codeInternal, "cannot schedule message"))
 		default:
-			var msg Message
-			err := websocket.JSON.Receive(c.connection, &msg)
-			fmt.Printf("Received: %+v\n", msg)
-			if err == io.EOF {
-				c.close <- true
-			} else if err != nil {
-				// c.server.Err(err)
-			} else {
-				broadcast(&msg)
-			}
+			c.send(&Message{Type: typeScheduled, Author: "Server", Room: msg.Room, Ref: id, At: &at, CorrelationID: msg.CorrelationID})
 		}
+		return
+	}
+	switch d := c.hub.broadcast(msg); {
+	case d.OverQuota:
+		sendError(c, errTenantThrottled)
+		return
+	case d.Shed:
+		sendError(c, clientErrorf(codeBusy, "the server is too busy, message dropped"))
+		return
+	}
+	c.hub.unfurl(msg)
+}
+
+// check is what a message from the client must pass to be published: it
+// is well formed, allowed, within the limits and not spam, and passes the
+// content filters, which may change it.
+func (c *Client) check(msg *Message) error {
+	if err := checkCorrelationID(msg); err != nil {
+		return err
+	}
+	if err := checkPriority(msg); err != nil {
+		return err
+	}
+	if !acceptable(msg) {
+		log.Println("Dropping unacceptable message from", c.nick)
+		return errNotAllowed
+	}
+	if err := checkLimits(c, msg); err != nil {
+		return err
+	}
+	if err := checkSpam(c, msg); err != nil {
+		return err
+	}
+	return filterMessage(msg)
+}
+
+// author is the name the messages of c go out under: its nickname, or
+// Anonymous for clients without one, never what they claim.
+func (c *Client) author() string {
+	if c.nick == "" {
+		return "Anonymous"
+	}
+	return c.nick
+}
+
+// profile looks up the stored profile of an authenticated client.
+func (c *Client) profile() *Profile {
+	if c.identity == "" {
+		return nil
+	}
+	p, err := dataStore().Profile(context.Background(), c.identity)
+	if err != nil {
+		log.Println("Profile lookup failed:", err)
 	}
+	return p
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxMetaValues = 16
+	maxMetaValue  = 64
+)
+
+// metaSources are what clients may declare about themselves when
+// connecting, by query parameter or header. Headers may list several
+// values separated by commas.
+var metaSources = []struct {
+	key, param, header string
+}{
+	{"client", "client", "X-Client-Name"},
+	{"version", "version", "X-Client-Version"},
+	{"device", "device", "X-Device-Type"},
+	{"tag", "tag", "X-Client-Tags"},
+}
+
+// clientMeta collects the declared metadata from the query and headers of
+// a handshake, leaving out values that are empty, too long or not
+// printable. header looks up all values of a header.
+func clientMeta(query url.Values, header func(name string) []string) map[string][]string {
+	meta := make(map[string][]string)
+	for _, src := range metaSources {
+		values := query[src.param]
+		for _, h := range header(src.header) {
+			values = append(values, strings.Split(h, ",")...)
+		}
+		for _, v := range values {
+			if v = strings.TrimSpace(v); validMetaValue(v) && len(meta[src.key]) < maxMetaValues {
+				meta[src.key] = append(meta[src.key], v)
+			}
+		}
+	}
+	return meta
+}
+
+func validMetaValue(v string) bool {
+	if v == "" || utf8.RuneCountInString(v) > maxMetaValue {
+		return false
+	}
+	for _, r := range v {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,19 @@
+package main
+
+import "time"
+
+// typeTime asks for the server's clock, to estimate the offset of the
+// client's: the client puts its time in ClientTime, and gets it back along
+// with the server's in ServerTime. Half the round trip later is when the
+// server read its clock.
+const typeTime = "time"
+
+// serverTime is the server time as sent to clients, in Unix milliseconds.
+func serverTime() int64 {
+	return time.Now().UnixMilli()
+}
+
+// sendTime answers a time request of c.
+func sendTime(c *Client, req *Message) {
+	c.send(&Message{Type: typeTime, Author: "Server", ClientTime: req.ClientTime, ServerTime: serverTime()})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"hash/crc32"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	clusterNodes = flag.String("cluster-nodes", "", "comma separated /replication URLs of the nodes of a cluster, this one included, such as wss://node1.example.com/replication; each room is owned by one node, chosen by consistent hashing, which numbers and remembers its messages")
+	clusterSelf  = flag.String("cluster-self", "", "which of -cluster-nodes is this node")
+)
+
+// ringPoints is how many points each node has on the hash ring, so rooms
+// spread evenly and move little when nodes come and go.
+const ringPoints = 128
+
+// hashRing assigns rooms to nodes by consistent hashing.
+type hashRing struct {
+	// members are the nodes, sorted.
+	members []string
+	points  []uint32
+	nodes   map[uint32]string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	r := &hashRing{members: slices.Clone(nodes), nodes: make(map[uint32]string)}
+	slices.Sort(r.members)
+	for _, node := range nodes {
+		for i := 0; i < ringPoints; i++ {
+			p := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			if _, taken := r.nodes[p]; !taken {
+				r.nodes[p] = node
+				r.points = append(r.points, p)
+			}
+		}
+	}
+	slices.Sort(r.points)
+	return r
+}
+
+// owner returns the node owning key, the first on the ring after its hash.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i]]
+}
+
+// ring is the hash ring of the cluster, nil when not clustered.
+var ring atomic.Pointer[hashRing]
+
+func clustered() bool {
+	return ring.Load() != nil
+}
+
+// following are the other nodes of the cluster this one follows, with
+// what stops following them.
+var following = struct {
+	sync.Mutex
+	nodes map[string]chan struct{}
+}{nodes: make(map[string]chan struct{})}
+
+// checkCluster stops the server when it cannot join a cluster.
+func checkCluster() {
+	if *replicaOf != "" {
+		log.Fatal("a cluster node cannot be a -replica-of too")
+	}
+	if replication.secret == "" {
+		log.Fatal("cluster nodes need -replication-secret-file")
+	}
+	if *clusterSelf == "" {
+		log.Fatal("cluster nodes need -cluster-self")
+	}
+}
+
+// startCluster builds the ring of -cluster-nodes. Clusters whose nodes
+// come and go are kept in etcd instead, see startEtcd.
+func startCluster() {
+	if *clusterNodes == "" {
+		return
+	}
+	checkCluster()
+	var nodes []string
+	for _, node := range strings.Split(*clusterNodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	if !slices.Contains(nodes, *clusterSelf) {
+		log.Fatal("-cluster-self must be one of -cluster-nodes")
+	}
+	setClusterNodes(nodes)
+}
+
+// setClusterNodes makes nodes the cluster: rooms are spread over them and
+// the other nodes followed, each streaming the messages of the rooms it
+// owns. Nodes no longer in it are let go.
+func setClusterNodes(nodes []string) {
+	ring.Store(newHashRing(nodes))
+
+	following.Lock()
+	defer following.Unlock()
+
+	for _, node := range nodes {
+		if node != *clusterSelf && following.nodes[node] == nil {
+			stop := make(chan struct{})
+			following.nodes[node] = stop
+			go runReplica(node, stop)
+		}
+	}
+	for node, stop := range following.nodes {
+		if !slices.Contains(nodes, node) {
+			delete(following.nodes, node)
+			close(stop)
+			replication.upstreamMu.Lock()
+			if ws := replication.upstreams[node]; ws != nil {
+				ws.Close()
+			}
+			replication.upstreamMu.Unlock()
+		}
+	}
+	log.Printf("Clustered with %d nodes as %s", len(nodes), *clusterSelf)
+}
+
+// upstream returns the node that broadcasts to room instead of this one:
+// the primary of a replica, or the owner of the room in a cluster. It is
+// empty when this node does.
+func (h *Hub) upstream(room string) string {
+	if *replicaOf != "" {
+		return *replicaOf
+	}
+	r := ring.Load()
+	if r == nil {
+		return ""
+	}
+	if owner := r.owner(h.storeKey(room)); owner != *clusterSelf {
+		return owner
+	}
+	return ""
+}
@@ -0,0 +1,226 @@
+// Command wsadmin manages a running chat server through its admin API.
+//
+//	wsadmin [flags] clients
+//	wsadmin [flags] disconnects
+//	wsadmin [flags] kick NICK
+//	wsadmin [flags] ban [-for DURATION] ip|identity|nick VALUE
+//	wsadmin [flags] unban ip|identity|nick VALUE
+//	wsadmin [flags] bans
+//	wsadmin [flags] broadcast [-room ROOM] MESSAGE
+//	wsadmin [flags] stats
+//	wsadmin [flags] tail
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	server       = flag.String("server", "http://localhost:3000", "base URL of the chat server")
+	user         = flag.String("user", os.Getenv("WSADMIN_USER"), "basic auth user, defaults to $WSADMIN_USER")
+	password     = flag.String("password", os.Getenv("WSADMIN_PASSWORD"), "basic auth password, defaults to $WSADMIN_PASSWORD")
+	broadcastKey = flag.String("broadcast-key-file", "", "file with the key broadcasts are signed with, when the server requires it")
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: wsadmin [flags] clients|disconnects|kick|ban|unban|bans|broadcast|stats|tail [args]")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+	}
+
+	args := flag.Args()[1:]
+	var err error
+	switch flag.Arg(0) {
+	case "clients":
+		err = show("GET", "/admin/clients", nil)
+	case "disconnects":
+		err = show("GET", "/admin/disconnects", nil)
+	case "kick":
+		if len(args) != 1 {
+			usage()
+		}
+		err = show("POST", "/admin/kick?nick="+url.QueryEscape(args[0]), nil)
+	case "ban", "unban":
+		err = ban(flag.Arg(0) == "unban", args)
+	case "bans":
+		err = show("GET", "/admin/bans", nil)
+	case "broadcast":
+		err = broadcast(args)
+	case "stats":
+		err = show("GET", "/admin/stats", nil)
+	case "tail":
+		err = tail()
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "wsadmin:", err)
+		os.Exit(1)
+	}
+}
+
+func ban(lift bool, args []string) error {
+	fs := flag.NewFlagSet("ban", flag.ExitOnError)
+	duration := fs.String("for", "", "how long the ban lasts, forever when empty")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	b := map[string]string{}
+	switch fs.Arg(0) {
+	case "ip", "identity", "nick":
+		b[fs.Arg(0)] = fs.Arg(1)
+	default:
+		usage()
+	}
+	method := "POST"
+	if lift {
+		method = "DELETE"
+	} else if *duration != "" {
+		b["duration"] = *duration
+	}
+	body, _ := json.Marshal(b)
+	return show(method, "/admin/bans", body)
+}
+
+func broadcast(args []string) error {
+	fs := flag.NewFlagSet("broadcast", flag.ExitOnError)
+	room := fs.String("room", "", "room to broadcast to, everyone when empty")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		usage()
+	}
+
+	body, _ := json.Marshal([]map[string]string{{"author": "Server", "body": strings.Join(fs.Args(), " "), "room": *room}})
+	return show("POST", "/broadcast/batch", body)
+}
+
+// show sends a request to the server and copies the response to stdout.
+func show(method, path string, body []byte) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(*server, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if *user != "" {
+		req.SetBasicAuth(*user, *password)
+	}
+	if strings.HasPrefix(path, "/broadcast/") && *broadcastKey != "" {
+		if err := signRequest(req, body); err != nil {
+			return err
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(resp.Body)
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(msg, &e) == nil && e.Message != "" {
+			msg = []byte(e.Message)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		fmt.Println("ok")
+		return nil
+	}
+	var out bytes.Buffer
+	data, _ := io.ReadAll(resp.Body)
+	if json.Indent(&out, data, "", "  ") != nil {
+		out.Reset()
+		out.Write(data)
+	}
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+// signRequest adds the headers the server's -broadcast-key-file check
+// expects.
+func signRequest(req *http.Request, body []byte) error {
+	key, err := os.ReadFile(*broadcastKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Nonce", hex.EncodeToString(nonce))
+
+	signed := []string{req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(nonce)}
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		signed = append(signed, hex.EncodeToString(sum[:]))
+	}
+	mac := hmac.New(sha256.New, []byte(strings.TrimSpace(string(key))))
+	mac.Write([]byte(strings.Join(signed, "\n")))
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// tail prints the events of /admin/ws, one JSON object per line, until the
+// server goes away.
+func tail() error {
+	origin := strings.TrimSuffix(*server, "/")
+	location := "ws" + strings.TrimPrefix(origin, "http") + "/admin/ws"
+	config, err := websocket.NewConfig(location, origin)
+	if err != nil {
+		return err
+	}
+	if *user != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(*user + ":" + *password))
+		config.Header.Set("Authorization", "Basic "+credentials)
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	for {
+		var event json.RawMessage
+		if err := websocket.JSON.Receive(ws, &event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		fmt.Println(string(event))
+	}
+}
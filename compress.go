@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var compressThreshold = flag.Int("compress-threshold", 4096, "bodies larger than this many bytes are sent gzipped, base64 encoded and marked enc=gzip to chat.v2.json clients that connect with ?compress=gzip, for deployments without permessage-deflate; 0 disables compression")
+
+// encodingGzip marks a body that is gzipped, then base64 encoded.
+const encodingGzip = "gzip"
+
+// maxInflatedBody caps what a compressed body a client sends may inflate
+// to, when no -max-message-size is smaller.
+const maxInflatedBody = 1 << 20
+
+// wantsCompression reports whether the client connecting through r asked
+// for compressed bodies.
+func wantsCompression(r *http.Request) bool {
+	return *compressThreshold > 0 && r.URL.Query().Get("compress") == encodingGzip
+}
+
+// encodeJSONV2Compressed is encodeJSONV2 with large bodies compressed.
+func encodeJSONV2Compressed(buf *bytes.Buffer, m *Message) (byte, error) {
+	if len(m.Body) <= *compressThreshold || m.Encoding != "" {
+		return encodeJSONV2(buf, m)
+	}
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	zw.Write([]byte(m.Body))
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	msg := *m
+	msg.Body, msg.Encoding = base64.StdEncoding.EncodeToString(zbuf.Bytes()), encodingGzip
+	return encodeJSONV2(buf, &msg)
+}
+
+// inflateBody restores the body of msg if the client sent it compressed.
+func inflateBody(msg *Message) error {
+	switch msg.Encoding {
+	case "":
+		return nil
+	case encodingGzip:
+	default:
+		return &validationError{"unknown body encoding " + msg.Encoding}
+	}
+	data, err := base64.StdEncoding.DecodeString(msg.Body)
+	if err != nil {
+		return &validationError{"invalid compressed body"}
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return &validationError{"invalid compressed body"}
+	}
+	limit := maxInflatedBody
+	if s := liveSettings().MaxMessageSize; s > 0 && s < limit {
+		limit = s
+	}
+	body, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	switch {
+	case err != nil:
+		return &validationError{"invalid compressed body"}
+	case len(body) > limit:
+		return &validationError{fmt.Sprintf("message is larger than %d bytes", limit)}
+	}
+	msg.Body, msg.Encoding = string(body), ""
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+)
+
+var (
+	rateLimit      = flag.Float64("rate-limit", 0, "messages per second each client may send on average, 0 for no limit")
+	rateBurst      = flag.Int("rate-burst", 10, "messages a client may send at once before -rate-limit applies")
+	broadcastRate  = flag.Float64("broadcast-rate-limit", 0, "requests per second each caller of the broadcast API may make on average, 0 for no limit")
+	broadcastBurst = flag.Int("broadcast-rate-burst", 20, "broadcast API requests a caller may make at once before -broadcast-rate-limit applies")
+	maxMessageSize = flag.Int("max-message-size", 0, "largest message body in bytes clients may send, 0 for no limit")
+	allowedOrigins = flag.String("allowed-origins", "", "comma separated origins websocket clients may connect from, such as https://chat.example.com; any when empty")
+	logLevel       = flag.String("log-level", "debug", "debug logs every message, info only connections and errors")
+)
+
+// settings are the parts of the configuration that can be changed while
+// the server runs, through PATCH /admin/config. They start out from the
+// flags of the same names.
+type settings struct {
+	RateLimit          float64  `json:"rateLimit"`
+	RateBurst          int      `json:"rateBurst"`
+	BroadcastRateLimit float64  `json:"broadcastRateLimit"`
+	BroadcastRateBurst int      `json:"broadcastRateBurst"`
+	MaxMessageSize     int      `json:"maxMessageSize"`
+	AllowedOrigins     []string `json:"allowedOrigins"`
+	LogLevel           string   `json:"logLevel"`
+	// Welcome and RoomWelcome are greeting templates, see greeting.
+	Welcome     string `json:"welcome"`
+	RoomWelcome string `json:"roomWelcome"`
+	MOTD        string `json:"motd"`
+	// Templates rewrite the bodies of broadcast messages, see transform.
+	Templates map[string]string `json:"templates"`
+
+	welcome, roomWelcome *template.Template
+	templates            map[string]*template.Template
+}
+
+var (
+	settingsOnce    sync.Once
+	currentSettings atomic.Pointer[settings]
+	// settingsMu serializes updates, readers just load currentSettings.
+	settingsMu sync.Mutex
+)
+
+// liveSettings returns the settings in effect. They must not be modified.
+func liveSettings() *settings {
+	settingsOnce.Do(func() {
+		s := &settings{
+			RateLimit:          *rateLimit,
+			RateBurst:          *rateBurst,
+			BroadcastRateLimit: *broadcastRate,
+			BroadcastRateBurst: *broadcastBurst,
+			MaxMessageSize:     *maxMessageSize,
+			AllowedOrigins:     []string{},
+			LogLevel:           *logLevel,
+			Welcome:            *welcomeGreeting,
+			RoomWelcome:        *roomWelcomeGreeting,
+			MOTD:               *motd,
+			Templates:          readTemplates(),
+		}
+		for _, o := range strings.Split(*allowedOrigins, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				s.AllowedOrigins = append(s.AllowedOrigins, o)
+			}
+		}
+		if err := s.validate(); err != nil {
+			log.Fatal(err)
+		}
+		currentSettings.Store(s)
+	})
+	return currentSettings.Load()
+}
+
+func (s *settings) validate() error {
+	if s.RateLimit < 0 || s.BroadcastRateLimit < 0 || s.MaxMessageSize < 0 {
+		return errors.New("rate limits and message size must not be negative")
+	}
+	if s.RateBurst < 1 || s.BroadcastRateBurst < 1 {
+		return errors.New("bursts must be at least 1")
+	}
+	if s.LogLevel != "debug" && s.LogLevel != "info" {
+		return fmt.Errorf("unknown log level %q, expected debug or info", s.LogLevel)
+	}
+	for _, o := range s.AllowedOrigins {
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid origin %q", o)
+		}
+	}
+	var err error
+	if s.welcome, err = parseGreeting(msgWelcome, s.Welcome); err != nil {
+		return err
+	}
+	if s.roomWelcome, err = parseGreeting(msgRoomWelcome, s.RoomWelcome); err != nil {
+		return err
+	}
+	return s.parseTemplates()
+}
+
+// originAllowed reports whether websocket clients may connect from origin.
+func (s *settings) originAllowed(origin string) bool {
+	return originListed(s.AllowedOrigins, origin)
+}
+
+// originListed reports whether origin is one of allowed, or allowed is
+// empty.
+func originListed(allowed []string, origin string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, o := range allowed {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// debugf logs per-message traffic, at the debug log level only.
+func debugf(format string, v ...any) {
+	if liveSettings().LogLevel == "debug" {
+		log.Printf(format, v...)
+	}
+}
+
+var errRateLimited = errors.New("you are sending messages too fast")
+
+// checkLimits returns an error when msg is too large or c sends faster than
+// the rate limit.
+func checkLimits(c *Client, msg *Message) error {
+	maxSize, _, _ := c.vhost.limits(liveSettings())
+	if maxSize > 0 && len(msg.Body) > maxSize {
+		return clientErrorf(codeTooLarge, "message is larger than %d bytes", maxSize)
+	}
+	return checkRate(c)
+}
+
+// checkRate returns an error when c sends faster than the rate limit, and
+// takes one message off its allowance otherwise.
+func checkRate(c *Client) error {
+	_, rate, burst := c.vhost.limits(liveSettings())
+	if rate > 0 {
+		if ok, _, _ := c.limiter.take(rate, burst, 1); !ok {
+			return errRateLimited
+		}
+	}
+	return nil
+}
+
+// settingsChanged logs the new settings s and disconnects the clients from
+// origins they no longer allow. It returns s as JSON.
+func settingsChanged(s *settings) []byte {
+	data, _ := json.Marshal(s)
+	log.Println("Settings changed:", string(data))
+	if n := disconnectAll(reasonKicked, func(c *Client) bool { return c.origin != "" && !c.vhost.originAllowed(s, c.origin) }); n > 0 {
+		log.Printf("Disconnected %d clients from origins no longer allowed", n)
+	}
+	return data
+}
+
+// configHandler serves /admin/config: GET returns the settings, PATCH
+// changes those given in the JSON body, for every instance when they share
+// -etcd. Clients connected from origins no longer allowed are
+// disconnected.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		settingsMu.Lock()
+		s := *liveSettings()
+		s.AllowedOrigins = append([]string{}, s.AllowedOrigins...)
+		s.Templates = maps.Clone(s.Templates)
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&s); err != nil {
+			settingsMu.Unlock()
+			httpError(w, r, "Invalid settings: "+err.Error(), decodeStatus(err))
+			return
+		}
+		if s.AllowedOrigins == nil {
+			s.AllowedOrigins = []string{}
+		}
+		if err := s.validate(); err != nil {
+			settingsMu.Unlock()
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		currentSettings.Store(&s)
+		settingsMu.Unlock()
+
+		data := settingsChanged(&s)
+		auditAction(requestActor(r), "configure", "", string(data))
+		if err := publishSettings(r.Context(), data); err != nil {
+			log.Println("Cannot share settings through etcd:", err)
+			httpError(w, r, "Settings changed here but not shared with the other instances", http.StatusBadGateway)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(liveSettings())
+}
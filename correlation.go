@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// correlationIDHeader carries the ID a caller uses to trace a notification
+// through its systems. Broadcasts pass it on to every recipient in the corr
+// field, and it shows in the logs.
+const correlationIDHeader = "X-Correlation-ID"
+
+var errInvalidCorrelationID = errors.New("correlation IDs are 1 to 64 letters, digits, dots, dashes or underscores")
+
+// requestCorrelationID returns the correlation ID of r, falling back to
+// the request ID so broadcasts can always be traced to their request.
+func requestCorrelationID(r *http.Request) (string, error) {
+	id := r.Header.Get(correlationIDHeader)
+	if id == "" {
+		return requestID(r), nil
+	}
+	if !validRequestID.MatchString(id) {
+		return "", errInvalidCorrelationID
+	}
+	return id, nil
+}
+
+// checkCorrelationID validates the correlation ID a client put on msg.
+func checkCorrelationID(msg *Message) error {
+	if msg.CorrelationID == "" || validRequestID.MatchString(msg.CorrelationID) {
+		return nil
+	}
+	return &validationError{errInvalidCorrelationID.Error()}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const maxClientMsgID = 128
+
+var dedupWindow = flag.Duration("dedup-window", 5*time.Minute, "how long client message IDs are remembered to drop retried messages, 0 disables")
+
+var seenClientIDs = struct {
+	sync.Mutex
+	at    map[string]time.Time
+	sweep sweeper
+}{at: make(map[string]time.Time)}
+
+// duplicate reports whether c already sent a message with the ID in
+// msg.ClientID within -dedup-window. Messages of named clients are matched
+// across connections, so retries after a reconnect are caught too.
+func duplicate(c *Client, msg *Message) bool {
+	if msg.ClientID == "" || *dedupWindow <= 0 {
+		return false
+	}
+	if len(msg.ClientID) > maxClientMsgID {
+		msg.ClientID = ""
+		return false
+	}
+	sender := c.recipientKey()
+	if sender == "" {
+		sender = fmt.Sprintf("conn:%p", c)
+	}
+	key := sender + "\n" + msg.ClientID
+
+	now := time.Now()
+	seenClientIDs.Lock()
+	defer seenClientIDs.Unlock()
+
+	if seenClientIDs.sweep.due(now, *dedupWindow) {
+		for k, t := range seenClientIDs.at {
+			if now.Sub(t) >= *dedupWindow {
+				delete(seenClientIDs.at, k)
+			}
+		}
+	}
+	// IDs past the window may not have been swept yet.
+	if t, ok := seenClientIDs.at[key]; ok && now.Sub(t) < *dedupWindow {
+		return true
+	}
+	seenClientIDs.at[key] = now
+	return false
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	smtpAddr         = flag.String("smtp-addr", "", "host:port of the SMTP server digests are sent through")
+	smtpFrom         = flag.String("smtp-from", "", "sender address of digest emails")
+	smtpUser         = flag.String("smtp-user", "", "user to authenticate to the SMTP server as; no authentication when empty")
+	smtpPasswordFile = flag.String("smtp-password-file", "", "file with the password of -smtp-user")
+	digestInterval   = flag.Duration("digest-interval", 0, "how often identified users who opted in are emailed the mentions and direct messages they missed while offline; 0 sends no digests")
+	digestSubject    = flag.String("digest-subject", "Messages you missed", "subject of digest emails")
+	digestTemplate   = flag.String("digest-template", "", "file with the Go template of the body of digest emails, using .User, .Entries (each with .Room, .Author, .Body, .At and .Direct) and .Dropped; a plain list when empty")
+)
+
+// maxDigestEntries is how many missed messages a digest keeps, older ones
+// are dropped first.
+const maxDigestEntries = 50
+
+const defaultDigestTemplate = `Hi {{.User}},
+
+while you were away:
+{{range .Entries}}
+{{.At.Format "Jan 2 15:04 MST"}} {{if .Direct}}{{.Author}} to you{{else}}{{.Author}} in {{.Room}}{{end}}:
+{{.Body}}
+{{end}}{{if .Dropped}}
+and {{.Dropped}} older messages.
+{{end}}`
+
+// mentionPattern finds the @identity mentions in message bodies.
+var mentionPattern = regexp.MustCompile(`@([\pL\pN_.\-]+)`)
+
+// digestEntry is a message a user missed. They are kept in the store
+// until emailed or the user connects.
+type digestEntry struct {
+	Room   string    `json:"room,omitempty"`
+	Author string    `json:"author"`
+	Body   string    `json:"body"`
+	At     time.Time `json:"at"`
+	// Direct is set for messages selected to the user alone, rather than
+	// mentioning them.
+	Direct bool `json:"direct,omitempty"`
+}
+
+// pendingDigest is what a user missed, in the memory store.
+type pendingDigest struct {
+	entries []digestEntry
+	dropped int
+}
+
+var digests struct {
+	template *template.Template
+	password string
+}
+
+// collectDigest notes msg for the offline users it mentions or is
+// directed to, once it was delivered.
+func collectDigest(msg *Message) {
+	if *digestInterval <= 0 || (msg.Type != "" && msg.Type != typeMessage) || msg.Body == "" || encryptedRoom(msg.Room) {
+		return
+	}
+	users := make(map[string]bool)
+	for _, cr := range msg.Select {
+		if cr.key == "identity" {
+			users[cr.value] = true
+		}
+	}
+	direct := len(users) > 0
+	if !direct {
+		for _, m := range mentionPattern.FindAllStringSubmatch(msg.Body, -1) {
+			users[strings.TrimRight(m[1], ".-")] = true
+		}
+	}
+	if msg.Profile != nil {
+		delete(users, msg.Profile.ID)
+	}
+	if len(users) == 0 {
+		return
+	}
+	e := digestEntry{Room: msg.Room, Author: msg.Author, Body: msg.Body, At: msg.received, Direct: direct}
+
+	go func() {
+		for user := range users {
+			if online(user) {
+				continue
+			}
+			email, err := dataStore().DigestEmail(context.Background(), user)
+			if err != nil {
+				log.Println("Digest email lookup failed:", err)
+				continue
+			}
+			if email == "" {
+				continue
+			}
+			if err := dataStore().AddToDigest(context.Background(), user, e, maxDigestEntries); err != nil {
+				log.Println("Cannot add to digest:", err)
+			}
+		}
+	}()
+}
+
+// online reports whether a client of identity is connected, to any
+// tenant.
+func online(identity string) bool {
+	found := false
+	for _, h := range allHubs() {
+		h.clients.each(func(c *Client) {
+			if c.identity == identity {
+				found = true
+			}
+		})
+	}
+	return found
+}
+
+// clearDigest forgets what identity missed, they are back.
+func clearDigest(identity string) {
+	if *digestInterval <= 0 {
+		return
+	}
+	if _, _, err := dataStore().TakeDigest(context.Background(), identity); err != nil {
+		log.Println("Cannot clear digest:", err)
+	}
+}
+
+// runDigests emails every -digest-interval the users with missed messages,
+// when this instance is the leader.
+func runDigests() {
+	if *digestInterval <= 0 {
+		return
+	}
+	if *smtpAddr == "" || *smtpFrom == "" {
+		log.Fatal("digests need -smtp-addr and -smtp-from")
+	}
+	text := defaultDigestTemplate
+	if *digestTemplate != "" {
+		data, err := os.ReadFile(*digestTemplate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		text = string(data)
+	}
+	t, err := template.New("digest").Option("missingkey=error").Parse(text)
+	if err != nil {
+		log.Fatalf("invalid digest template: %v", err)
+	}
+	digests.template = t
+	if *smtpUser != "" {
+		digests.password = readSecretFile(*smtpPasswordFile)
+	}
+
+	ticker := time.NewTicker(*digestInterval)
+	for range ticker.C {
+		if !leading() {
+			continue
+		}
+		ctx := context.Background()
+		users, err := dataStore().DigestUsers(ctx)
+		if err != nil {
+			log.Println("Cannot list digests:", err)
+			continue
+		}
+		for _, user := range users {
+			entries, dropped, err := dataStore().TakeDigest(ctx, user)
+			if err != nil {
+				log.Println("Cannot take digest:", err)
+				continue
+			}
+			if len(entries) == 0 {
+				continue
+			}
+			if err := sendDigest(user, entries, dropped); err != nil {
+				log.Printf("Cannot send digest to %s: %v", user, err)
+				// It goes out next time, with what was missed since.
+				for _, e := range entries {
+					dataStore().AddToDigest(ctx, user, e, maxDigestEntries)
+				}
+			}
+		}
+	}
+}
+
+// sendDigest emails entries to user, if they still want digests.
+func sendDigest(user string, entries []digestEntry, dropped int) error {
+	email, err := dataStore().DigestEmail(context.Background(), user)
+	if err != nil || email == "" {
+		return err
+	}
+	// Entries put back after failing to send come after newer ones.
+	slices.SortStableFunc(entries, func(a, b digestEntry) int { return a.At.Compare(b.At) })
+	var body bytes.Buffer
+	data := struct {
+		User    string
+		Entries []digestEntry
+		Dropped int
+	}{user, entries, dropped}
+	if err := digests.template.Execute(&body, data); err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", *smtpFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", email)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", *digestSubject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if *smtpUser != "" {
+		host, _, _ := net.SplitHostPort(*smtpAddr)
+		auth = smtp.PlainAuth("", *smtpUser, digests.password, host)
+	}
+	return smtp.SendMail(*smtpAddr, auth, *smtpFrom, []string{email}, msg.Bytes())
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	discordTokenFile = flag.String("discord-token-file", "", "file with the token of the bot the Discord bridge reads and posts with; the bridge is off when empty")
+	discordRoomsFile = flag.String("discord-rooms", "", "JSON file of the rooms the Discord bridge mirrors, e.g. {\"general\": {\"channel\": \"123456789012345678\", \"webhook\": \"https://discord.com/api/webhooks/...\"}}; posts go through the channel's webhook, under the author's name, when it has one")
+)
+
+const (
+	discordAPI     = "https://discord.com/api/v10/"
+	discordGateway = "wss://gateway.discord.gg/?v=10&encoding=json"
+	// discordIntents are GUILD_MESSAGES and MESSAGE_CONTENT.
+	discordIntents = 1<<9 | 1<<15
+	// discordRetries is how often a post rate limited by Discord is
+	// retried.
+	discordRetries = 3
+)
+
+// discordRoom is a room of -discord-rooms.
+type discordRoom struct {
+	Channel string `json:"channel"`
+	Webhook string `json:"webhook"`
+}
+
+var (
+	discordToken  string
+	discordBridge *bridge
+	// discordWebhooks are the webhook URLs by channel.
+	discordWebhooks map[string]string
+)
+
+// startDiscordBridge mirrors the -discord-rooms to Discord, if configured.
+func startDiscordBridge() {
+	if *discordTokenFile == "" {
+		return
+	}
+	discordToken = readSecretFile(*discordTokenFile)
+	data, err := os.ReadFile(*discordRoomsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var byRoom map[string]discordRoom
+	if err := json.Unmarshal(data, &byRoom); err != nil {
+		log.Fatalf("invalid Discord rooms %s: %v", *discordRoomsFile, err)
+	}
+	var pairs []string
+	discordWebhooks = make(map[string]string)
+	for room, d := range byRoom {
+		pairs = append(pairs, room+"="+d.Channel)
+		if d.Webhook != "" {
+			if !strings.HasPrefix(d.Webhook, "https://") {
+				log.Fatalf("invalid Discord webhook of room %s", room)
+			}
+			discordWebhooks[d.Channel] = d.Webhook
+		}
+	}
+	discordBridge = startBridge("discord", parseBridgeRooms("discord", strings.Join(pairs, ",")), postToDiscord)
+	go runDiscordGateway()
+}
+
+// discordMessage is what the bridge sends and receives of Discord
+// messages.
+type discordMessage struct {
+	ChannelID string `json:"channel_id,omitempty"`
+	Content   string `json:"content"`
+	Username  string `json:"username,omitempty"`
+	WebhookID string `json:"webhook_id,omitempty"`
+	Author    *struct {
+		Username   string `json:"username"`
+		GlobalName string `json:"global_name"`
+		Bot        bool   `json:"bot"`
+	} `json:"author,omitempty"`
+	Member *struct {
+		Nick string `json:"nick"`
+	} `json:"member,omitempty"`
+	Attachments []struct {
+		URL string `json:"url"`
+	} `json:"attachments,omitempty"`
+	// AllowedMentions keeps bridged messages from pinging anyone.
+	AllowedMentions *discordMentions `json:"allowed_mentions,omitempty"`
+}
+
+type discordMentions struct {
+	Parse []string `json:"parse"`
+}
+
+// postToDiscord posts msg to channel, through its webhook under the name
+// of the author when it has one, otherwise as the bot naming the author.
+func postToDiscord(channel string, msg *Message) error {
+	out := discordMessage{Content: msg.Body, AllowedMentions: &discordMentions{Parse: []string{}}}
+	url, auth := discordWebhooks[channel], ""
+	if url != "" {
+		out.Username = msg.Author
+	} else {
+		url, auth = discordAPI+"channels/"+channel+"/messages", "Bot "+discordToken
+		out.Content = "**" + msg.Author + "**: " + msg.Body
+	}
+	body, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		r, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		resp, err := bridgeHTTP.Do(r)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests && attempt < discordRetries:
+			time.Sleep(retryAfter(resp))
+		case resp.StatusCode >= 300:
+			return errors.New("Discord API: " + resp.Status)
+		default:
+			return nil
+		}
+	}
+}
+
+// discordPayload is a gateway event.
+type discordPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  *int64          `json:"s,omitempty"`
+	T  string          `json:"t,omitempty"`
+}
+
+// runDiscordGateway keeps the bot connected to the gateway, relaying the
+// messages of the bridged channels.
+func runDiscordGateway() {
+	for {
+		err := discordSession()
+		log.Println("Discord gateway connection ended:", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// discordSession identifies the bot on a new gateway connection and
+// handles its events until it fails.
+func discordSession() error {
+	ws, err := websocket.Dial(discordGateway, "", "https://discord.com")
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	var hello discordPayload
+	if err := websocket.JSON.Receive(ws, &hello); err != nil {
+		return err
+	}
+	var params struct {
+		HeartbeatInterval int `json:"heartbeat_interval"`
+	}
+	if hello.Op != 10 || json.Unmarshal(hello.D, &params) != nil || params.HeartbeatInterval <= 0 {
+		return errors.New("no hello from the gateway")
+	}
+
+	var sendMu sync.Mutex
+	send := func(op int, d any) error {
+		data, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return websocket.JSON.Send(ws, discordPayload{Op: op, D: data})
+	}
+	var seq atomic.Int64
+	seq.Store(-1)
+	heartbeat := func() error {
+		if s := seq.Load(); s >= 0 {
+			return send(1, s)
+		}
+		return send(1, nil)
+	}
+
+	identify := map[string]any{
+		"token":      discordToken,
+		"intents":    discordIntents,
+		"properties": map[string]string{"os": "linux", "browser": "golang-websockets", "device": "golang-websockets"},
+	}
+	if err := send(2, identify); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Duration(params.HeartbeatInterval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if heartbeat() != nil {
+					ws.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		var p discordPayload
+		if err := websocket.JSON.Receive(ws, &p); err != nil {
+			return err
+		}
+		if p.S != nil {
+			seq.Store(*p.S)
+		}
+		switch p.Op {
+		case 0:
+			if p.T == "MESSAGE_CREATE" {
+				var m discordMessage
+				if err := json.Unmarshal(p.D, &m); err == nil {
+					relayDiscordMessage(&m)
+				}
+			}
+		case 1:
+			if err := heartbeat(); err != nil {
+				return err
+			}
+		case 7, 9:
+			return errors.New("the gateway asked to reconnect")
+		}
+	}
+}
+
+// relayDiscordMessage relays m to its room, with the links of its
+// attachments. Bot and webhook messages, the bridge's own among them, are
+// left out.
+func relayDiscordMessage(m *discordMessage) {
+	if m.Author == nil || m.Author.Bot || m.WebhookID != "" {
+		return
+	}
+	author := m.Author.Username
+	switch {
+	case m.Member != nil && m.Member.Nick != "":
+		author = m.Member.Nick
+	case m.Author.GlobalName != "":
+		author = m.Author.GlobalName
+	}
+	body := m.Content
+	for _, a := range m.Attachments {
+		if body != "" {
+			body += "\n"
+		}
+		body += a.URL
+	}
+	discordBridge.relay(m.ChannelID, author, body)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// typeDraining warns clients that the server is going away, with a hint in
+// ReconnectAfter of when to come back.
+const typeDraining = "server_draining"
+
+var reconnectAfter = flag.Duration("drain-reconnect-after", 5*time.Second, "how long clients of a draining server are told to wait before reconnecting")
+
+// draining is set once the server stops taking new clients.
+var draining atomic.Bool
+
+// terminated returns a channel receiving SIGTERM and interrupts.
+func terminated() <-chan os.Signal {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	return sig
+}
+
+// refuseWhileDraining answers 503 Service Unavailable instead of taking new
+// clients once the server drains.
+func refuseWhileDraining(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(reconnectAfter.Seconds())))
+			httpError(w, r, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// drainClients tells the connected clients the server is going away and
+// closes their connections one at a time over timeout, so they do not all
+// reconnect at once.
+func drainClients(timeout time.Duration) {
+	draining.Store(true)
+	for _, h := range allHubs() {
+		h.notifyAllLocalized(msgDraining, "Server is shutting down", func(body string) *Message {
+			return &Message{
+				Type:           typeDraining,
+				Author:         "Server",
+				Body:           body,
+				ReconnectAfter: int(reconnectAfter.Seconds()),
+			}
+		})
+	}
+
+	deadline := time.Now().Add(timeout)
+	// Leave clients that act on the notice a moment to go by themselves.
+	time.Sleep(min(*reconnectAfter, timeout/2))
+	for n := connectedClients(); n > 0 && time.Now().Before(deadline); n = connectedClients() {
+		interval := time.Until(deadline) / time.Duration(n+1)
+		picked := false
+		closed := disconnectAll(reasonShutdown, func(c *Client) bool {
+			if _, ok := c.connection.(io.Closer); ok && !picked {
+				picked = true
+				return true
+			}
+			return false
+		})
+		if closed == 0 {
+			// gRPC streams cannot be closed from here, they end when the
+			// server stops.
+			time.Sleep(time.Second)
+			continue
+		}
+		time.Sleep(interval)
+	}
+	if n := connectedClients(); n > 0 {
+		log.Println("Drain timed out with", n, "clients left")
+	}
+}
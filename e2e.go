@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// typeKeyExchange carries key material between clients of an end-to-end
+// encrypted room. It is relayed like a message but never remembered, and
+// goes only to the client nicknamed in To when that is set.
+const typeKeyExchange = "key-exchange"
+
+var e2eRooms = flag.String("e2e-rooms", "", "comma separated rooms whose message bodies are end-to-end encrypted by clients; the server relays and stores them untouched")
+
+// encryptedRoom reports whether bodies sent to room are ciphertext the
+// server must not look into or change.
+func encryptedRoom(room string) bool {
+	if room == "" || *e2eRooms == "" {
+		return false
+	}
+	for _, r := range strings.Split(*e2eRooms, ",") {
+		if strings.TrimSpace(r) == room {
+			return true
+		}
+	}
+	return false
+}
+
+var errNotAllowed = &clientError{codeUnauthorized, "message not allowed in this room"}
+
+// acceptable reports whether a client may send msg. Messages go to a
+// single topic, and key exchanges only make sense in encrypted rooms.
+func acceptable(msg *Message) bool {
+	if hasWildcard(msg.Room) {
+		return false
+	}
+	if msg.Type == typeKeyExchange {
+		return encryptedRoom(msg.Room)
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// typeError tells a client the server refused something it sent, or the
+// client itself. Code says why for programs, the body explains it to people.
+const typeError = "error"
+
+// Codes of error events.
+const (
+	codeInvalid      = "invalid"
+	codeTooLarge     = "too_large"
+	codeRateLimited  = "rate_limited"
+	codeMuted        = "muted"
+	codeFiltered     = "filtered"
+	codeUnauthorized = "unauthorized"
+	codeBanned       = "banned"
+	codeNickInvalid  = "nick_invalid"
+	codeNickTaken    = "nick_taken"
+	codeBusy         = "busy"
+	codeQuota        = "quota_exceeded"
+	codeInternal     = "internal"
+)
+
+// clientError is an error with its own event code.
+type clientError struct {
+	code   string
+	detail string
+}
+
+func (e *clientError) Error() string {
+	return e.detail
+}
+
+func clientErrorf(code, format string, v ...any) error {
+	return &clientError{code, fmt.Sprintf(format, v...)}
+}
+
+// errorCode returns the event code for err.
+func errorCode(err error) string {
+	var cerr *clientError
+	var verr *validationError
+	switch {
+	case errors.As(err, &cerr):
+		return cerr.code
+	case errors.As(err, &verr), errors.Is(err, errInvalidTopic):
+		return codeInvalid
+	case errors.Is(err, errRateLimited):
+		return codeRateLimited
+	case errors.Is(err, errProfanity):
+		return codeFiltered
+	case errors.Is(err, errBanned):
+		return codeBanned
+	case errors.Is(err, errNickInvalid):
+		return codeNickInvalid
+	case errors.Is(err, errNickTaken), errors.Is(err, errNickReserved):
+		return codeNickTaken
+	}
+	return codeInternal
+}
+
+// errorMessage describes err to c, in its locale when the catalog has a
+// translation for the code.
+func errorMessage(c *Client, err error) *Message {
+	code := errorCode(err)
+	return &Message{Type: typeError, Author: "Server", Code: code, Body: localize(c.locale, "error."+code, err.Error())}
+}
+
+// sendError tells c why the server refused what it sent last.
+func sendError(c *Client, err error) {
+	clientEvent(adminError, c, err.Error())
+	c.send(errorMessage(c, err))
+}
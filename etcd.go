@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	etcdEndpoints = flag.String("etcd", "", "comma separated etcd endpoints, such as http://etcd1:2379, where instances share the /admin/config settings and cluster nodes register, so either changes everywhere without restarts")
+	etcdPrefix    = flag.String("etcd-prefix", "/golang-websockets/", "prefix of the etcd keys of this deployment")
+)
+
+// nodeTTL is how long, in seconds, a cluster node stays registered after
+// it stopped renewing its lease.
+const nodeTTL = 10
+
+var etcdClient *clientv3.Client
+
+// startEtcd applies the shared settings and follows their changes and,
+// for cluster nodes, registers this node and follows the others coming
+// and going.
+func startEtcd() {
+	if *etcdEndpoints == "" {
+		return
+	}
+	var err error
+	etcdClient, err = clientv3.New(clientv3.Config{Endpoints: strings.Split(*etcdEndpoints, ","), DialTimeout: 5 * time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
+	rev, err := watchEtcd(*etcdPrefix+"settings", false, applySharedSettings)
+	if err != nil {
+		log.Fatal("Cannot load settings from etcd: ", err)
+	}
+	log.Println("Following etcd settings from revision", rev)
+
+	if *clusterSelf == "" || *clusterNodes != "" {
+		return
+	}
+	checkCluster()
+	go registerNode()
+	if _, err := watchEtcd(*etcdPrefix+"nodes/", true, applyNodes); err != nil {
+		log.Fatal("Cannot load cluster nodes from etcd: ", err)
+	}
+}
+
+// watchEtcd calls apply with the values under key, or with the keys under
+// it as a prefix, now and whenever they change. It returns the revision
+// first read.
+func watchEtcd(key string, prefix bool, apply func(values [][]byte)) (int64, error) {
+	var opts []clientv3.OpOption
+	if prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	read := func() (int64, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		resp, err := etcdClient.Get(ctx, key, opts...)
+		if err != nil {
+			return 0, err
+		}
+		values := make([][]byte, len(resp.Kvs))
+		for i, kv := range resp.Kvs {
+			values[i] = kv.Value
+		}
+		apply(values)
+		return resp.Header.Revision, nil
+	}
+	rev, err := read()
+	if err != nil {
+		return 0, err
+	}
+
+	go func() {
+		for {
+			for resp := range etcdClient.Watch(context.Background(), key, append(opts, clientv3.WithRev(rev+1))...) {
+				if err := resp.Err(); err != nil {
+					log.Println("etcd watch failed:", err)
+					break
+				}
+				if len(resp.Events) > 0 {
+					rev = resp.Header.Revision
+					// Reading it all again copes with deletions too.
+					if r, err := read(); err == nil {
+						rev = r
+					}
+				}
+			}
+			time.Sleep(time.Second)
+			// Compacted revisions cannot be watched from, start over.
+			if r, err := read(); err == nil {
+				rev = r
+			}
+		}
+	}()
+	return rev, nil
+}
+
+// applySharedSettings makes the settings stored in etcd the live ones.
+// Invalid settings are logged and ignored.
+func applySharedSettings(values [][]byte) {
+	if len(values) == 0 {
+		return
+	}
+	settingsMu.Lock()
+	s := *liveSettings()
+	s.Templates = nil
+	if err := json.Unmarshal(values[0], &s); err != nil {
+		settingsMu.Unlock()
+		log.Println("Ignoring invalid settings from etcd:", err)
+		return
+	}
+	if s.AllowedOrigins == nil {
+		s.AllowedOrigins = []string{}
+	}
+	if err := s.validate(); err != nil {
+		settingsMu.Unlock()
+		log.Println("Ignoring invalid settings from etcd:", err)
+		return
+	}
+	current, _ := json.Marshal(liveSettings())
+	shared, _ := json.Marshal(&s)
+	if string(current) == string(shared) {
+		settingsMu.Unlock()
+		return
+	}
+	currentSettings.Store(&s)
+	settingsMu.Unlock()
+	settingsChanged(&s)
+}
+
+// publishSettings shares the settings, data in JSON, with the instances
+// following etcd.
+func publishSettings(ctx context.Context, data []byte) error {
+	if etcdClient == nil {
+		return nil
+	}
+	_, err := etcdClient.Put(ctx, *etcdPrefix+"settings", string(data))
+	return err
+}
+
+// registerNode keeps this node registered for as long as it runs, under a
+// lease that ends nodeTTL seconds after it stops.
+func registerNode() {
+	for {
+		ctx := context.Background()
+		lease, err := etcdClient.Grant(ctx, nodeTTL)
+		if err == nil {
+			_, err = etcdClient.Put(ctx, *etcdPrefix+"nodes/"+*clusterSelf, *clusterSelf, clientv3.WithLease(lease.ID))
+		}
+		var alive <-chan *clientv3.LeaseKeepAliveResponse
+		if err == nil {
+			alive, err = etcdClient.KeepAlive(ctx, lease.ID)
+		}
+		if err != nil {
+			log.Println("Cannot register cluster node in etcd:", err)
+		} else {
+			for range alive {
+			}
+			log.Println("Cluster node registration in etcd lapsed")
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// applyNodes makes the registered nodes the cluster, with this node in it
+// even before its registration shows.
+func applyNodes(values [][]byte) {
+	nodes := []string{*clusterSelf}
+	for _, v := range values {
+		if node := string(v); !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	slices.Sort(nodes)
+	if r := ring.Load(); r != nil && slices.Equal(r.members, nodes) {
+		return
+	}
+	setClusterNodes(nodes)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Protocol features that can be switched on and off at runtime.
+const (
+	featureTyping     = "typing"
+	featureReactions  = "reactions"
+	featureHistory    = "history"
+	featureScheduling = "scheduling"
+)
+
+// typeCapabilities tells clients which features are enabled, when they
+// connect and whenever that changes.
+const typeCapabilities = "capabilities"
+
+var featuresFlag = flag.String("features", "", "comma separated feature=on|off settings for typing, reactions, history and scheduling, all on by default; can be changed through /admin/features")
+
+var features = struct {
+	sync.RWMutex
+	once    sync.Once
+	enabled map[string]bool
+}{}
+
+func loadFeatures() {
+	features.enabled = map[string]bool{
+		featureTyping:     true,
+		featureReactions:  true,
+		featureHistory:    true,
+		featureScheduling: true,
+	}
+	for _, setting := range strings.Split(*featuresFlag, ",") {
+		if setting = strings.TrimSpace(setting); setting == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(setting, "=")
+		if _, known := features.enabled[name]; !known || (value != "on" && value != "off") {
+			log.Fatalf("invalid -features setting %q", setting)
+		}
+		features.enabled[name] = value == "on"
+	}
+}
+
+// enabledFeatures returns a copy of the feature settings.
+func enabledFeatures() map[string]bool {
+	features.once.Do(loadFeatures)
+	features.RLock()
+	defer features.RUnlock()
+
+	m := make(map[string]bool, len(features.enabled))
+	for name, on := range features.enabled {
+		m[name] = on
+	}
+	return m
+}
+
+func featureEnabled(name string) bool {
+	features.once.Do(loadFeatures)
+	features.RLock()
+	defer features.RUnlock()
+
+	return features.enabled[name]
+}
+
+// checkFeature returns a validation error when feature is disabled.
+func checkFeature(feature string) error {
+	if featureEnabled(feature) {
+		return nil
+	}
+	return &validationError{feature + " is disabled on this server"}
+}
+
+func capabilitiesMessage() *Message {
+	// The server time gives clients a first estimate of their clock
+	// offset, see typeTime.
+	return &Message{Type: typeCapabilities, Author: "Server", Features: enabledFeatures(), ServerTime: serverTime()}
+}
+
+// featuresHandler serves /admin/features: GET returns the feature
+// settings, PATCH changes those in a JSON object of names to booleans and
+// sends the new capabilities to every client.
+func featuresHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var changes map[string]bool
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&changes); err != nil {
+			httpError(w, r, "Invalid features: "+err.Error(), decodeStatus(err))
+			return
+		}
+		current := enabledFeatures()
+		var names []string
+		for name, on := range changes {
+			if _, known := current[name]; !known {
+				httpError(w, r, fmt.Sprintf("Unknown feature %q", name), http.StatusBadRequest)
+				return
+			}
+			names = append(names, fmt.Sprintf("%s=%t", name, on))
+		}
+		sort.Strings(names)
+
+		features.Lock()
+		for name, on := range changes {
+			features.enabled[name] = on
+		}
+		features.Unlock()
+
+		log.Println("Features changed:", strings.Join(names, ","))
+		auditAction(requestActor(r), "features", "", strings.Join(names, ","))
+		for _, h := range allHubs() {
+			h.notifyAll(capabilitiesMessage())
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enabledFeatures())
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ContentFilter inspects messages sent by clients before they are
+// broadcast. It may change msg, or return an error to reject it.
+type ContentFilter interface {
+	Filter(msg *Message) error
+}
+
+var (
+	profanityFile   = flag.String("profanity-words", "", "file with words to filter, one per line, replacing the built-in list")
+	profanityMode   = flag.String("profanity-mode", "off", "what to do with messages containing filtered words: off, mask, reject")
+	unfilteredRooms = flag.String("unfiltered-rooms", "", "comma separated rooms where content filters are disabled")
+)
+
+var defaultProfanity = []string{"damn", "hell", "crap", "bastard", "bollocks", "bugger"}
+
+var errProfanity = errors.New("message contains filtered words")
+
+// wordFilter masks or rejects messages containing any word of a list,
+// matching whole words regardless of case.
+type wordFilter struct {
+	re     *regexp.Regexp
+	reject bool
+}
+
+func newWordFilter(words []string, reject bool) *wordFilter {
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	return &wordFilter{re: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`), reject: reject}
+}
+
+func (f *wordFilter) Filter(msg *Message) error {
+	if !f.re.MatchString(msg.Body) {
+		return nil
+	}
+	if f.reject {
+		return errProfanity
+	}
+	msg.Body = f.re.ReplaceAllStringFunc(msg.Body, func(w string) string {
+		return strings.Repeat("*", len([]rune(w)))
+	})
+	return nil
+}
+
+var (
+	filtersOnce    sync.Once
+	contentFilters []ContentFilter
+)
+
+func loadFilters() []ContentFilter {
+	filtersOnce.Do(func() {
+		switch *profanityMode {
+		case "off":
+		case "mask", "reject":
+			words := defaultProfanity
+			if *profanityFile != "" {
+				var err error
+				if words, err = readWordList(*profanityFile); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if len(words) > 0 {
+				contentFilters = append(contentFilters, newWordFilter(words, *profanityMode == "reject"))
+			}
+		default:
+			log.Fatalf("invalid -profanity-mode %q, expected off, mask or reject", *profanityMode)
+		}
+	})
+	return contentFilters
+}
+
+func readWordList(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if w := strings.TrimSpace(scanner.Text()); w != "" && !strings.HasPrefix(w, "#") {
+			words = append(words, w)
+		}
+	}
+	return words, scanner.Err()
+}
+
+func filteredRoom(room string) bool {
+	if encryptedRoom(room) {
+		return false
+	}
+	for _, r := range strings.Split(*unfilteredRooms, ",") {
+		if r = strings.TrimSpace(r); r != "" && r == room {
+			return false
+		}
+	}
+	return true
+}
+
+// filterMessage runs msg through the content filters, unless its room has
+// them disabled or is end-to-end encrypted.
+func filterMessage(msg *Message) error {
+	if (msg.Type != "" && msg.Type != typeMessage) || !filteredRoom(msg.Room) {
+		return nil
+	}
+	for _, f := range loadFilters() {
+		if err := f.Filter(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
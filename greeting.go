@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"text/template"
+)
+
+var (
+	welcomeGreeting     = flag.String("welcome", "Welcome!", "Go template of the greeting sent to connecting clients, using .Nick, .Identity, .Members and .MOTD; empty sends none")
+	roomWelcomeGreeting = flag.String("room-welcome", "", "Go template of the greeting sent to clients joining a room, using .Nick, .Identity, .Room, .Members and .MOTD; empty sends none")
+	motd                = flag.String("motd", "", "message of the day, shown by greetings using .MOTD")
+)
+
+// greetingData is what greeting templates can use. Members counts the
+// clients in the room, or on the server for the welcome greeting, the
+// greeted one included.
+type greetingData struct {
+	Nick     string
+	Identity string
+	Room     string
+	Members  int
+	MOTD     string
+}
+
+// parseGreeting parses a greeting template. An empty one parses to nil.
+func parseGreeting(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %v", name, err)
+	}
+	return t, nil
+}
+
+// greeting renders t, or its translation for the locale of c, for c. It
+// returns nil when there is no greeting.
+func (s *settings) greeting(t *template.Template, c *Client, room string, members int) *Message {
+	if t == nil {
+		return nil
+	}
+	t = localGreeting(c, t.Name(), t)
+	var buf bytes.Buffer
+	data := greetingData{Nick: c.nick, Identity: c.identity, Room: room, Members: members, MOTD: s.MOTD}
+	if err := t.Execute(&buf, data); err != nil {
+		log.Printf("Cannot render %s greeting: %v", t.Name(), err)
+		return nil
+	}
+	msg := &Message{Author: "Server", Body: buf.String(), Room: room}
+	sign(msg)
+	return msg
+}
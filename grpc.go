@@ -0,0 +1,217 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chatpb/chat.proto
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mycodesmells/golang-websockets/chatpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type chatServer struct {
+	chatpb.UnimplementedChatServer
+}
+
+type grpcConn struct {
+	stream chatpb.Chat_ChatServer
+}
+
+func (c grpcConn) Send(msg *Message) error {
+	return c.stream.Send(toProto(msg))
+}
+
+func (c grpcConn) Receive(msg *Message) error {
+	in, err := c.stream.Recv()
+	if err != nil {
+		return err
+	}
+	fromProto(in, msg)
+	return nil
+}
+
+func listenGRPC(addr string) (net.Listener, error) {
+	if ln := upgradeListener("grpc://" + addr); ln != nil {
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+func serveGRPC(ln net.Listener) *grpc.Server {
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(recoverUnary, protectUnary), grpc.StreamInterceptor(recoverStream))
+	chatpb.RegisterChatServer(s, &chatServer{})
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return s
+}
+
+func (s *chatServer) Chat(stream chatpb.Chat_ChatServer) error {
+	if draining.Load() {
+		return status.Error(codes.Unavailable, "server is shutting down")
+	}
+	h := grpcHub(stream.Context())
+	if h == nil {
+		return status.Error(codes.NotFound, "unknown tenant")
+	}
+	client := NewClient(grpcConn{stream})
+	client.hub = h
+	var nick string
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		if len(md.Get("nick")) > 0 {
+			nick = md.Get("nick")[0]
+		}
+		client.meta = clientMeta(nil, md.Get)
+		client.locale = negotiateLocale(strings.Join(md.Get("lang"), ""), strings.Join(md.Get("accept-language"), ","))
+	}
+	if err := register(stream.Context(), client, nick); err != nil {
+		if err == errNickInvalid {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err == errTenantFull {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	defer client.hub.removeClient(client)
+	client.listen(stream.Context())
+	return nil
+}
+
+// Broadcast sends in to everyone in the tenant of the call, as the server
+// like /broadcast does. It is only served behind protectUnary.
+func (s *chatServer) Broadcast(ctx context.Context, in *chatpb.Message) (*chatpb.BroadcastResponse, error) {
+	r, _ := ctx.Value(grpcRequestKey{}).(*http.Request)
+	if r == nil {
+		return nil, status.Error(codes.Internal, "broadcast not checked")
+	}
+	log.Printf("Broadcast requested by %s over gRPC", clientIP(r))
+	auditAction(requestActor(r), "broadcast", in.Room, in.Body)
+	hubFor(r).broadcast(&Message{Author: "Server", Room: in.Room, Body: in.Body})
+	return &chatpb.BroadcastResponse{}, nil
+}
+
+// grpcHub returns the hub of the tenant named in the tenant metadata of a
+// call, or nil when there is no such tenant.
+func grpcHub(ctx context.Context) *Hub {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return tenantHub(strings.Join(md.Get("tenant"), ""))
+}
+
+type grpcRequestKey struct{}
+
+// grpcCodes are the codes of the statuses protectBroadcast refuses calls
+// with.
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.Aborted,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+	http.StatusServiceUnavailable:    codes.Unavailable,
+}
+
+// protectUnary puts Broadcast calls behind the same checks as /broadcast,
+// see protectBroadcast. A call is checked as a POST of the marshalled
+// message to the method name, with its metadata as headers: credentials
+// in authorization, signatures in x-timestamp, x-nonce and x-signature,
+// and idempotency-key. The tenant metadata names the tenant the
+// credentials and signature must be valid for. Headers the checks set,
+// such as retry-after, are sent back as header metadata.
+func protectUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if info.FullMethod != chatpb.Chat_Broadcast_FullMethodName {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	tenant := strings.Join(md.Get("tenant"), "")
+	if !knownTenant(tenant) {
+		return nil, status.Error(codes.NotFound, "unknown tenant")
+	}
+	body, err := proto.Marshal(req.(proto.Message))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	r, err := http.NewRequestWithContext(context.WithValue(ctx, tenantKey{}, tenant), http.MethodPost, info.FullMethod, bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for k, v := range md {
+		if !strings.HasPrefix(k, ":") {
+			r.Header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	var resp any
+	var called bool
+	w := &grpcResponse{header: make(http.Header)}
+	protectBroadcast(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		resp, err = handler(context.WithValue(r.Context(), grpcRequestKey{}, r), req)
+		if err != nil {
+			// Not kept for retries with the same Idempotency-Key.
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}).ServeHTTP(w, r)
+
+	sent := metadata.MD{}
+	for k, v := range w.header {
+		if k != "Content-Type" && k != "X-Content-Type-Options" {
+			sent[strings.ToLower(k)] = v
+		}
+	}
+	grpc.SetHeader(ctx, sent)
+	switch {
+	case called:
+		return resp, err
+	case w.status < http.StatusBadRequest:
+		// A retry answered with the first call's response.
+		return &chatpb.BroadcastResponse{}, nil
+	}
+	var e errorResponse
+	json.Unmarshal(w.body.Bytes(), &e)
+	code, ok := grpcCodes[w.status]
+	if !ok {
+		code = codes.Unknown
+	}
+	return nil, status.Error(code, e.Message)
+}
+
+// grpcResponse keeps what protectBroadcast answers a call with.
+type grpcResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *grpcResponse) Header() http.Header { return w.header }
+
+func (w *grpcResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *grpcResponse) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
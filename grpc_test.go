@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mycodesmells/golang-websockets/chatpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var broadcastInfo = &grpc.UnaryServerInfo{FullMethod: chatpb.Chat_Broadcast_FullMethodName}
+
+// signedCall returns the context of a Broadcast call of in, signed with
+// key the way protectUnary checks it.
+func signedCall(t *testing.T, in *chatpb.Message, key, nonce string) context.Context {
+	t.Helper()
+	body, err := proto.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest(http.MethodPost, chatpb.Chat_Broadcast_FullMethodName, nil)
+	signRequest(r, key, time.Now(), nonce, body)
+	md := metadata.MD{}
+	for k, v := range r.Header {
+		md.Set(k, v...)
+	}
+	return metadata.NewIncomingContext(context.Background(), md)
+}
+
+func TestProtectUnaryRequiresSignature(t *testing.T) {
+	signedBroadcastHandler(t)
+	in := &chatpb.Message{Body: "hello"}
+	called := false
+	handler := func(ctx context.Context, req any) (any, error) {
+		called = true
+		return &chatpb.BroadcastResponse{}, nil
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want codes.Code
+	}{
+		{"unsigned", metadata.NewIncomingContext(context.Background(), metadata.MD{}), codes.Unauthenticated},
+		{"wrong key", signedCall(t, in, "other-key", testNonce("grpc-key")), codes.Unauthenticated},
+		{"other message", signedCall(t, &chatpb.Message{Body: "bye"}, testBroadcastKey, testNonce("grpc-body")), codes.Unauthenticated},
+		{"signed", signedCall(t, in, testBroadcastKey, testNonce("grpc-signed")), codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			_, err := protectUnary(tt.ctx, in, broadcastInfo, handler)
+			if code := status.Code(err); code != tt.want {
+				t.Errorf("got code %v, want %v: %v", code, tt.want, err)
+			}
+			if called != (tt.want == codes.OK) {
+				t.Errorf("handler called: %v", called)
+			}
+		})
+	}
+}
+
+func TestProtectUnaryRefusesUnknownTenants(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("tenant", "no-such-tenant"))
+	_, err := protectUnary(ctx, &chatpb.Message{Body: "hello"}, broadcastInfo, func(ctx context.Context, req any) (any, error) {
+		t.Error("handler called")
+		return nil, nil
+	})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("got code %v, want %v", code, codes.NotFound)
+	}
+}
+
+func TestBroadcastStampsServerAuthor(t *testing.T) {
+	h := tenantHub("")
+	h.mu.Lock()
+	h.room("")
+	h.mu.Unlock()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.MD{})
+	in := &chatpb.Message{Author: "alice", Type: typeTombstone, Body: "from the server"}
+	if _, err := protectUnary(ctx, in, broadcastInfo, func(ctx context.Context, req any) (any, error) {
+		return (&chatServer{}).Broadcast(ctx, req.(*chatpb.Message))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	recent := h.recent("", 1)
+	if len(recent) != 1 || recent[0].Body != "from the server" {
+		t.Fatalf("broadcast not delivered: %+v", recent)
+	}
+	if msg := recent[0]; msg.Author != "Server" || msg.Type != "" {
+		t.Errorf("got author %q and type %q, want Server and a chat message", msg.Author, msg.Type)
+	}
+}
+
+func TestBroadcastNeedsProtectUnary(t *testing.T) {
+	_, err := (&chatServer{}).Broadcast(context.Background(), &chatpb.Message{Body: "hello"})
+	if err == nil {
+		t.Error("unchecked broadcast accepted")
+	}
+}
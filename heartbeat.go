@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// typePing is sent by the server every -heartbeat-interval and must be
+	// answered with typePong, or anything else, to keep the connection.
+	// Clients may ping the server too.
+	typePing = "ping"
+	typePong = "pong"
+)
+
+var (
+	heartbeatInterval = flag.Duration("heartbeat-interval", 0, "how often clients are pinged and must show they are alive, by answering with a pong or sending anything else; 0 disables heartbeats for clients that do not ask for them")
+	heartbeatMisses   = flag.Int("heartbeat-misses", 3, "heartbeats in a row a client may miss before it is disconnected")
+	heartbeatMin      = flag.Duration("heartbeat-min", 5*time.Second, "shortest heartbeat interval clients may ask for with ?heartbeat=")
+	heartbeatMax      = flag.Duration("heartbeat-max", 5*time.Minute, "longest heartbeat interval clients, such as mobile ones saving battery, may ask for with ?heartbeat=")
+)
+
+var errMissedHeartbeats = errors.New("missed heartbeats")
+
+// heartbeat pings c until ctx is done, and fails once c missed
+// -heartbeat-misses of them in a row, which ends the connection and takes
+// the client out of its rooms.
+func (c *Client) heartbeat(ctx context.Context) error {
+	if c.heartbeatEvery <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(c.heartbeatEvery)
+	defer ticker.Stop()
+
+	ping := func() error {
+		return c.connection.Send(&Message{Type: typePing, Author: "Server"})
+	}
+	last, missed := c.lastActive.Load(), 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		if active := c.lastActive.Load(); active != last {
+			last, missed = active, 0
+		} else if missed++; missed >= *heartbeatMisses {
+			log.Printf("Disconnecting %s after %d missed heartbeats", c.nick, missed)
+			c.setCloseReason(reasonTimeout)
+			return errMissedHeartbeats
+		}
+
+		c.write(ping)
+	}
+}
+
+// negotiateHeartbeat returns the heartbeat interval of a client connecting
+// through r: the one it asked for with ?heartbeat=, a duration such as 90s
+// or seconds, within -heartbeat-min and -heartbeat-max, or
+// -heartbeat-interval.
+func negotiateHeartbeat(r *http.Request) time.Duration {
+	asked := r.URL.Query().Get("heartbeat")
+	if asked == "" {
+		return *heartbeatInterval
+	}
+	d, err := time.ParseDuration(asked)
+	if err != nil {
+		secs, err := strconv.Atoi(asked)
+		if err != nil || secs <= 0 {
+			return *heartbeatInterval
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	return min(max(d, *heartbeatMin), *heartbeatMax)
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const historySize = 100
+
+type Hub struct {
+	// tenant is the namespace the hub serves, see resolveTenant. It is
+	// empty for the default one.
+	tenant  string
+	clients *registry
+
+	// mu guards the rooms map, the rooms each client joined, pending and
+	// held. Each room guards its own state, and is locked after mu when
+	// both are needed.
+	mu    sync.Mutex
+	rooms map[string]*room
+	// retired holds what is kept of reclaimed rooms, by name, and evicted
+	// the usage of those no longer kept, see retire.
+	retired      map[string]retiredRoom
+	retiredSweep sweeper
+	evicted      retiredRoom
+	// pending holds at-least-once messages not yet acknowledged, by
+	// recipientKey.
+	pending map[string][]*Message
+	// held holds the messages awaiting approval in moderated rooms, by
+	// ID, see hold.
+	held      map[string]*heldMessage
+	heldSweep sweeper
+
+	// patterns are the clients that joined each wildcard pattern. They
+	// are copied to patternSnapshot on every change, for deliveries to
+	// read without locking.
+	patternsMu      sync.Mutex
+	patterns        map[string]map[*Client]bool
+	patternSnapshot atomic.Pointer[map[string][]*Client]
+
+	// broadcasts counts broadcast messages, for the message rate.
+	broadcasts atomic.Int64
+	// rate and throttled enforce and account for the tenant's message
+	// rate quota, see withinRate.
+	rate      tokenBucket
+	throttled atomic.Int64
+}
+
+var hub = newHub("")
+
+func newHub(tenant string) *Hub {
+	h := &Hub{
+		tenant:   tenant,
+		clients:  newRegistry(),
+		rooms:    make(map[string]*room),
+		retired:  make(map[string]retiredRoom),
+		pending:  make(map[string][]*Message),
+		held:     make(map[string]*heldMessage),
+		patterns: make(map[string]map[*Client]bool),
+	}
+	h.patternSnapshot.Store(&map[string][]*Client{})
+	return h
+}
+
+// addClientAndGreet fails when another connected client uses the same
+// nickname. Everyone is in the lobby, so nicknames are unique across rooms.
+func (h *Hub) addClientAndGreet(client *Client) error {
+	if q := h.quota(); q.Connections > 0 && h.count() >= q.Connections {
+		return errTenantFull
+	}
+	if err := h.clients.add(client); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.room("").welcome(client)
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		h.redeliver(client)
+		h.mu.Unlock()
+	}()
+
+	// The client does not listen yet, nothing else writes to it.
+	// The heartbeat interval goes with the welcome, or the capabilities
+	// when there is no welcome greeting.
+	s := liveSettings()
+	heartbeat := client.heartbeatEvery.Milliseconds()
+	if welcome := s.greeting(s.welcome, client, "", h.count()); welcome != nil {
+		welcome.Heartbeat, heartbeat = heartbeat, 0
+		client.connection.Send(welcome)
+	}
+	capabilities := capabilitiesMessage()
+	capabilities.Heartbeat = heartbeat
+	sign(capabilities)
+	client.connection.Send(capabilities)
+	if client.sessionID != "" {
+		client.connection.Send(&Message{Type: typeSession, Author: "Server", Body: client.sessionID})
+	}
+	return nil
+}
+
+func (h *Hub) removeClient(client *Client) {
+	keepSession(client)
+	h.clients.remove(client)
+	h.mu.Lock()
+	h.room("").remove(client)
+	for name := range client.rooms {
+		h.forget(client, name)
+	}
+	h.mu.Unlock()
+
+	if client.identity != "" {
+		saveLastSeen(client, client.lastSeen())
+	}
+	clientEvent(adminDisconnect, client, recordDisconnect(client))
+	h.publishWill(client)
+}
+
+func (h *Hub) count() int {
+	return h.clients.len()
+}
+
+// join subscribes client to a room, or to all topics matching a pattern.
+func (h *Hub) join(client *Client, name string) error {
+	if !validPattern(name) {
+		return errInvalidTopic
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !hasWildcard(name) && h.rooms[name] == nil && h.roomsFull() {
+		return errTooManyRooms
+	}
+	client.rooms[name] = true
+	if !hasWildcard(name) {
+		h.room(name).welcome(client)
+		return nil
+	}
+
+	h.patternsMu.Lock()
+	if h.patterns[name] == nil {
+		h.patterns[name] = make(map[*Client]bool)
+	}
+	h.patterns[name][client] = true
+	h.updatePatternSnapshot()
+	h.patternsMu.Unlock()
+
+	for topic, r := range h.rooms {
+		if topic == "" || !topicMatches(name, topic) {
+			continue
+		}
+		r.mu.Lock()
+		if r.retained != nil {
+			client.queue.push(r.retained)
+		}
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+func (h *Hub) leave(client *Client, name string) {
+	h.mu.Lock()
+	if client.rooms[name] {
+		delete(client.rooms, name)
+		h.forget(client, name)
+	}
+	h.mu.Unlock()
+}
+
+// forget takes client out of the room or pattern called name. It is called
+// with the hub lock held.
+func (h *Hub) forget(client *Client, name string) {
+	if !hasWildcard(name) {
+		if r := h.rooms[name]; r != nil {
+			r.remove(client)
+			h.reclaim(r)
+		}
+		return
+	}
+	h.patternsMu.Lock()
+	delete(h.patterns[name], client)
+	if len(h.patterns[name]) == 0 {
+		delete(h.patterns, name)
+	}
+	h.updatePatternSnapshot()
+	h.patternsMu.Unlock()
+}
+
+// updatePatternSnapshot is called with h.patternsMu held after patterns
+// changed.
+func (h *Hub) updatePatternSnapshot() {
+	snapshot := make(map[string][]*Client, len(h.patterns))
+	for pattern, clients := range h.patterns {
+		for c := range clients {
+			snapshot[pattern] = append(snapshot[pattern], c)
+		}
+	}
+	h.patternSnapshot.Store(&snapshot)
+}
+
+// delivery says how a broadcast went. Clients whose send queue is full,
+// usually because their connection is gone or stalled, are skipped rather
+// than holding up everyone else.
+type delivery struct {
+	ID        string `json:"id"`
+	Targeted  int    `json:"targeted"`
+	Delivered int    `json:"delivered"`
+	Skipped   int    `json:"skipped"`
+	// Shed is set when the message was dropped to keep within the
+	// server's fan-out limits.
+	Shed bool `json:"shed,omitempty"`
+	// OverQuota is set when the message was dropped because the tenant
+	// sends too fast or cannot have another room, see quota.
+	OverQuota bool `json:"overQuota,omitempty"`
+}
+
+// broadcast delivers msg to every client when it has no room, otherwise
+// only to the clients that joined msg.Room.
+func (h *Hub) broadcast(msg *Message) delivery {
+	if !h.withinRate(1) {
+		log.Println("Dropping broadcast over the tenant's rate quota from", msg.Author)
+		return delivery{OverQuota: true}
+	}
+	if node := h.upstream(msg.Room); node != "" {
+		return h.forward(node, msg)
+	}
+	if !fanout.admit(msg.Priority) {
+		log.Println("Shedding broadcast over the fan-out limit from", msg.Author)
+		return delivery{Shed: true}
+	}
+
+	h.mu.Lock()
+	if h.rooms[msg.Room] == nil && h.roomsFull() {
+		h.mu.Unlock()
+		log.Println("Dropping broadcast to a new room over the tenant's quota from", msg.Author)
+		return delivery{OverQuota: true}
+	}
+	r := h.broadcastRoom(msg.Room, msg)
+	h.mu.Unlock()
+	h.prepare(msg)
+	d := delivery{ID: msg.ID}
+	if r != nil {
+		d = r.submit([]*Message{msg})[0]
+		h.release(r)
+	} else {
+		sign(msg)
+	}
+
+	fanout.charge(msg, d)
+	collectDigest(msg)
+	return d
+}
+
+// broadcastBatch delivers msgs in order, without other messages to the
+// same rooms coming in between. Rooms are delivered to concurrently.
+func (h *Hub) broadcastBatch(msgs []*Message) []delivery {
+	ds := make([]delivery, len(msgs))
+	if !h.withinRate(len(msgs)) {
+		log.Println("Dropping batch of", len(msgs), "broadcasts over the tenant's rate quota")
+		for i := range ds {
+			ds[i].OverQuota = true
+		}
+		return ds
+	}
+	// Messages to rooms broadcast elsewhere are forwarded there, in
+	// order, the rest delivered here.
+	forwarded := make([]bool, len(msgs))
+	local := 0
+	for i, msg := range msgs {
+		if node := h.upstream(msg.Room); node != "" {
+			ds[i], forwarded[i] = h.forward(node, msg), true
+		} else {
+			local++
+		}
+	}
+	if local == 0 {
+		return ds
+	}
+	if !fanout.admit(batchPriority(msgs)) {
+		log.Println("Shedding batch of", len(msgs), "broadcasts over the fan-out limit")
+		for i := range ds {
+			if !forwarded[i] {
+				ds[i].Shed = true
+			}
+		}
+		return ds
+	}
+
+	var order []string
+	byRoom := make(map[string][]int)
+	for i, msg := range msgs {
+		if forwarded[i] {
+			continue
+		}
+		h.prepare(msg)
+		if byRoom[msg.Room] == nil {
+			order = append(order, msg.Room)
+		}
+		byRoom[msg.Room] = append(byRoom[msg.Room], i)
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range order {
+		indexes := byRoom[name]
+		roomMsgs := make([]*Message, len(indexes))
+		for j, i := range indexes {
+			roomMsgs[j] = msgs[i]
+		}
+		h.mu.Lock()
+		if h.rooms[name] == nil && h.roomsFull() {
+			h.mu.Unlock()
+			for _, i := range indexes {
+				ds[i].OverQuota = true
+			}
+			continue
+		}
+		r := h.broadcastRoom(name, roomMsgs...)
+		h.mu.Unlock()
+		if r == nil {
+			for _, i := range indexes {
+				sign(msgs[i])
+				ds[i].ID = msgs[i].ID
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j, d := range r.submit(roomMsgs) {
+				ds[indexes[j]] = d
+			}
+			h.release(r)
+		}()
+	}
+	wg.Wait()
+
+	for i, msg := range msgs {
+		if forwarded[i] {
+			continue
+		}
+		fanout.charge(msg, ds[i])
+		if !ds[i].OverQuota {
+			collectDigest(msg)
+		}
+	}
+	return ds
+}
+
+func (h *Hub) prepare(msg *Message) {
+	if encryptedRoom(msg.Room) {
+		debugf("Broadcasting %s from %s to encrypted room %s, correlation %s", msg.Type, msg.Author, msg.Room, msg.CorrelationID)
+	} else {
+		debugf("Broadcasting %+v", msg)
+	}
+	transform(msg)
+	sanitize(msg)
+	msg.ID = newMessageID()
+	if msg.received.IsZero() {
+		msg.received = time.Now()
+	}
+	msg.ServerTime = msg.received.UnixMilli()
+	h.broadcasts.Add(1)
+}
+
+// erase drops every remembered message of user that by selects and tells
+// connected clients to forget them too.
+func (h *Hub) erase(user string, by func(*Message) bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, r := range h.rooms {
+		r.mu.Lock()
+		kept := r.history[:0:0]
+		for _, msg := range r.history {
+			if !by(msg) {
+				kept = append(kept, msg)
+			}
+		}
+		r.history = kept
+		pins := r.pins[:0:0]
+		for _, msg := range r.pins {
+			if !by(msg) {
+				pins = append(pins, msg)
+			}
+		}
+		r.pins = pins
+		if r.retained != nil && by(r.retained) {
+			r.retained = nil
+		}
+		r.mu.Unlock()
+		h.reclaim(r)
+	}
+	delete(h.pending, "id:"+user)
+
+	tombstone := &Message{Type: typeTombstone, Author: "Server", Body: user}
+	sign(tombstone)
+	h.clients.each(func(c *Client) {
+		c.queue.put(tombstone)
+	})
+}
+
+// nicks returns the nicknames clients of identity go by, in lower case.
+func (h *Hub) nicks(identity string) []string {
+	var nicks []string
+	h.clients.each(func(c *Client) {
+		if c.identity == identity && c.nick != "" {
+			nicks = append(nicks, strings.ToLower(c.nick))
+		}
+	})
+	return nicks
+}
+
+func newMessageID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// notifyRole sends msg to the clients with role, without remembering it.
+func (h *Hub) notifyRole(role string, msg *Message) {
+	sign(msg)
+
+	h.clients.each(func(c *Client) {
+		if c.role == role {
+			c.queue.put(msg)
+		}
+	})
+}
+
+// notifyAll sends msg to every client, without remembering it.
+func (h *Hub) notifyAll(msg *Message) {
+	sign(msg)
+
+	h.clients.each(func(c *Client) {
+		c.queue.push(msg)
+	})
+}
+
+// remembered returns the message with id from the history of room.
+func (h *Hub) remembered(name, id string) *Message {
+	r := h.existingRoom(name)
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, msg := range r.history {
+		if msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// recent returns up to limit of the latest messages sent to room, oldest first.
+func (h *Hub) recent(name string, limit int) []*Message {
+	r := h.existingRoom(name)
+	if r == nil {
+		return []*Message{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := r.history
+	if limit > 0 && limit < len(list) {
+		list = list[len(list)-limit:]
+	}
+	return append([]*Message{}, list...)
+}
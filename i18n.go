@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+var localeDir = flag.String("locale-dir", "", "directory of message catalogs named <locale>.json, e.g. de.json or pt-BR.json, each a JSON object translating the server's messages by key; English is built in")
+
+// Keys of the server messages catalogs can translate. Errors are looked up
+// as "error.<code>", see errorCode. The greetings are templates like the
+// -welcome and -room-welcome flags.
+const (
+	msgWelcome     = "welcome"
+	msgRoomWelcome = "room_welcome"
+	msgDraining    = "draining"
+	msgServerBusy  = "server_busy"
+)
+
+// catalogs are the message catalogs in -locale-dir, keyed by lower case
+// locale.
+var catalogs map[string]map[string]string
+
+func loadCatalogs() {
+	if *localeDir == "" {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(*localeDir, "*.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	catalogs = make(map[string]map[string]string)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			log.Fatalf("invalid message catalog %s: %v", file, err)
+		}
+		for key, text := range catalog {
+			if key == msgWelcome || key == msgRoomWelcome {
+				if _, err := parseGreeting(key, text); err != nil {
+					log.Fatalf("invalid message catalog %s: %v", file, err)
+				}
+			}
+		}
+		catalogs[strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))] = catalog
+	}
+	log.Printf("Loaded %d message catalogs", len(catalogs))
+}
+
+// translation returns the text for key in locale, falling back to the
+// language without its region, e.g. from pt-br to pt.
+func translation(locale, key string) (string, bool) {
+	for locale != "" {
+		if text, ok := catalogs[locale][key]; ok {
+			return text, true
+		}
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return "", false
+}
+
+// localize returns the text for key in locale, or text, the English one,
+// when there is no translation.
+func localize(locale, key, text string) string {
+	if t, ok := translation(locale, key); ok {
+		return t
+	}
+	return text
+}
+
+// hasCatalog reports whether there are translations for locale or its
+// language.
+func hasCatalog(locale string) bool {
+	for locale != "" {
+		if _, ok := catalogs[locale]; ok {
+			return true
+		}
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return false
+}
+
+// requestLocale picks the locale for a client from the lang query
+// parameter of its handshake, or else its Accept-Language header: the
+// first, by preference, that there is a catalog for. It returns "" for
+// English.
+func requestLocale(r *http.Request) string {
+	return negotiateLocale(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language"))
+}
+
+func negotiateLocale(lang, acceptLanguage string) string {
+	if lang = strings.ToLower(strings.TrimSpace(lang)); hasCatalog(lang) {
+		return lang
+	}
+
+	type choice struct {
+		locale string
+		q      float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		locale, params, _ := strings.Cut(part, ";")
+		c := choice{strings.ToLower(strings.TrimSpace(locale)), 1}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(v, 64); err == nil {
+				c.q = q
+			}
+		}
+		if c.q > 0 {
+			choices = append(choices, c)
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	for _, c := range choices {
+		if hasCatalog(c.locale) {
+			return c.locale
+		}
+	}
+	return ""
+}
+
+// localGreeting returns the greeting template for key in the client's
+// locale, or t when there is no translation.
+func localGreeting(c *Client, key string, t *template.Template) *template.Template {
+	text, ok := translation(c.locale, key)
+	if !ok {
+		return t
+	}
+	local, err := parseGreeting(key, text)
+	if err != nil {
+		return t
+	}
+	return local
+}
+
+// notifyAllLocalized sends every client the message build makes of the
+// text for key in its locale.
+func (h *Hub) notifyAllLocalized(key, text string, build func(body string) *Message) {
+	var mu sync.Mutex
+	byLocale := make(map[string]*Message)
+	h.clients.each(func(c *Client) {
+		mu.Lock()
+		msg := byLocale[c.locale]
+		if msg == nil {
+			msg = build(localize(c.locale, key, text))
+			sign(msg)
+			byLocale[c.locale] = msg
+		}
+		mu.Unlock()
+		c.queue.push(msg)
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const maxIdempotencyKey = 255
+
+var idempotencyWindow = flag.Duration("idempotency-window", 24*time.Hour, "how long responses to broadcast requests with an Idempotency-Key are remembered and replayed for retries")
+
+// storedResponse is the answer to an idempotent request, replayed for
+// retries. It is nil while the first request is still being handled.
+type storedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+type idempotencyEntry struct {
+	resp    *storedResponse
+	expires time.Time
+}
+
+var idempotencyKeys = struct {
+	sync.Mutex
+	byKey map[string]*idempotencyEntry
+	sweep sweeper
+}{byKey: make(map[string]*idempotencyEntry)}
+
+// idempotencyScope names who sent r, so callers cannot see or block each
+// other's responses by guessing keys: the logged in user, the
+// -basic-auth-file user or else the address, within the tenant.
+func idempotencyScope(r *http.Request) string {
+	scope := "ip:" + clientIP(r)
+	if identity := requestIdentity(r); identity != "" {
+		scope = "id:" + identity
+	} else if user := basicAuthUser(r); user != "" {
+		scope = "basic:" + user
+	}
+	return requestTenant(r) + "\n" + scope
+}
+
+// responseRecorder keeps a copy of what a handler writes.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// idempotent handles a request carrying an Idempotency-Key header only
+// once within -idempotency-window; retries get the first response again.
+// Keys are scoped to the caller and the path, and a retry arriving while
+// the first request is still running is answered with 409 Conflict.
+func idempotent(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			httpError(w, r, "Idempotency-Key too long", http.StatusBadRequest)
+			return
+		}
+		key = idempotencyScope(r) + "\n" + r.URL.Path + "\n" + key
+
+		now := time.Now()
+		idempotencyKeys.Lock()
+		if idempotencyKeys.sweep.due(now, time.Minute) {
+			for k, e := range idempotencyKeys.byKey {
+				if e.resp != nil && now.After(e.expires) {
+					delete(idempotencyKeys.byKey, k)
+				}
+			}
+		}
+		e, seen := idempotencyKeys.byKey[key]
+		if !seen {
+			e = &idempotencyEntry{}
+			idempotencyKeys.byKey[key] = e
+		}
+		resp := e.resp
+		idempotencyKeys.Unlock()
+
+		if seen {
+			if resp == nil {
+				httpError(w, r, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+				return
+			}
+			for k, v := range resp.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+			return
+		}
+
+		rr := &responseRecorder{ResponseWriter: w}
+		finished := false
+		// Deferred, so a panicking handler does not leave the key in
+		// progress forever.
+		defer func() {
+			idempotencyKeys.Lock()
+			defer idempotencyKeys.Unlock()
+			if !finished || rr.status >= 500 || rr.status == 0 {
+				// Let the client try again for real.
+				delete(idempotencyKeys.byKey, key)
+				return
+			}
+			e.resp = &storedResponse{rr.status, w.Header().Clone(), rr.body.Bytes()}
+			e.expires = time.Now().Add(*idempotencyWindow)
+		}()
+		h.ServeHTTP(rr, r)
+		finished = true
+	})
+}
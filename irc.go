@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ircAddr = flag.String("irc", "", "address of an IRC listener, such as :6667, where rooms are channels named #room; disabled when empty")
+
+const (
+	ircServerName = "chat"
+	// ircMaxLine is the longest line IRC allows, with its CRLF.
+	ircMaxLine = 512
+	// ircRegisterTimeout is how long a connection has to send NICK and
+	// USER.
+	ircRegisterTimeout = 30 * time.Second
+)
+
+// ircConn speaks IRC to a terminal client. It maps rooms to channels and
+// chat messages to PRIVMSG; joining, leaving and pings are dealt with
+// while receiving.
+type ircConn struct {
+	conn   net.Conn
+	lines  *bufio.Scanner
+	nick   string
+	client *Client
+}
+
+// serveIRC accepts IRC connections on -irc.
+func serveIRC(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("IRC gateway listening on", addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("IRC accept failed:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go onIrcConnect(conn)
+	}
+}
+
+func onIrcConnect(conn net.Conn) {
+	defer conn.Close()
+	defer recoverPanic("IRC connection")
+
+	c := &ircConn{conn: conn, lines: bufio.NewScanner(conn)}
+	c.lines.Buffer(make([]byte, ircMaxLine), ircMaxLine)
+	conn.SetReadDeadline(time.Now().Add(ircRegisterTimeout))
+	nick, ok := c.handshake()
+	if !ok {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	client := NewClient(c)
+	c.client = client
+	client.addr, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	client.meta = map[string][]string{"client": {"irc"}}
+	if *requireLogin {
+		c.writeLine(":%s 464 %s :Log in through the web client, IRC cannot", ircServerName, nick)
+		return
+	}
+	c.nick = nick
+	if err := register(context.Background(), client, nick); err != nil {
+		switch err {
+		case errNickInvalid:
+			c.writeLine(":%s 432 * %s :%s", ircServerName, nick, err)
+		case errNickTaken, errNickReserved:
+			c.writeLine(":%s 433 * %s :%s", ircServerName, nick, err)
+		default:
+			c.writeLine("ERROR :%s", errorMessage(client, err).Body)
+		}
+		return
+	}
+	c.nick = ircNick(client.nick)
+	c.writeLine(":%s 001 %s :Welcome to the chat, %s", ircServerName, c.nick, c.nick)
+	c.writeLine(":%s 422 %s :Join a room with /join #room", ircServerName, c.nick)
+	log.Println("IRC client connected from", client.addr)
+	defer client.hub.removeClient(client)
+	client.listen(context.Background())
+}
+
+// handshake reads lines until the client named itself with NICK and sent
+// USER.
+func (c *ircConn) handshake() (string, bool) {
+	var nick string
+	var user bool
+	for nick == "" || !user {
+		command, params, ok := c.readCommand()
+		if !ok {
+			return "", false
+		}
+		switch command {
+		case "NICK":
+			if len(params) > 0 {
+				nick = params[0]
+			}
+		case "USER":
+			user = true
+		case "PING":
+			c.writeLine("PONG %s :%s", ircServerName, strings.Join(params, " "))
+		case "QUIT":
+			return "", false
+		}
+	}
+	return nick, true
+}
+
+// readCommand reads the next line, returning its command and parameters.
+// A trailing parameter, after " :", may have spaces.
+func (c *ircConn) readCommand() (string, []string, bool) {
+	for c.lines.Scan() {
+		line := strings.TrimRight(c.lines.Text(), "\r")
+		if strings.HasPrefix(line, ":") {
+			// Clients need not send a prefix, and it is not trusted.
+			_, line, _ = strings.Cut(line, " ")
+		}
+		line, trailing, hasTrailing := strings.Cut(line, " :")
+		params := strings.Fields(line)
+		if len(params) == 0 {
+			continue
+		}
+		if hasTrailing {
+			params = append(params, trailing)
+		}
+		return strings.ToUpper(params[0]), params[1:], true
+	}
+	return "", nil, false
+}
+
+// ircUnsafe removes what would end an IRC line early, or is not allowed
+// in one, from whatever went into it: CR, LF and NUL.
+var ircUnsafe = strings.NewReplacer("\r", "", "\n", "", "\x00", "")
+
+func (c *ircConn) writeLine(format string, v ...any) error {
+	line := ircUnsafe.Replace(fmt.Sprintf(format, v...))
+	if len(line) > ircMaxLine-2 {
+		line = line[:ircMaxLine-2]
+	}
+	_, err := io.WriteString(c.conn, line+"\r\n")
+	return err
+}
+
+// reply has the writer goroutine write a line, for the reader.
+func (c *ircConn) reply(format string, v ...any) {
+	line := fmt.Sprintf(format, v...)
+	c.client.write(func() error {
+		return c.writeLine("%s", line)
+	})
+}
+
+// ircNick makes name usable as an IRC nickname.
+func ircNick(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '!' || r == '@' || r == ':' || r == ',' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// Send writes the chat messages of joined rooms as PRIVMSG, other chat
+// messages and errors as NOTICE, and presence changes as JOIN and PART.
+func (c *ircConn) Send(msg *Message) error {
+	switch msg.Type {
+	case "", typeMessage:
+		from := ircNick(msg.Author)
+		if msg.Room == "" {
+			return c.writeLines(":"+from+"!"+from+"@"+ircServerName+" NOTICE "+c.nick+" :", msg.Body)
+		}
+		if from == c.nick {
+			// IRC clients show what they sent themselves.
+			return nil
+		}
+		return c.writeLines(":"+from+"!"+from+"@"+ircServerName+" PRIVMSG #"+msg.Room+" :", msg.Body)
+	case typeError:
+		return c.writeLines(":"+ircServerName+" NOTICE "+c.nick+" :", msg.Body)
+	case typePresenceDiff:
+		if len(msg.Presence) == 0 || msg.Presence[0].Nick == c.nick {
+			return nil
+		}
+		who := ircNick(msg.Presence[0].Nick)
+		switch msg.Change {
+		case presenceJoin:
+			return c.writeLine(":%s!%s@%s JOIN #%s", who, who, ircServerName, msg.Room)
+		case presenceLeave:
+			return c.writeLine(":%s!%s@%s PART #%s", who, who, ircServerName, msg.Room)
+		}
+	}
+	return nil
+}
+
+// writeLines writes each line of body after prefix, IRC has no multi-line
+// messages.
+func (c *ircConn) writeLines(prefix, body string) error {
+	for _, line := range strings.FieldsFunc(body, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		if err := c.writeLine("%s%s", prefix, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Receive handles commands until the client sends a message to a channel
+// it joined, which it returns.
+func (c *ircConn) Receive(msg *Message) error {
+	for {
+		command, params, ok := c.readCommand()
+		if !ok {
+			// Lines too long end the connection too, the scanner stops.
+			return io.EOF
+		}
+		c.client.active()
+
+		switch command {
+		case "PRIVMSG", "NOTICE":
+			if len(params) < 2 || !strings.HasPrefix(params[0], "#") {
+				c.reply(":%s 401 %s :Only channels can be messaged", ircServerName, c.nick)
+				continue
+			}
+			*msg = Message{Author: c.nick, Body: params[1], Room: strings.TrimPrefix(params[0], "#")}
+			return nil
+		case "JOIN":
+			if len(params) == 0 {
+				continue
+			}
+			for _, channel := range strings.Split(params[0], ",") {
+				c.join(strings.TrimPrefix(channel, "#"))
+			}
+		case "PART":
+			if len(params) == 0 {
+				continue
+			}
+			for _, channel := range strings.Split(params[0], ",") {
+				room := strings.TrimPrefix(channel, "#")
+				c.client.hub.leave(c.client, room)
+				c.reply(":%s!%s@%s PART #%s", c.nick, c.nick, ircServerName, room)
+			}
+		case "PING":
+			c.reply("PONG %s :%s", ircServerName, strings.Join(params, " "))
+		case "PONG":
+		case "QUIT":
+			return io.EOF
+		default:
+			c.reply(":%s 421 %s %s :Unknown command", ircServerName, c.nick, command)
+		}
+	}
+}
+
+// join joins room and lists its members, as IRC clients expect.
+func (c *ircConn) join(room string) {
+	if room == "" || hasWildcard(room) {
+		c.reply(":%s 403 %s #%s :No such channel", ircServerName, c.nick, room)
+		return
+	}
+	if err := c.client.hub.join(c.client, room); err != nil {
+		c.reply(":%s 403 %s #%s :%s", ircServerName, c.nick, room, err)
+		return
+	}
+	c.reply(":%s!%s@%s JOIN #%s", c.nick, c.nick, ircServerName, room)
+	var names []string
+	for _, p := range c.client.hub.presence(room).Presence {
+		names = append(names, ircNick(p.Nick))
+	}
+	c.reply(":%s 353 %s = #%s :%s", ircServerName, c.nick, room, strings.Join(names, " "))
+	c.reply(":%s 366 %s #%s :End of /NAMES list", ircServerName, c.nick, room)
+}
+
+func (c *ircConn) Close() error {
+	return c.conn.Close()
+}
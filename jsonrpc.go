@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+)
+
+var rpcNullID = json.RawMessage("null")
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type roomParams struct {
+	Room string `json:"room"`
+}
+
+type subscribeParams struct {
+	Filter map[string]string `json:"filter"`
+}
+
+// willParams sets the last will, an empty body withdraws it.
+type willParams struct {
+	Body string `json:"body"`
+}
+
+type ackParams struct {
+	ID string `json:"id"`
+}
+
+type backfillParams struct {
+	Room string `json:"room"`
+	seqRange
+}
+
+type readParams struct {
+	Room string `json:"room"`
+	Seq  uint64 `json:"seq"`
+}
+
+type timeParams struct {
+	ClientTime int64 `json:"ct"`
+}
+
+type timeResult struct {
+	ClientTime int64 `json:"ct"`
+	ServerTime int64 `json:"ts"`
+}
+
+type historyParams struct {
+	Room  string `json:"room"`
+	Limit int    `json:"limit"`
+}
+
+// jsonrpcConn speaks JSON-RPC 2.0 on top of a websocket. Incoming messages
+// are pushed to the client as "message" notifications, while "send" requests
+// are handed to the client's read loop like plain messages.
+type jsonrpcConn struct {
+	ws     *websocket.Conn
+	client *Client
+}
+
+func (c *jsonrpcConn) Send(msg *Message) error {
+	return sendJSON(c.ws, rpcNotification{"2.0", "message", msg})
+}
+
+func (c *jsonrpcConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *jsonrpcConn) Receive(msg *Message) error {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(c.ws, &data); err != nil {
+			return err
+		}
+
+		c.client.active()
+		var req rpcRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			c.fail(rpcNullID, rpcParseError, "parse error")
+			continue
+		}
+		if req.JSONRPC != "2.0" || req.Method == "" {
+			if req.ID == nil {
+				req.ID = rpcNullID
+			}
+			c.fail(req.ID, rpcInvalidRequest, "invalid request")
+			continue
+		}
+
+		if req.Method == "send" {
+			var m Message
+			err := decodeJSON(req.Params, &m)
+			if err == nil {
+				err = checkRequired(&m)
+			}
+			if verr, ok := err.(*validationError); ok {
+				c.fail(req.ID, rpcInvalidParams, "invalid params: "+verr.Error())
+				continue
+			} else if err != nil {
+				c.fail(req.ID, rpcInvalidParams, "invalid params")
+				continue
+			}
+			c.reply(req.ID, true)
+			*msg = m
+			return nil
+		}
+		c.call(&req)
+	}
+}
+
+func (c *jsonrpcConn) call(req *rpcRequest) {
+	// Methods are named after the message types websocket clients send to
+	// the same effect, so observers are held to the same rules.
+	if c.client.observer && !observerAllowed(&Message{Type: req.Method}) {
+		c.fail(req.ID, rpcInvalidRequest, errObserver.Error())
+		return
+	}
+	switch req.Method {
+	case "join", "leave":
+		var p roomParams
+		if err := json.Unmarshal(req.Params, &p); err != nil || p.Room == "" {
+			c.fail(req.ID, rpcInvalidParams, "invalid params")
+			return
+		}
+		if req.Method == "join" {
+			if err := c.client.hub.join(c.client, p.Room); err != nil {
+				c.fail(req.ID, rpcInvalidParams, err.Error())
+				return
+			}
+		} else {
+			c.client.hub.leave(c.client, p.Room)
+		}
+		c.reply(req.ID, true)
+
+	case "subscribe":
+		var p subscribeParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			c.fail(req.ID, rpcInvalidParams, "invalid params")
+			return
+		}
+		if err := validFilter(p.Filter); err != nil {
+			c.fail(req.ID, rpcInvalidParams, err.Error())
+			return
+		}
+		c.client.hub.subscribe(c.client, p.Filter)
+		c.reply(req.ID, true)
+
+	case "will":
+		var p willParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			c.fail(req.ID, rpcInvalidParams, "invalid params")
+			return
+		}
+		c.client.hub.setWill(c.client, &Message{Body: p.Body})
+		c.reply(req.ID, true)
+
+	case "ack":
+		var p ackParams
+		if err := json.Unmarshal(req.Params, &p); err != nil || p.ID == "" {
+			c.fail(req.ID, rpcInvalidParams, "invalid params")
+			return
+		}
+		c.client.hub.ack(c.client, p.ID)
+		c.reply(req.ID, true)
+
+	case "backfill":
+		if err := checkFeature(featureHistory); err != nil {
+			c.fail(req.ID, rpcInvalidParams, err.Error())
+			return
+		}
+		var p backfillParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			c.fail(req.ID, rpcInvalidParams, "invalid params")
+			return
+		}
+		if err := checkBackfill(c.client, p.Room, &p.seqRange); err != nil {
+			c.fail(req.ID, rpcInvalidParams, err.Error())
+			return
+		}
+		msgs, err := c.client.hub.backfill(p.Room, p.seqRange)
+		if err != nil {
+			c.fail(req.ID, rpcInternalError, "cannot backfill room")
+			return
+		}
+		c.reply(req.ID, msgs)
+
+	case "history":
+		if err := checkFeature(featureHistory); err != nil {
+			c.fail(req.ID, rpcInvalidParams, err.Error())
+			return
+		}
+		var p historyParams
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &p); err != nil {
+				c.fail(req.ID, rpcInvalidParams, "invalid params")
+				return
+			}
+		}
+		if p.Room != "" && !c.client.joined(p.Room) {
+			c.fail(req.ID, rpcInvalidParams, "not in room "+p.Room)
+			return
+		}
+		c.reply(req.ID, c.client.hub.recent(p.Room, p.Limit))
+
+	case "read":
+		var p readParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			c.fail(req.ID, rpcInvalidParams, "invalid params")
+			return
+		}
+		if err := c.client.hub.markRead(c.client, p.Room, p.Seq); err != nil {
+			c.fail(req.ID, rpcInvalidParams, err.Error())
+			return
+		}
+		c.reply(req.ID, true)
+
+	case "receipts":
+		var p roomParams
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &p); err != nil {
+				c.fail(req.ID, rpcInvalidParams, "invalid params")
+				return
+			}
+		}
+		if p.Room != "" && !c.client.joined(p.Room) {
+			c.fail(req.ID, rpcInvalidParams, "not in room "+p.Room)
+			return
+		}
+		m, err := c.client.hub.receipts(context.Background(), p.Room)
+		if err != nil {
+			c.fail(req.ID, rpcInternalError, "cannot load read receipts")
+			return
+		}
+		c.reply(req.ID, m)
+
+	case "presence":
+		var p roomParams
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &p); err != nil {
+				c.fail(req.ID, rpcInvalidParams, "invalid params")
+				return
+			}
+		}
+		if p.Room != "" && !c.client.joined(p.Room) {
+			c.fail(req.ID, rpcInvalidParams, "not in room "+p.Room)
+			return
+		}
+		c.reply(req.ID, c.client.hub.presence(p.Room))
+
+	case "time":
+		var p timeParams
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &p); err != nil {
+				c.fail(req.ID, rpcInvalidParams, "invalid params")
+				return
+			}
+		}
+		c.reply(req.ID, timeResult{p.ClientTime, serverTime()})
+
+	default:
+		c.fail(req.ID, rpcMethodNotFound, "method not found")
+	}
+}
+
+// reply answers a request. Notifications, which carry no id, are never
+// answered.
+func (c *jsonrpcConn) reply(id json.RawMessage, result interface{}) {
+	if id == nil {
+		return
+	}
+	c.client.write(func() error {
+		return sendJSON(c.ws, rpcResponse{JSONRPC: "2.0", ID: id, Result: result})
+	})
+}
+
+func (c *jsonrpcConn) fail(id json.RawMessage, code int, message string) {
+	if id == nil {
+		return
+	}
+	c.client.write(func() error {
+		return sendJSON(c.ws, rpcResponse{JSONRPC: "2.0", ID: id, Error: &rpcError{code, message}})
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	ldapURL          = flag.String("ldap-url", "", "LDAP server to check usernames and passwords posted to /login/ldap against, e.g. ldaps://ldap.example.com; disabled when empty")
+	ldapBindDN       = flag.String("ldap-bind-dn", "", "DN of the service account used to look users up")
+	ldapBindPassword = flag.String("ldap-bind-password", "", "password of the LDAP service account")
+	ldapBaseDN       = flag.String("ldap-base-dn", "", "where to search for users")
+	ldapUserFilter   = flag.String("ldap-user-filter", "(uid=%s)", "filter finding a user by name, (sAMAccountName=%s) for Active Directory")
+	ldapNameAttr     = flag.String("ldap-name-attribute", "cn", "attribute holding the user's chat name")
+)
+
+// groupRoles maps LDAP groups to chat roles, written on the command line as
+// role=groupDN. A user gets the role of the first group listed that they are
+// a member of.
+type groupRoles []struct{ role, group string }
+
+func (gr *groupRoles) String() string {
+	specs := make([]string, len(*gr))
+	for i, m := range *gr {
+		specs[i] = m.role + "=" + m.group
+	}
+	return strings.Join(specs, " ")
+}
+
+func (gr *groupRoles) Set(spec string) error {
+	role, group, ok := strings.Cut(spec, "=")
+	if !ok || role == "" || group == "" {
+		return fmt.Errorf("invalid group role %q, expected role=groupDN", spec)
+	}
+	*gr = append(*gr, struct{ role, group string }{role, group})
+	return nil
+}
+
+func (gr groupRoles) roleOf(groups []string) string {
+	for _, m := range gr {
+		for _, g := range groups {
+			if strings.EqualFold(g, m.group) {
+				return m.role
+			}
+		}
+	}
+	return defaultRole
+}
+
+var ldapRoles groupRoles
+
+func init() {
+	flag.Var(&ldapRoles, "ldap-group-role", "give members of an LDAP group a chat role, as role=groupDN, may be repeated")
+}
+
+var errBadCredentials = errors.New("invalid username or password")
+
+// ldapAuthenticate checks the password of username and returns the user's
+// chat name and role.
+func ldapAuthenticate(username, password string) (name, role string, err error) {
+	if password == "" {
+		// An empty password would be an unauthenticated bind, which
+		// succeeds on most servers.
+		return "", "", errBadCredentials
+	}
+
+	conn, err := ldap.DialURL(*ldapURL, ldap.DialWithTLSConfig(&tls.Config{}))
+	if err != nil {
+		return "", "", err
+	}
+	defer conn.Close()
+
+	if *ldapBindDN != "" {
+		if err := conn.Bind(*ldapBindDN, *ldapBindPassword); err != nil {
+			return "", "", err
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		*ldapBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(*ldapUserFilter, ldap.EscapeFilter(username)),
+		[]string{*ldapNameAttr, "memberOf"}, nil,
+	))
+	if err != nil {
+		return "", "", err
+	}
+	if len(res.Entries) != 1 {
+		return "", "", errBadCredentials
+	}
+	user := res.Entries[0]
+
+	if err := conn.Bind(user.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", "", errBadCredentials
+		}
+		return "", "", err
+	}
+
+	name = user.GetAttributeValue(*ldapNameAttr)
+	if name == "" {
+		name = username
+	}
+	return name, ldapRoles.roleOf(user.GetAttributeValues("memberOf")), nil
+}
+
+// ldapLoginHandler starts a session for a username and password posted as
+// a form.
+func ldapLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if *ldapURL == "" {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, role, err := ldapAuthenticate(r.PostFormValue("username"), r.PostFormValue("password"))
+	if err == errBadCredentials {
+		httpError(w, r, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println("LDAP login failed:", err)
+		httpError(w, r, "Login failed", http.StatusBadGateway)
+		return
+	}
+
+	if err := startSession(w, r, name, name, role, requestTenant(r)); err != nil {
+		log.Println("Cannot start session:", err)
+		httpError(w, r, "Login failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Logged in %s as %s", name, role)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
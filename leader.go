@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var leaderLease = flag.Duration("leader-lease", 15*time.Second, "how long the leader among the instances sharing -session-redis stays leader without renewing its lease; the leader alone delivers scheduled messages and sends digests")
+
+const leaderKey = "leader"
+
+// leader is the election of the instance running the jobs that must run
+// once however many instances there are. Without Redis every instance
+// leads itself.
+var leader = struct {
+	id string
+	// until is when the lease of this instance ends, in Unix nanoseconds,
+	// zero when it does not lead.
+	until atomic.Int64
+}{id: newMessageID()}
+
+// renewLease extends the lease only if this instance still holds it.
+var renewLease = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// leading reports whether this instance is the leader.
+func leading() bool {
+	if redisClient() == nil {
+		return true
+	}
+	return time.Now().UnixNano() < leader.until.Load()
+}
+
+// startLeaderElection campaigns for leadership once, so the jobs know
+// where they stand when the server starts, then keeps renewing or trying
+// to take the lease.
+func startLeaderElection() {
+	c := redisClient()
+	if c == nil {
+		return
+	}
+	campaign(c)
+	go func() {
+		ticker := time.NewTicker(*leaderLease / 3)
+		for range ticker.C {
+			campaign(c)
+		}
+	}()
+}
+
+func campaign(c *redis.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), *leaderLease/3)
+	defer cancel()
+
+	was := leading()
+	start := time.Now()
+	var ok bool
+	var err error
+	if was {
+		var renewed int
+		renewed, err = renewLease.Run(ctx, c, []string{leaderKey}, leader.id, leaderLease.Milliseconds()).Int()
+		ok = renewed == 1
+	} else {
+		ok, err = c.SetNX(ctx, leaderKey, leader.id, *leaderLease).Result()
+	}
+	switch {
+	case err != nil:
+		// The lease runs out by itself if Redis stays unreachable.
+		log.Println("Leader election failed:", err)
+		return
+	case ok:
+		leader.until.Store(start.Add(*leaderLease).UnixNano())
+		if !was {
+			log.Println("Elected leader")
+		}
+	default:
+		leader.until.Store(0)
+		if was {
+			log.Println("No longer the leader")
+		}
+	}
+	if ok {
+		// Messages scheduled through other instances are picked up here.
+		restoreScheduled()
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Why clients disconnect.
+const (
+	reasonClientClose  = "client_close"
+	reasonTimeout      = "timeout"
+	reasonError        = "error"
+	reasonKicked       = "kicked"
+	reasonSlowConsumer = "slow_consumer"
+	reasonShutdown     = "shutdown"
+)
+
+var maxSkipped = flag.Int("max-skipped", 100, "messages in a row a client may miss because its send queue is full before it is disconnected as a slow consumer, 0 never disconnects")
+
+var (
+	connectionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chat_connection_duration_seconds",
+		Help:    "How long clients stayed connected.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	})
+	disconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_disconnects_total",
+		Help: "Clients disconnected, by reason.",
+	}, []string{"reason"})
+)
+
+const recentDisconnectsSize = 100
+
+// disconnectInfo describes a client that went away, for the admin API.
+type disconnectInfo struct {
+	Nick           string    `json:"nick,omitempty"`
+	Identity       string    `json:"identity,omitempty"`
+	Addr           string    `json:"addr,omitempty"`
+	ConnectedAt    time.Time `json:"connectedAt"`
+	DisconnectedAt time.Time `json:"disconnectedAt"`
+	Reason         string    `json:"reason"`
+}
+
+var recentDisconnects = struct {
+	sync.Mutex
+	list []disconnectInfo
+}{}
+
+// closeWith closes the client's connection, recording why. The first
+// reason given sticks.
+func (c *Client) closeWith(reason string) {
+	c.setCloseReason(reason)
+	c.closeConnection()
+}
+
+func (c *Client) setCloseReason(reason string) {
+	c.mu.Lock()
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+	c.mu.Unlock()
+}
+
+// closeReasonFor tells why the connection ended with err, unless the
+// server closed it.
+func closeReasonFor(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil || err == io.EOF:
+		return reasonClientClose
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return reasonTimeout
+	}
+	return reasonError
+}
+
+// skippedMessage is called when a message could not be queued for c, and
+// disconnects it once that happened -max-skipped times in a row.
+func (c *Client) skippedMessage() {
+	if *maxSkipped > 0 && c.skipped.Add(1) == int32(*maxSkipped) {
+		go c.closeWith(reasonSlowConsumer)
+	}
+}
+
+// recordDisconnect counts a client that has just been removed.
+func recordDisconnect(c *Client) string {
+	c.mu.Lock()
+	reason := c.closeReason
+	c.mu.Unlock()
+	if reason == "" {
+		reason = reasonClientClose
+	}
+
+	now := time.Now()
+	connectionDuration.Observe(now.Sub(c.connectedAt).Seconds())
+	disconnects.WithLabelValues(reason).Inc()
+
+	recentDisconnects.Lock()
+	recentDisconnects.list = append(recentDisconnects.list, disconnectInfo{
+		Nick:           c.nick,
+		Identity:       c.identity,
+		Addr:           c.addr,
+		ConnectedAt:    c.connectedAt.UTC(),
+		DisconnectedAt: now.UTC(),
+		Reason:         reason,
+	})
+	if len(recentDisconnects.list) > recentDisconnectsSize {
+		recentDisconnects.list = recentDisconnects.list[1:]
+	}
+	recentDisconnects.Unlock()
+	return reason
+}
+
+// disconnectsHandler serves GET /admin/disconnects, the latest clients to
+// go away and why, oldest first.
+func disconnectsHandler(w http.ResponseWriter, r *http.Request) {
+	recentDisconnects.Lock()
+	list := append([]disconnectInfo{}, recentDisconnects.list...)
+	recentDisconnects.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
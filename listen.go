@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// handlerSets are the groups of endpoints a listener can expose.
+var handlerSets = map[string]func(mux *http.ServeMux){
+	"ws": func(mux *http.ServeMux) {
+		mux.Handle("/ws", refuseWhileDraining(refuseWhileOverloaded(admitConnections(wsHandler))))
+	},
+	"broadcast": func(mux *http.ServeMux) {
+		mux.Handle("/broadcast/", protectBroadcast(broadcastHandler))
+		mux.Handle("/broadcast/batch", protectBroadcast(batchBroadcastHandler))
+		mux.Handle("/rooms/", roomsHandler())
+		mux.Handle("/stream", refuseWhileDraining(refuseWhileOverloaded(requireBasicAuth(http.HandlerFunc(streamHandler)))))
+		mux.Handle("/hooks/", limitRequests(http.HandlerFunc(webhookHandler)))
+		mux.HandleFunc("/bridges/slack/events", slackEventsHandler)
+		mux.HandleFunc("/_matrix/app/v1/transactions/", matrixTransactionsHandler)
+	},
+	"auth": func(mux *http.ServeMux) {
+		mux.HandleFunc("/login", loginHandler)
+		mux.HandleFunc("/callback", callbackHandler)
+		mux.HandleFunc("/login/ldap", ldapLoginHandler)
+		mux.Handle("/logout", csrfProtect(http.HandlerFunc(logoutHandler)))
+	},
+	"users": func(mux *http.ServeMux) {
+		mux.Handle("/users/", csrfProtect(http.HandlerFunc(usersHandler)))
+	},
+	"admin": func(mux *http.ServeMux) {
+		mux.Handle("/admin/audit", requireServerAdmin(http.HandlerFunc(auditHandler)))
+		mux.Handle("/admin/ws", adminWsHandler)
+		mux.Handle("/admin/clients", requireAdmin(http.HandlerFunc(adminClientsHandler)))
+		mux.Handle("/admin/kick", requireAdmin(csrfProtect(http.HandlerFunc(adminKickHandler))))
+		mux.Handle("/admin/bans", requireAdmin(csrfProtect(http.HandlerFunc(adminBansHandler))))
+		mux.Handle("/admin/disconnects", requireServerAdmin(http.HandlerFunc(disconnectsHandler)))
+		mux.Handle("/admin/stats", requireAdmin(http.HandlerFunc(adminStatsHandler)))
+		mux.Handle("/admin/features", requireServerAdmin(csrfProtect(http.HandlerFunc(featuresHandler))))
+		mux.Handle("/admin/config", requireServerAdmin(csrfProtect(http.HandlerFunc(configHandler))))
+		mux.Handle("/admin/tenants", requireServerAdmin(http.HandlerFunc(adminTenantsHandler)))
+		mux.Handle("/admin/usage", requireServerAdmin(http.HandlerFunc(usageHandler)))
+	},
+	"replication": func(mux *http.ServeMux) {
+		mux.Handle("/replication", replicationHandler)
+	},
+	"metrics": func(mux *http.ServeMux) {
+		mux.Handle("/metrics", metricsHandler)
+	},
+	"ui": func(mux *http.ServeMux) {
+		mux.Handle("/", uiHandler(*webroot))
+	},
+}
+
+// protectBroadcast puts the checks every broadcast endpoint shares in
+// front of h.
+func protectBroadcast(h http.HandlerFunc) http.Handler {
+	return refuseWhileOverloaded(requireBasicAuth(limitRequests(requireSignedRequest(csrfProtect(idempotent(h))))))
+}
+
+var allHandlers = []string{"ws", "broadcast", "auth", "users", "admin", "replication", "metrics", "ui"}
+
+// defaultHandlers are served by listeners that name none. The metrics are
+// left out: they are not authenticated and name rooms and tenants, so they
+// belong on a listener only the scraper can reach, such as
+// -listen 127.0.0.1:9100=metrics.
+var defaultHandlers = []string{"ws", "broadcast", "auth", "users", "admin", "replication", "ui"}
+
+// listener is one address the server accepts HTTP connections on, written
+// on the command line as [proxy+][tcp://|tls://|unix://|systemd://]address[=handler,...].
+// Systemd addresses name a socket passed by socket activation. The proxy+
+// prefix expects every connection to start with a PROXY protocol header, as
+// sent by HAProxy and most TCP load balancers.
+type listener struct {
+	network  string
+	addr     string
+	tls      bool
+	proxy    bool
+	handlers []string
+}
+
+func parseListener(spec string) (listener, error) {
+	l := listener{network: "tcp", handlers: defaultHandlers}
+
+	addr, handlers, ok := strings.Cut(spec, "=")
+	if ok {
+		l.handlers = strings.Split(handlers, ",")
+		for _, h := range l.handlers {
+			if handlerSets[h] == nil {
+				return l, fmt.Errorf("unknown handler set %q, expected one of: %s", h, strings.Join(allHandlers, ", "))
+			}
+		}
+	}
+
+	if strings.HasPrefix(addr, "proxy+") {
+		l.proxy = true
+		addr = strings.TrimPrefix(addr, "proxy+")
+	}
+
+	switch {
+	case strings.HasPrefix(addr, "tls://"):
+		l.tls = true
+		addr = strings.TrimPrefix(addr, "tls://")
+	case strings.HasPrefix(addr, "unix://"):
+		l.network = "unix"
+		addr = strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "systemd://"):
+		l.network = "systemd"
+		addr = strings.TrimPrefix(addr, "systemd://")
+	default:
+		addr = strings.TrimPrefix(addr, "tcp://")
+	}
+	if addr == "" {
+		return l, fmt.Errorf("missing address in %q", spec)
+	}
+	l.addr = addr
+	return l, nil
+}
+
+func (l listener) String() string {
+	scheme := "tcp"
+	if l.tls {
+		scheme = "tls"
+	} else if l.network != "tcp" {
+		scheme = l.network
+	}
+	if l.proxy {
+		scheme = "proxy+" + scheme
+	}
+	return scheme + "://" + l.addr + "=" + strings.Join(l.handlers, ",")
+}
+
+type listenerList []listener
+
+func (ls *listenerList) String() string {
+	specs := make([]string, len(*ls))
+	for i, l := range *ls {
+		specs[i] = l.String()
+	}
+	return strings.Join(specs, " ")
+}
+
+func (ls *listenerList) Set(spec string) error {
+	l, err := parseListener(spec)
+	if err != nil {
+		return err
+	}
+	*ls = append(*ls, l)
+	return nil
+}
+
+var listeners listenerList
+
+func init() {
+	flag.Var(&listeners, "listen", "listen on [proxy+][tcp://|tls://|unix://|systemd://]address[=handler,...], may be repeated (default :3000, or the sockets passed by systemd, with all of ws, broadcast, auth, users, admin, replication, ui; metrics must be asked for)")
+}
+
+func (l listener) serve(ln net.Listener) *http.Server {
+	mux := http.NewServeMux()
+	for _, h := range l.handlers {
+		handlerSets[h](mux)
+	}
+
+	if l.proxy {
+		// Wrapped here rather than in listen so the raw socket can still be
+		// handed over on upgrades.
+		ln = &proxyproto.Listener{Listener: ln, ReadHeaderTimeout: 10 * time.Second}
+	}
+
+	log.Println("Listening on", l)
+	srv := &http.Server{Handler: accessLog(recoverHandler(resolveTenant(mux)))}
+	if l.tls {
+		config, err := serverTLSConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = config
+	}
+	go func() {
+		var err error
+		if l.tls {
+			// The certificate comes from srv.TLSConfig.
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return srv
+}
+
+func (l listener) listen() (net.Listener, error) {
+	if ln := upgradeListener(l.String()); ln != nil {
+		return ln, nil
+	}
+
+	switch l.network {
+	case "systemd":
+		return systemdListener(l.addr)
+	case "tcp":
+		return net.Listen(l.network, l.addr)
+	}
+
+	perm, err := strconv.ParseUint(*unixMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unix socket mode %q: %v", *unixMode, err)
+	}
+
+	// A socket left behind by a previous run would make Listen fail.
+	if fi, err := os.Stat(l.addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(l.addr)
+	}
+
+	ln, err := net.Listen("unix", l.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(l.addr, os.FileMode(perm)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -1,27 +1,302 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+	"google.golang.org/grpc"
+)
+
+// protocolVersion is the envelope version spoken by chat.v2 clients. The
+// original bare {author, body} messages are version 1.
+const protocolVersion = 2
+
+const (
+	typeMessage = "message"
+	// typeTombstone tells clients that everything from the user named in
+	// the body was erased.
+	typeTombstone = "tombstone"
 )
 
 type Message struct {
-	Author string `json:"author"`
-	Body   string `json:"body"`
+	Version int    `json:"v,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Author  string `json:"author"`
+	Body    string `json:"body"`
+	Room    string `json:"room,omitempty"`
+	// ID is assigned by the server when the message is broadcast.
+	ID string `json:"id,omitempty"`
+	// Seq numbers the messages of a room without gaps, so clients can tell
+	// when they missed some.
+	Seq uint64 `json:"seq,omitempty"`
+	// Range of a backfill request.
+	Range *seqRange `json:"range,omitempty"`
+	// ClientID is chosen by the sender to have retries recognized.
+	ClientID string `json:"cid,omitempty"`
+	// Retain keeps the message as the current one of its room, handed to
+	// every client joining later. A retained message with an empty body
+	// clears it.
+	Retain bool `json:"retain,omitempty"`
+	// QoS is the delivery guarantee, qosAtMostOnce or qosAtLeastOnce.
+	QoS int `json:"qos,omitempty"`
+	// To is the nickname of the only recipient of a key exchange or a
+	// WebRTC signaling message.
+	To string `json:"to,omitempty"`
+	// Ref is the ID of the message a preview belongs to.
+	Ref string `json:"ref,omitempty"`
+	// Preview of a link in the message referenced by Ref.
+	Preview *LinkPreview `json:"preview,omitempty"`
+	// Profile of the author, attached by the server to messages from
+	// authenticated users.
+	Profile *Profile `json:"profile,omitempty"`
+	// Filter of a subscribe request, see Client.wants.
+	Filter map[string]string `json:"filter,omitempty"`
+	// At is when a scheduled message is to be delivered.
+	At *time.Time `json:"at,omitempty"`
+	// Stats are posted to the #stats room.
+	Stats *serverStats `json:"stats,omitempty"`
+	// Features of a capabilities message, by name.
+	Features map[string]bool `json:"features,omitempty"`
+	// Receipts of a receipts message, read markers by reader.
+	Receipts map[string]uint64 `json:"receipts,omitempty"`
+	// Presence of a presence message, the members of Room, or of a
+	// presence diff, the member that changed.
+	Presence []presence `json:"presence,omitempty"`
+	// PresenceVersion is the version of the members of Room a presence
+	// message or diff brings clients to.
+	PresenceVersion uint64 `json:"pv,omitempty"`
+	// Change of a presence diff, presenceJoin, presenceLeave or
+	// presenceStatus.
+	Change string `json:"change,omitempty"`
+	// ReconnectAfter is how many seconds clients of a draining server
+	// should wait before reconnecting.
+	ReconnectAfter int `json:"reconnectAfter,omitempty"`
+	// RequestID is the ID of the HTTP request that broadcast the message,
+	// as logged in the access log.
+	RequestID string `json:"rid,omitempty"`
+	// Priority is priorityUrgent, prioritySystem, priorityBulk or empty
+	// for normal.
+	Priority string `json:"priority,omitempty"`
+	// ServerTime is when the server received a broadcast message, or
+	// answered a time request, in Unix milliseconds. Clients order and
+	// label messages by it rather than by their own clocks.
+	ServerTime int64 `json:"ts,omitempty"`
+	// ClientTime is the client's clock in a time request, see typeTime.
+	ClientTime int64 `json:"ct,omitempty"`
+	// CorrelationID is set by the sender to trace the message end to end.
+	CorrelationID string `json:"corr,omitempty"`
+	// Code of an error event, see errorCode.
+	Code string `json:"code,omitempty"`
+	// Bridge names the bridge, such as slack, that relayed the message in
+	// from another chat, see bridge.
+	Bridge string `json:"bridge,omitempty"`
+	// Signature proves the message went through this server, see sign.
+	Signature string `json:"sig,omitempty"`
+	// Audio is the frame of an audio message, see typeAudio.
+	Audio []byte `json:"audio,omitempty"`
+	// Tags and Notes are added by the rules the message matched, see
+	// applyRules.
+	Tags  []string          `json:"tags,omitempty"`
+	Notes map[string]string `json:"notes,omitempty"`
+	// Encoding says how Body is compressed, see encodingGzip.
+	Encoding string `json:"enc,omitempty"`
+	// Chunk says which part of a larger message a chunk is, see typeChunk.
+	Chunk *chunk `json:"chunk,omitempty"`
+	// Heartbeat is the agreed heartbeat interval of the client greeted, in
+	// milliseconds, see negotiateHeartbeat.
+	Heartbeat int64 `json:"heartbeat,omitempty"`
+
+	// Select limits delivery to matching clients.
+	Select selector `json:"-"`
+	// received is when the server got the message, and writes counts its
+	// deliveries, for the latency metrics.
+	received time.Time
+	writes   *writeTracker
+	// replicated is set for messages a replica got from its primary,
+	// already numbered, see replication.
+	replicated bool
+	// hook names the integration that posted the message, see transform.
+	hook string
 }
 
+var (
+	grpcAddr       = flag.String("grpc-addr", "", "address of the gRPC listener, disabled when empty")
+	wtAddr         = flag.String("webtransport", "", "address of the experimental WebTransport (HTTP/3) listener, disabled when empty")
+	tlsCert        = flag.String("tls-cert", "", "TLS certificate file")
+	tlsKey         = flag.String("tls-key", "", "TLS private key file")
+	unixSock       = flag.String("unix", "", "also serve on this unix socket path, same as -listen unix://path")
+	unixMode       = flag.String("unix-mode", "0660", "permissions of unix socket files")
+	upgradeTimeout = flag.Duration("upgrade-timeout", 30*time.Second, "how long to wait for a new binary to start during an upgrade")
+	drainTimeout   = flag.Duration("drain-timeout", time.Minute, "how long an old process keeps serving its clients after an upgrade, or a stopped one before closing the last connections")
+	webroot        = flag.String("webroot", "", "directory with static frontend files served at /, replaces the built-in chat page")
+)
+
 func main() {
-	http.HandleFunc("/broadcast/", broadcastHandler)
-	http.Handle("/ws", wsHandler)
+	flag.Parse()
+	tenants.once.Do(loadTenants)
+	loadVhosts()
+	loadQuotas()
+	loadWebhooks()
+	checkFanoutPolicy()
+	loadRules()
+	loadScript()
+	loadPlugins()
+	loadCatalogs()
+
+	if *unixSock != "" {
+		listeners = append(listeners, listener{network: "unix", addr: *unixSock, handlers: defaultHandlers})
+	}
+	if len(listeners) == 0 {
+		for _, spec := range inheritedListeners() {
+			if l, err := parseListener(spec); err == nil {
+				listeners = append(listeners, l)
+			}
+		}
+	}
+	if len(listeners) == 0 {
+		sockets, err := systemdSockets()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i := range sockets {
+			listeners = append(listeners, listener{network: "systemd", addr: strconv.Itoa(i), handlers: defaultHandlers})
+		}
+	}
+	if len(listeners) == 0 {
+		listeners = append(listeners, listener{network: "tcp", addr: ":3000", handlers: defaultHandlers})
+	}
+
+	sockets := make(map[string]net.Listener)
+	for _, l := range listeners {
+		ln, err := l.listen()
+		if err != nil {
+			log.Fatal(err)
+		}
+		sockets[l.String()] = ln
+	}
+	var grpcLn net.Listener
+	if *grpcAddr != "" {
+		ln, err := listenGRPC(*grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		grpcLn = ln
+		sockets["grpc://"+*grpcAddr] = ln
+	}
+	upgradeReady()
+	startReplication()
+	startCluster()
+	startEtcd()
+	startLeaderElection()
+	watchLoad()
+	restoreScheduled()
+	startSlackBridge()
+	startDiscordBridge()
+	startMatrixBridge()
+	if *ircAddr != "" {
+		go serveIRC(*ircAddr)
+	}
+	go runStats()
+	go runUsageExport()
+	go runDigests()
+
+	var grpcServer *grpc.Server
+	if grpcLn != nil {
+		grpcServer = serveGRPC(grpcLn)
+	}
+	var servers []*http.Server
+	for _, l := range listeners {
+		servers = append(servers, l.serve(sockets[l.String()]))
+	}
+	var wt *webtransport.Server
+	if *wtAddr != "" {
+		wt = serveWebTransport(*wtAddr, *tlsCert, *tlsKey)
+	}
+
+	upgradeDone := make(chan bool)
+	go func() {
+		waitForUpgrade(sockets)
+		close(upgradeDone)
+	}()
 
-	http.ListenAndServe(":3000", nil)
+	select {
+	case <-upgradeDone:
+		// The new process owns the sockets now.
+		for _, srv := range servers {
+			go srv.Shutdown(context.Background())
+		}
+		if grpcServer != nil {
+			go grpcServer.GracefulStop()
+		}
+		if wt != nil {
+			wt.Close()
+		}
+		drainClients(*drainTimeout)
+	case sig := <-terminated():
+		// Keep listening, so new clients get a 503 rather than a refused
+		// connection, until the old ones are gone.
+		log.Println("Received", sig, "draining clients")
+		drainClients(*drainTimeout)
+		for _, srv := range servers {
+			srv.Shutdown(context.Background())
+		}
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		if wt != nil {
+			wt.Close()
+		}
+	}
 }
 
+// broadcastHandler sends the message in the path to everyone, or with
+// select=key=value query parameters only to matching clients. With at or
+// delay parameters the message is scheduled instead, until cancelled with
+// DELETE /broadcast/scheduled/{id}.
 func broadcastHandler(w http.ResponseWriter, r *http.Request) {
-	msg := readMsgFromRequest(r)
-	broadcast(&Message{"Server", msg})
-	fmt.Fprintf(w, "Broadcasting %v", msg)
+	if id, ok := strings.CutPrefix(r.URL.Path, "/broadcast/scheduled/"); ok {
+		unscheduleHandler(w, r, id)
+		return
+	}
+	sel, err := parseSelector(r.URL.Query()["select"])
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	at, err := requestedDeliveryTime(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	corr, err := requestCorrelationID(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	priority, err := parsePriority(r.URL.Query().Get("priority"))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body := readMsgFromRequest(r)
+	log.Printf("Broadcast requested by %s, correlation %s", clientIP(r), corr)
+	auditAction(requestActor(r), "broadcast", "", body)
+	msg := &Message{Author: "Server", Body: body, Select: sel, Priority: priority, RequestID: requestID(r), CorrelationID: corr}
+	if !at.IsZero() {
+		scheduleFromRequest(w, r, msg, at)
+		return
+	}
+	d := hubFor(r).broadcast(msg)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
 }
 
 func readMsgFromRequest(r *http.Request) string {
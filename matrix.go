@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	matrixHomeserver  = flag.String("matrix-homeserver", "", "URL of the Matrix homeserver the Matrix bridge is an application service of, such as https://matrix.example.com; the bridge is off when empty")
+	matrixDomain      = flag.String("matrix-domain", "", "server name of the Matrix homeserver, the part of user IDs after the colon")
+	matrixASTokenFile = flag.String("matrix-as-token-file", "", "file with the as_token of the bridge's application service registration")
+	matrixHSTokenFile = flag.String("matrix-hs-token-file", "", "file with the hs_token of the bridge's application service registration, which the homeserver pushes events with")
+	matrixUserPrefix  = flag.String("matrix-user-prefix", "chat_", "localpart prefix of the Matrix users standing in for chat users; the registration must claim it as an exclusive user namespace")
+	matrixRooms       = flag.String("matrix-rooms", "", "comma separated room=matrix room ID pairs the Matrix bridge mirrors, such as general=!abc123:example.com")
+)
+
+// matrixRetries is how often a request rate limited by the homeserver is
+// retried.
+const matrixRetries = 3
+
+var (
+	matrixASToken string
+	matrixHSToken string
+	matrixBridge  *bridge
+)
+
+// matrixUsers remembers which stand-in users were registered and joined
+// which Matrix rooms, and the display names of Matrix users.
+var matrixUsers = struct {
+	sync.Mutex
+	registered map[string]bool
+	joined     map[string]bool
+	names      map[string]string
+}{registered: make(map[string]bool), joined: make(map[string]bool), names: make(map[string]string)}
+
+// startMatrixBridge mirrors the -matrix-rooms to Matrix, if configured.
+func startMatrixBridge() {
+	if *matrixHomeserver == "" {
+		return
+	}
+	if *matrixDomain == "" || *matrixASTokenFile == "" || *matrixHSTokenFile == "" {
+		log.Fatal("the Matrix bridge needs -matrix-domain, -matrix-as-token-file and -matrix-hs-token-file")
+	}
+	matrixASToken = readSecretFile(*matrixASTokenFile)
+	matrixHSToken = readSecretFile(*matrixHSTokenFile)
+	matrixBridge = startBridge("matrix", parseBridgeRooms("matrix", *matrixRooms), postToMatrix)
+}
+
+// matrixCall makes a client-server API request as the application
+// service, on behalf of user when set, and decodes the response into out
+// when given.
+func matrixCall(method, path, user string, in, out any) error {
+	u := strings.TrimSuffix(*matrixHomeserver, "/") + path
+	if user != "" {
+		u += "?user_id=" + url.QueryEscape(user)
+	}
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		r, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Authorization", "Bearer "+matrixASToken)
+		r.Header.Set("Content-Type", "application/json")
+		resp, err := bridgeHTTP.Do(r)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < matrixRetries {
+			resp.Body.Close()
+			time.Sleep(retryAfter(resp))
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			var merr struct {
+				Code  string `json:"errcode"`
+				Error string `json:"error"`
+			}
+			json.NewDecoder(resp.Body).Decode(&merr)
+			return &matrixError{resp.StatusCode, merr.Code, merr.Error}
+		}
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+}
+
+// matrixError is an error answer of the homeserver.
+type matrixError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *matrixError) Error() string {
+	return "Matrix API: " + e.code + ": " + e.message
+}
+
+// matrixUser returns the ID of the Matrix user standing in for the chat
+// user author.
+func matrixUser(author string) string {
+	localpart := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, author)
+	return "@" + *matrixUserPrefix + localpart + ":" + *matrixDomain
+}
+
+// ensureMatrixMember registers the stand-in user, named after author, and
+// has it join roomID, unless done before.
+func ensureMatrixMember(user, author, roomID string) error {
+	matrixUsers.Lock()
+	registered, joined := matrixUsers.registered[user], matrixUsers.joined[user+" "+roomID]
+	matrixUsers.Unlock()
+
+	if !registered {
+		localpart := strings.TrimPrefix(strings.Split(user, ":")[0], "@")
+		err := matrixCall(http.MethodPost, "/_matrix/client/v3/register", "", map[string]string{"type": "m.login.application_service", "username": localpart}, nil)
+		var merr *matrixError
+		if err != nil && !(errors.As(err, &merr) && merr.code == "M_USER_IN_USE") {
+			return err
+		}
+		if err := matrixCall(http.MethodPut, "/_matrix/client/v3/profile/"+url.PathEscape(user)+"/displayname", user, map[string]string{"displayname": author}, nil); err != nil {
+			log.Println("Cannot set Matrix display name of", user, err)
+		}
+		matrixUsers.Lock()
+		matrixUsers.registered[user] = true
+		matrixUsers.Unlock()
+	}
+	if !joined {
+		if err := matrixCall(http.MethodPost, "/_matrix/client/v3/rooms/"+url.PathEscape(roomID)+"/join", user, struct{}{}, nil); err != nil {
+			return err
+		}
+		matrixUsers.Lock()
+		matrixUsers.joined[user+" "+roomID] = true
+		matrixUsers.Unlock()
+	}
+	return nil
+}
+
+// postToMatrix sends msg to the Matrix room roomID as the stand-in user
+// of its author.
+func postToMatrix(roomID string, msg *Message) error {
+	user := matrixUser(msg.Author)
+	if err := ensureMatrixMember(user, msg.Author, roomID); err != nil {
+		return err
+	}
+	txn := msg.ID
+	if txn == "" {
+		txn = newMessageID()
+	}
+	content := map[string]string{"msgtype": "m.text", "body": msg.Body}
+	return matrixCall(http.MethodPut, "/_matrix/client/v3/rooms/"+url.PathEscape(roomID)+"/send/m.room.message/"+url.PathEscape(txn), user, content, nil)
+}
+
+// matrixName returns the display name of the Matrix user with id, or its
+// localpart when it has none.
+func matrixName(id string) string {
+	matrixUsers.Lock()
+	name, ok := matrixUsers.names[id]
+	matrixUsers.Unlock()
+	if ok {
+		return name
+	}
+
+	var out struct {
+		DisplayName string `json:"displayname"`
+	}
+	if err := matrixCall(http.MethodGet, "/_matrix/client/v3/profile/"+url.PathEscape(id)+"/displayname", "", nil, &out); err == nil && out.DisplayName != "" {
+		name = out.DisplayName
+	} else {
+		name = strings.TrimPrefix(strings.Split(id, ":")[0], "@")
+	}
+	matrixUsers.Lock()
+	matrixUsers.names[id] = name
+	matrixUsers.Unlock()
+	return name
+}
+
+// matrixTransactionsHandler serves PUT /_matrix/app/v1/transactions/{id},
+// the events the homeserver pushes to the bridge, relaying the messages
+// of the bridged rooms.
+func matrixTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !matrixBridge.serves(r) {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", "PUT")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("access_token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(matrixHSToken)) != 1 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"errcode":"M_FORBIDDEN"}`)
+		return
+	}
+
+	var txn struct {
+		Events []struct {
+			Type    string `json:"type"`
+			RoomID  string `json:"room_id"`
+			Sender  string `json:"sender"`
+			Content struct {
+				MsgType string `json:"msgtype"`
+				Body    string `json:"body"`
+			} `json:"content"`
+		} `json:"events"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&txn); err != nil {
+		httpError(w, r, "Invalid transaction", decodeStatus(err))
+		return
+	}
+	// The homeserver sends a transaction again until it is acknowledged.
+	id := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1/transactions/")
+	if broadcastNonces.add("matrix:"+id, time.Now()) {
+		for _, e := range txn.Events {
+			if e.Type != "m.room.message" || strings.HasPrefix(e.Sender, "@"+*matrixUserPrefix) {
+				continue
+			}
+			body := e.Content.Body
+			switch e.Content.MsgType {
+			case "m.text", "m.notice":
+			case "m.emote":
+				body = "* " + body
+			default:
+				continue
+			}
+			go func() {
+				matrixBridge.relay(e.RoomID, matrixName(e.Sender), body)
+			}()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, "{}")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsHandler serves the Prometheus metrics at /metrics.
+var metricsHandler = promhttp.Handler()
+
+var metricsMaxRooms = flag.Int("metrics-max-rooms", 100, "rooms given their own label in the per-room metrics; later ones are counted together as (other)")
+
+var (
+	broadcastLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chat_broadcast_latency_seconds",
+		Help:    "Time from receiving a message to writing it to the last of its recipients.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	})
+	clientWriteDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chat_client_write_duration_seconds",
+		Help:    "Time taken to write one message to a client connection.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+
+	roomMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_room_messages_total",
+		Help: "Messages broadcast to each room.",
+	}, []string{"tenant", "room"})
+	roomBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_room_bytes_total",
+		Help: "Bytes of message bodies broadcast to each room.",
+	}, []string{"tenant", "room"})
+	roomMembers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chat_room_members",
+		Help: "Clients that joined each room by name; the lobby has every client.",
+	}, []string{"tenant", "room"})
+
+	connectionsRefused = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_connections_refused_total",
+		Help: "Connection attempts turned away by -connect-rate, for the server, or -connect-rate-per-ip, for an address.",
+	}, []string{"limit"})
+)
+
+var labeledRooms atomic.Int32
+
+// roomLabel names room in the per-room metrics. Rooms are labeled on a
+// first come basis, up to -metrics-max-rooms, to keep the number of time
+// series bounded. It is called once per room.
+func roomLabel(name string) string {
+	if name == "" {
+		return "(lobby)"
+	}
+	if labeledRooms.Add(1) > int32(*metricsMaxRooms) {
+		return "(other)"
+	}
+	return name
+}
+
+// writeTracker counts the writes of a broadcast still to be done, so the
+// last one can observe the broadcast latency.
+type writeTracker struct {
+	received  time.Time
+	remaining atomic.Int32
+}
+
+// track prepares msg to be delivered. The caller holds one count, let go
+// of with written once it has queued msg for every recipient.
+func (msg *Message) track() {
+	if msg.received.IsZero() {
+		msg.received = time.Now()
+	}
+	msg.writes = &writeTracker{received: msg.received}
+	msg.writes.remaining.Store(1)
+}
+
+// queued is called before msg is queued for a recipient, and must be
+// followed by written once that recipient was written to, or right away
+// if msg could not be queued.
+func (msg *Message) queued() {
+	if msg.writes != nil {
+		msg.writes.remaining.Add(1)
+	}
+}
+
+func (msg *Message) written() {
+	// Messages sent again later, from the history for instance, have
+	// already been counted and go below zero.
+	if msg.writes != nil && msg.writes.remaining.Add(-1) == 0 {
+		broadcastLatency.Observe(time.Since(msg.writes.received).Seconds())
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	moderatedRooms    = flag.String("moderated-rooms", "", "comma separated rooms where what clients send is held until a moderator approves it through /rooms/{room}/held; moderators' own messages go straight through")
+	moderationTimeout = flag.Duration("moderation-timeout", time.Hour, "how long held messages wait for approval before they are dropped")
+)
+
+// typeHeld tells the author that the message referenced by Ref awaits a
+// moderator's approval.
+const typeHeld = "held"
+
+// adminHeld reports a message held for approval on the operations feed.
+const adminHeld = "held"
+
+const (
+	// maxHeldPerSender and maxHeldPerRoom cap the messages awaiting
+	// approval, so a sender or room cannot fill the server with them.
+	maxHeldPerSender = 20
+	maxHeldPerRoom   = 500
+)
+
+var (
+	errTooManyHeld     = clientErrorf(codeQuota, "at most %d of your messages can await approval at once", maxHeldPerSender)
+	errRoomTooManyHeld = clientErrorf(codeQuota, "too many messages await approval in this room, try again later")
+)
+
+// heldMessage is a message awaiting approval, as listed by
+// GET /rooms/{room}/held.
+type heldMessage struct {
+	ID      string    `json:"id"`
+	Message *Message  `json:"message"`
+	Held    time.Time `json:"held"`
+	Expires time.Time `json:"expires"`
+	// At is when the message was scheduled for, if it was, and owner who
+	// scheduled it.
+	At    *time.Time `json:"at,omitempty"`
+	owner string
+	// sender is who sent it, for maxHeldPerSender: the reader, or the
+	// address of clients without a name.
+	sender string
+}
+
+// moderatedRoom reports whether what clients send to room is held.
+func moderatedRoom(room string) bool {
+	if *moderatedRooms == "" {
+		return false
+	}
+	for _, r := range strings.Split(*moderatedRooms, ",") {
+		if strings.TrimSpace(r) == room {
+			return true
+		}
+	}
+	return false
+}
+
+// held reports whether msg from c must wait for approval.
+func held(c *Client, msg *Message) bool {
+	if c.role == moderatorRole || c.role == adminRole {
+		return false
+	}
+	return msg.Type != typeReaction && moderatedRoom(msg.Room)
+}
+
+// hold keeps msg, to be broadcast at at, or now when zero, until a
+// moderator approves it or -moderation-timeout passes. It fails when the
+// sender or the room has too many messages held already.
+func (h *Hub) hold(c *Client, msg *Message, at time.Time) error {
+	now := time.Now()
+	hm := &heldMessage{ID: newMessageID(), Message: msg, Held: now, Expires: now.Add(*moderationTimeout), sender: c.reader()}
+	if hm.sender == "" {
+		hm.sender = "addr:" + c.addr
+	}
+	if !at.IsZero() {
+		hm.At, hm.owner = &at, c.reader()
+	}
+
+	h.mu.Lock()
+	h.expireHeld(now)
+	var fromSender, inRoom int
+	for _, other := range h.held {
+		if now.After(other.Expires) {
+			continue
+		}
+		if other.sender == hm.sender {
+			fromSender++
+		}
+		if other.Message.Room == msg.Room {
+			inRoom++
+		}
+	}
+	switch {
+	case fromSender >= maxHeldPerSender:
+		h.mu.Unlock()
+		return errTooManyHeld
+	case inRoom >= maxHeldPerRoom:
+		h.mu.Unlock()
+		return errRoomTooManyHeld
+	}
+	h.held[hm.ID] = hm
+	h.mu.Unlock()
+
+	log.Printf("Holding message %s from %s in room %s", hm.ID, c.nick, msg.Room)
+	b, _ := json.Marshal(hm)
+	emitAdminEvent(adminEvent{Type: adminHeld, Client: c.nick, Addr: c.addr, Detail: string(b)})
+	c.send(&Message{Type: typeHeld, Author: "Server", Room: msg.Room, Ref: hm.ID})
+	return nil
+}
+
+// expireHeld drops the held messages that waited past -moderation-timeout,
+// at most once a minute. It is called with the hub lock held.
+func (h *Hub) expireHeld(now time.Time) {
+	if !h.heldSweep.due(now, time.Minute) {
+		return
+	}
+	for id, hm := range h.held {
+		if now.After(hm.Expires) {
+			delete(h.held, id)
+			log.Printf("Held message %s in room %s expired", id, hm.Message.Room)
+		}
+	}
+}
+
+// heldIn returns the messages awaiting approval in room, oldest first.
+func (h *Hub) heldIn(room string) []*heldMessage {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.expireHeld(now)
+	list := []*heldMessage{}
+	for _, hm := range h.held {
+		if hm.Message.Room == room && !now.After(hm.Expires) {
+			list = append(list, hm)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Held.Before(list[j].Held) })
+	return list
+}
+
+// takeHeld removes and returns the message held in room as id, if any and
+// not expired.
+func (h *Hub) takeHeld(room, id string) *heldMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hm := h.held[id]
+	if hm == nil || hm.Message.Room != room {
+		return nil
+	}
+	delete(h.held, id)
+	if time.Now().After(hm.Expires) {
+		return nil
+	}
+	return hm
+}
+
+// rehold puts back a held message whose approval could not go through.
+func (h *Hub) rehold(hm *heldMessage) {
+	h.mu.Lock()
+	h.held[hm.ID] = hm
+	h.mu.Unlock()
+}
+
+// approve broadcasts the held message, or schedules it if it was for
+// later.
+func (h *Hub) approve(hm *heldMessage) (delivery, error) {
+	msg := hm.Message
+	if hm.At != nil && hm.At.After(time.Now()) {
+		id, err := h.scheduleMessage(msg, *hm.At, hm.owner)
+		return delivery{ID: id}, err
+	}
+	msg.received = time.Time{}
+	d := h.broadcast(msg)
+	if !d.OverQuota && !d.Shed {
+		h.unfurl(msg)
+	}
+	return d, nil
+}
+
+// heldHandler serves /rooms/{room}/held to moderators: GET lists the
+// messages awaiting approval, POST /rooms/{room}/held/{id} approves one
+// and DELETE /rooms/{room}/held/{id} rejects it.
+func heldHandler(w http.ResponseWriter, r *http.Request, room, id string) {
+	if !isModerator(r) {
+		httpError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	h := hubFor(r)
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.heldIn(room))
+
+	case r.Method == http.MethodPost && id != "":
+		hm := h.takeHeld(room, id)
+		if hm == nil {
+			httpError(w, r, "Not found", http.StatusNotFound)
+			return
+		}
+		d, err := h.approve(hm)
+		switch {
+		case err != nil:
+			log.Println("Cannot schedule approved message:", err)
+			httpError(w, r, "Cannot schedule message", http.StatusInternalServerError)
+			return
+		case d.OverQuota:
+			h.rehold(hm)
+			httpError(w, r, "Tenant over its quota", http.StatusTooManyRequests)
+			return
+		case d.Shed:
+			h.rehold(hm)
+			httpError(w, r, "Server too busy", http.StatusServiceUnavailable)
+			return
+		}
+		auditAction(requestActor(r), "approve", room, id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
+
+	case r.Method == http.MethodDelete && id != "":
+		if h.takeHeld(room, id) == nil {
+			httpError(w, r, "Not found", http.StatusNotFound)
+			return
+		}
+		auditAction(requestActor(r), "reject", room, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const maxNickLength = 32
+
+var (
+	errNickTaken    = errors.New("nickname is already taken")
+	errNickReserved = errors.New("nickname is reserved by another user")
+	errNickInvalid  = errors.New("invalid nickname")
+)
+
+// nickReservations remembers which user owns a nickname, so it stays theirs
+// across connections. Reservations are only kept when a Redis store is
+// configured with -session-redis.
+type nickReservations interface {
+	// reserve gives nick to owner unless another owner has it.
+	reserve(ctx context.Context, nick, owner string) (bool, error)
+	// reserved reports whether anyone owns nick.
+	reserved(ctx context.Context, nick string) (bool, error)
+	// release frees all nicknames of owner and returns them, in lower
+	// case.
+	release(ctx context.Context, owner string) ([]string, error)
+}
+
+type redisNicks struct {
+	rdb *redis.Client
+}
+
+func (r redisNicks) reserve(ctx context.Context, nick, owner string) (bool, error) {
+	key := strings.ToLower(nick)
+	if _, err := r.rdb.HSetNX(ctx, "nicknames", key, owner).Result(); err != nil {
+		return false, err
+	}
+	current, err := r.rdb.HGet(ctx, "nicknames", key).Result()
+	if err != nil {
+		return false, err
+	}
+	return current == owner, nil
+}
+
+func (r redisNicks) reserved(ctx context.Context, nick string) (bool, error) {
+	return r.rdb.HExists(ctx, "nicknames", strings.ToLower(nick)).Result()
+}
+
+func (r redisNicks) release(ctx context.Context, owner string) ([]string, error) {
+	all, err := r.rdb.HGetAll(ctx, "nicknames").Result()
+	if err != nil {
+		return nil, err
+	}
+	var released []string
+	for nick, o := range all {
+		if o == owner {
+			if err := r.rdb.HDel(ctx, "nicknames", nick).Err(); err != nil {
+				return released, err
+			}
+			released = append(released, nick)
+		}
+	}
+	return released, nil
+}
+
+var (
+	nicksOnce sync.Once
+	nicks     nickReservations
+)
+
+func nickBackend() nickReservations {
+	nicksOnce.Do(func() {
+		if c := redisClient(); c != nil {
+			nicks = redisNicks{c}
+		}
+	})
+	return nicks
+}
+
+// serverAuthor reports whether name is one the server puts on messages
+// that are nobody's in particular: its own, and those of clients without
+// a nickname. No one can go by them.
+func serverAuthor(name string) bool {
+	return strings.EqualFold(name, "Server") || strings.EqualFold(name, "Anonymous")
+}
+
+// register gives client the nickname it asked for, or its authenticated
+// name, and adds it to the hub. Anonymous clients cannot take nicknames
+// reserved by logged in users, but do not reserve any themselves.
+func register(ctx context.Context, client *Client, nick string) error {
+	nick = strings.TrimSpace(nick)
+	if nick == "" {
+		nick = client.name
+	}
+	if nick != "" {
+		if utf8.RuneCountInString(nick) > maxNickLength || serverAuthor(nick) {
+			return errNickInvalid
+		}
+		if store := nickBackend(); store != nil {
+			var ok bool
+			var err error
+			if client.identity != "" {
+				ok, err = store.reserve(ctx, nick, client.identity)
+			} else {
+				var taken bool
+				taken, err = store.reserved(ctx, nick)
+				ok = !taken
+			}
+			if err != nil {
+				log.Println("Cannot check nickname reservation:", err)
+			} else if !ok {
+				return errNickReserved
+			}
+		}
+		client.nick = nick
+	}
+	if banned(client) {
+		return errBanned
+	}
+	if err := scriptConnect(client); err != nil {
+		return err
+	}
+	if err := extensionsConnect(client); err != nil {
+		return err
+	}
+	if p := client.profile(); p != nil {
+		client.status = p.Status
+	}
+	if err := client.hub.addClientAndGreet(client); err != nil {
+		return err
+	}
+	clientEvent(adminConnect, client, "")
+	if client.identity != "" {
+		clearDigest(client.identity)
+	}
+	return nil
+}
+
+// refuse tells a client why it cannot join. Nothing else writes to the
+// connection before the client listens, so the message is sent directly.
+func refuse(client *Client, err error) {
+	clientEvent(adminError, client, err.Error())
+	client.connection.Send(errorMessage(client, err))
+}
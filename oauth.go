@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+const (
+	oauthStateCookie = "oauth_state"
+	googleIssuer     = "https://accounts.google.com"
+)
+
+var (
+	oauthProvider     = flag.String("oauth-provider", "", "log users in with google, github or oidc; disabled when empty")
+	oauthIssuer       = flag.String("oauth-issuer", "", "issuer URL of the oidc provider")
+	oauthClientID     = flag.String("oauth-client-id", "", "OAuth2 client ID")
+	oauthClientSecret = flag.String("oauth-client-secret", "", "OAuth2 client secret")
+	oauthRedirectURL  = flag.String("oauth-redirect-url", "", "public URL of /callback, as registered with the provider")
+	oauthTenantClaim  = flag.String("oauth-tenant-claim", "", "ID token claim naming the tenant of oidc and google users; they belong to the tenant they logged in through when empty or missing")
+	requireLogin      = flag.Bool("require-login", false, "reject websocket clients that have not logged in")
+)
+
+// oauthLogin is a configured identity provider. identify turns the token
+// from a successful code exchange into the user's identity, see
+// loginIdentity, their name and, when the provider says, tenant.
+type oauthLogin struct {
+	config   oauth2.Config
+	identify func(ctx context.Context, token *oauth2.Token) (identity, name, tenant string, err error)
+}
+
+// loginIdentity names a user by the issuer and subject of their login,
+// which together are unique and never given to anyone else, unlike names
+// and email addresses. Both are escaped so the identity has no slashes and
+// fits in /users/{id}.
+func loginIdentity(issuer, subject string) string {
+	return url.PathEscape(issuer) + "|" + url.PathEscape(subject)
+}
+
+var (
+	loginOnce sync.Once
+	login     *oauthLogin
+)
+
+// oauth returns the provider set up by the -oauth-* flags, or nil when
+// logging in is disabled.
+func oauth() *oauthLogin {
+	loginOnce.Do(func() {
+		if *oauthProvider == "" {
+			return
+		}
+		l, err := newOAuthLogin(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		login = l
+	})
+	return login
+}
+
+func newOAuthLogin(ctx context.Context) (*oauthLogin, error) {
+	l := &oauthLogin{config: oauth2.Config{
+		ClientID:     *oauthClientID,
+		ClientSecret: *oauthClientSecret,
+		RedirectURL:  *oauthRedirectURL,
+	}}
+
+	switch *oauthProvider {
+	case "github":
+		l.config.Endpoint = github.Endpoint
+		l.config.Scopes = []string{"read:user"}
+		l.identify = githubIdentity(&l.config)
+		return l, nil
+	case "google":
+		return l, l.setupOIDC(ctx, googleIssuer)
+	case "oidc":
+		return l, l.setupOIDC(ctx, *oauthIssuer)
+	}
+	return nil, fmt.Errorf("unknown -oauth-provider %q, expected google, github or oidc", *oauthProvider)
+}
+
+func (l *oauthLogin) setupOIDC(ctx context.Context, issuer string) error {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return err
+	}
+	verifier := provider.Verifier(&oidc.Config{ClientID: l.config.ClientID})
+
+	l.config.Endpoint = provider.Endpoint()
+	l.config.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	l.identify = func(ctx context.Context, token *oauth2.Token) (string, string, string, error) {
+		raw, ok := token.Extra("id_token").(string)
+		if !ok {
+			return "", "", "", errors.New("no id_token in token response")
+		}
+		idToken, err := verifier.Verify(ctx, raw)
+		if err != nil {
+			return "", "", "", err
+		}
+
+		var claims struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		}
+		if err := idToken.Claims(&claims); err != nil {
+			return "", "", "", err
+		}
+		var tenant string
+		if *oauthTenantClaim != "" {
+			var all map[string]any
+			if err := idToken.Claims(&all); err != nil {
+				return "", "", "", err
+			}
+			tenant, _ = all[*oauthTenantClaim].(string)
+		}
+		identity := loginIdentity(idToken.Issuer, idToken.Subject)
+		switch {
+		case claims.Name != "":
+			return identity, claims.Name, tenant, nil
+		case claims.Email != "":
+			return identity, claims.Email, tenant, nil
+		}
+		return identity, idToken.Subject, tenant, nil
+	}
+	return nil
+}
+
+// githubIdentity identifies users by their GitHub user ID, which unlike
+// their login is never reused, and names them by their login. GitHub does
+// not speak OpenID Connect.
+func githubIdentity(config *oauth2.Config) func(context.Context, *oauth2.Token) (string, string, string, error) {
+	return func(ctx context.Context, token *oauth2.Token) (string, string, string, error) {
+		resp, err := config.Client(ctx, token).Get("https://api.github.com/user")
+		if err != nil {
+			return "", "", "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", "", "", errors.New("GitHub user lookup failed: " + resp.Status)
+		}
+
+		var user struct {
+			Login string `json:"login"`
+			ID    int64  `json:"id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+			return "", "", "", err
+		}
+		if user.ID == 0 {
+			return "", "", "", errors.New("GitHub user lookup returned no ID")
+		}
+		id := strconv.FormatInt(user.ID, 10)
+		if user.Login == "" {
+			return loginIdentity("https://github.com", id), id, "", nil
+		}
+		return loginIdentity("https://github.com", id), user.Login, "", nil
+	}
+}
+
+// loginHandler sends the browser to the provider, remembering a random
+// state to tie the callback to this browser.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	l := oauth()
+	if l == nil {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+
+	state := randomToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/callback",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, l.config.AuthCodeURL(state), http.StatusFound)
+}
+
+// callbackHandler finishes the login and starts a session for the user.
+func callbackHandler(w http.ResponseWriter, r *http.Request) {
+	l := oauth()
+	if l == nil {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+
+	state, err := r.Cookie(oauthStateCookie)
+	if err != nil || state.Value == "" || state.Value != r.URL.Query().Get("state") {
+		httpError(w, r, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/callback", MaxAge: -1})
+
+	token, err := l.config.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		httpError(w, r, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	identity, name, tenant, err := l.identify(r.Context(), token)
+	if err != nil {
+		log.Println("Login failed:", err)
+		httpError(w, r, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	if tenant == "" {
+		tenant = requestTenant(r)
+	} else if !knownTenant(tenant) {
+		log.Printf("Login of %s failed: unknown tenant %q", name, tenant)
+		httpError(w, r, "Login failed", http.StatusForbidden)
+		return
+	}
+
+	if err := startSession(w, r, identity, name, defaultRole, tenant); err != nil {
+		log.Println("Cannot start session:", err)
+		httpError(w, r, "Login failed", http.StatusInternalServerError)
+		return
+	}
+	log.Println("Logged in", name)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Observers, such as dashboards, projectors and audit taps, receive the
+// broadcasts of the rooms they watch but cannot send anything. Clients
+// connect as observers with ?observe=1, users with observerRole always do.
+
+var errObserver = &clientError{codeUnauthorized, "observers cannot send messages"}
+
+// observing reports whether the client connecting through r with role
+// observes.
+func observing(r *http.Request, role string) bool {
+	if role == observerRole {
+		return true
+	}
+	observe, _ := strconv.ParseBool(r.URL.Query().Get("observe"))
+	return observe
+}
+
+// observerAllowed reports whether an observer may send msg: only what keeps
+// the connection and its deliveries going.
+func observerAllowed(msg *Message) bool {
+	switch msg.Type {
+	case typePing, typePong, typeAck:
+		return true
+	}
+	return false
+}
+
+// watch puts the observer c in the rooms given as room query parameters
+// of r, since it cannot join them itself.
+func (h *Hub) watch(c *Client, r *http.Request) {
+	for _, name := range r.URL.Query()["room"] {
+		if err := h.join(c, name); err != nil {
+			log.Printf("Observer cannot watch room %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"runtime/metrics"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	overloadQueued     = flag.Int("overload-queued", 0, "messages waiting in the queues of all clients above which the server is overloaded: it refuses new websocket clients and broadcasts with 503 and tells its clients it is busy; 0 for no limit")
+	overloadCPU        = flag.Float64("overload-cpu", 0, "share of the CPUs available to the server, between 0 and 1, above which it is overloaded, see -overload-queued; 0 for no limit")
+	overloadRetryAfter = flag.Duration("overload-retry-after", 10*time.Second, "how long callers turned away by an overloaded server are told to wait")
+)
+
+// typeServerBusy tells clients the server is overloaded, with a hint in
+// ReconnectAfter of how long to hold back what they can.
+const typeServerBusy = "server_busy"
+
+// overloaded is set while the server sheds load, see watchLoad.
+var overloaded atomic.Bool
+
+// overloadRecovery is the share of the thresholds load must fall under for
+// the server to take new work again, so it does not flap.
+const overloadRecovery = 0.8
+
+// refuseWhileOverloaded answers 503 Service Unavailable, with Retry-After,
+// instead of taking more work while the server is overloaded.
+func refuseWhileOverloaded(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if overloaded.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(overloadRetryAfter.Seconds())))
+			httpError(w, r, "Server is too busy", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// queuedMessages counts the messages waiting to be written to clients.
+func queuedMessages() int {
+	n := 0
+	for _, h := range allHubs() {
+		var queued atomic.Int64
+		h.clients.each(func(c *Client) {
+			queued.Add(int64(c.queue.len()))
+		})
+		n += int(queued.Load())
+	}
+	return n
+}
+
+// cpuSampler measures the share of the available CPU time the process used
+// between samples.
+type cpuSampler struct {
+	samples    []metrics.Sample
+	busy, wall float64
+	// usage is the last measured, see sample.
+	usage float64
+}
+
+func newCPUSampler() *cpuSampler {
+	s := &cpuSampler{samples: []metrics.Sample{{Name: "/cpu/classes/total:cpu-seconds"}, {Name: "/cpu/classes/idle:cpu-seconds"}}}
+	s.sample()
+	return s
+}
+
+// sample returns the CPU usage since the last sample, between 0 and 1.
+func (s *cpuSampler) sample() float64 {
+	metrics.Read(s.samples)
+	// Both are estimates across all of GOMAXPROCS, only updated by the
+	// GC: until the next cycle, the last usage measured still holds.
+	total, idle := s.samples[0].Value.Float64(), s.samples[1].Value.Float64()
+	busy, wall := total-idle, total
+	if wall > s.wall {
+		s.usage = (busy - s.busy) / (wall - s.wall)
+		s.busy, s.wall = busy, wall
+	}
+	return s.usage
+}
+
+// watchLoad checks the load every second, and sheds it while it is over
+// -overload-queued or -overload-cpu.
+func watchLoad() {
+	if *overloadQueued <= 0 && *overloadCPU <= 0 {
+		return
+	}
+	cpu := newCPUSampler()
+	go func() {
+		for range time.Tick(time.Second) {
+			queued, usage := queuedMessages(), 0.0
+			if *overloadCPU > 0 {
+				usage = cpu.sample()
+			}
+			over := (*overloadQueued > 0 && queued > *overloadQueued) || (*overloadCPU > 0 && usage > *overloadCPU)
+			under := (*overloadQueued <= 0 || float64(queued) < overloadRecovery*float64(*overloadQueued)) &&
+				(*overloadCPU <= 0 || usage < overloadRecovery**overloadCPU)
+			switch {
+			case over && !overloaded.Load():
+				overloaded.Store(true)
+				log.Printf("Overloaded with %d queued messages and %.0f%% CPU, shedding load", queued, usage*100)
+				notifyBusy()
+			case under && overloaded.Load():
+				overloaded.Store(false)
+				log.Println("No longer overloaded")
+			}
+		}
+	}()
+}
+
+// notifyBusy tells every client the server is overloaded.
+func notifyBusy() {
+	for _, h := range allHubs() {
+		h.notifyAllLocalized(msgServerBusy, "Server is too busy, please slow down", func(body string) *Message {
+			return &Message{
+				Type:           typeServerBusy,
+				Author:         "Server",
+				Body:           body,
+				ReconnectAfter: int(overloadRetryAfter.Seconds()),
+			}
+		})
+	}
+}
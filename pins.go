@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const maxPins = 20
+
+// pin adds msg to the pinned messages of its room.
+func (h *Hub) pin(msg *Message) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := h.room(msg.Room)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.pins) >= maxPins {
+		return false
+	}
+	r.pins = append(r.pins, msg)
+	return true
+}
+
+// unpin removes the pinned message with id from room.
+func (h *Hub) unpin(name, id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := h.rooms[name]
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	found := false
+	for i, msg := range r.pins {
+		if msg.ID == id {
+			r.pins = append(r.pins[:i:i], r.pins[i+1:]...)
+			found = true
+			break
+		}
+	}
+	r.mu.Unlock()
+	h.reclaim(r)
+	return found
+}
+
+func (h *Hub) pinned(name string) []*Message {
+	r := h.existingRoom(name)
+	if r == nil {
+		return []*Message{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*Message{}, r.pins...)
+}
+
+// sendPins queues the pinned messages of the room for client. It is called
+// with r.mu held.
+func (r *room) sendPins(client *Client) {
+	for _, msg := range r.pins {
+		client.queue.push(msg)
+	}
+}
+
+// isModerator reports whether r comes from someone allowed to manage pins:
+// a moderator or admin session, or a -basic-auth-file user.
+func isModerator(r *http.Request) bool {
+	role := sessionRole(r)
+	return role == moderatorRole || role == adminRole || basicAuthUser(r) != ""
+}
+
+// canReadRoom reports whether r comes from someone allowed to read what is
+// kept about room: a moderator, or a logged in user with a client in it.
+func canReadRoom(r *http.Request, room string) bool {
+	if isModerator(r) {
+		return true
+	}
+	identity := requestIdentity(r)
+	return identity != "" && hubFor(r).hasMember(identity, room)
+}
+
+// hasMember reports whether a client of identity is in room.
+func (h *Hub) hasMember(identity, room string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	found := false
+	h.clients.each(func(c *Client) {
+		if c.identity == identity && c.inRoom(room) {
+			found = true
+		}
+	})
+	return found
+}
+
+// pinsHandler serves /rooms/{room}/pins: GET lists the pinned messages,
+// POST pins the JSON encoded {author, body} message or, with ref, the
+// remembered message of that ID, and DELETE /rooms/{room}/pins/{id}
+// unpins one. Pins are listed to members of the room and moderators only.
+func pinsHandler(w http.ResponseWriter, r *http.Request, room, id string) {
+	h := hubFor(r)
+	if r.Method == http.MethodGet && id == "" {
+		if !canReadRoom(r, room) {
+			httpError(w, r, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.pinned(room))
+		return
+	}
+	if !isModerator(r) {
+		httpError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		var in struct {
+			Author string `json:"author"`
+			Body   string `json:"body"`
+			Ref    string `json:"ref"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&in); err != nil {
+			httpError(w, r, "Invalid pin", decodeStatus(err))
+			return
+		}
+
+		var msg *Message
+		if in.Ref != "" {
+			msg = h.remembered(room, in.Ref)
+			if msg == nil {
+				httpError(w, r, "No such message in room", http.StatusNotFound)
+				return
+			}
+		} else if in.Body != "" {
+			if in.Author == "" {
+				in.Author = "Server"
+			}
+			msg = &Message{Author: in.Author, Body: in.Body, Room: room, ID: newMessageID(), RequestID: requestID(r)}
+			sanitize(msg)
+			sign(msg)
+		} else {
+			httpError(w, r, "Invalid pin", http.StatusBadRequest)
+			return
+		}
+		if !h.pin(msg) {
+			httpError(w, r, "Too many pinned messages", http.StatusConflict)
+			return
+		}
+		log.Printf("Pinned %s in room %s", msg.ID, room)
+		auditAction(requestActor(r), "pin", room, msg.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(msg)
+
+	case r.Method == http.MethodDelete && id != "":
+		if !h.unpin(room, id) {
+			httpError(w, r, "Not found", http.StatusNotFound)
+			return
+		}
+		auditAction(requestActor(r), "unpin", room, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// roomsHandler dispatches the /rooms/{room}/... endpoints. Rooms may be
+// topics spanning several path segments.
+func roomsHandler() http.Handler {
+	broadcast := protectBroadcast(roomBroadcastHandler)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/rooms/")
+		if strings.HasSuffix(path, "/broadcast") {
+			broadcast.ServeHTTP(w, r)
+			return
+		}
+
+		if room, ok := strings.CutSuffix(path, "/node"); ok {
+			if room == "" || hasWildcard(room) {
+				httpError(w, r, "Not found", http.StatusNotFound)
+				return
+			}
+			roomNodeHandler(w, r, room)
+			return
+		}
+
+		if strings.HasSuffix(path, "/receipts") {
+			room := strings.TrimSuffix(path, "/receipts")
+			if room == "" || hasWildcard(room) {
+				httpError(w, r, "Not found", http.StatusNotFound)
+				return
+			}
+			receiptsHandler(w, r, room)
+			return
+		}
+
+		if i := strings.LastIndex(path, "/held/"); i >= 0 || strings.HasSuffix(path, "/held") {
+			room, id := strings.TrimSuffix(path, "/held"), ""
+			if !strings.HasSuffix(path, "/held") {
+				room, id = path[:i], path[i+len("/held/"):]
+			}
+			if room == "" || hasWildcard(room) || strings.Contains(id, "/") {
+				httpError(w, r, "Not found", http.StatusNotFound)
+				return
+			}
+			csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				heldHandler(w, r, room, id)
+			})).ServeHTTP(w, r)
+			return
+		}
+
+		room, id := path, ""
+		if i := strings.LastIndex(path, "/pins/"); i >= 0 {
+			room, id = path[:i], path[i+len("/pins/"):]
+		} else if strings.HasSuffix(path, "/pins") {
+			room = strings.TrimSuffix(path, "/pins")
+		} else {
+			httpError(w, r, "Not found", http.StatusNotFound)
+			return
+		}
+		if room == "" || hasWildcard(room) || strings.Contains(id, "/") {
+			httpError(w, r, "Not found", http.StatusNotFound)
+			return
+		}
+		csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pinsHandler(w, r, room, id)
+		})).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"plugin"
+	"strings"
+)
+
+var pluginFiles = flag.String("plugins", "", "comma separated Go plugin .so files of extensions, built with go build -buildmode=plugin against the same Go and dependency versions; each may export OnConnect func(map[string]string) error and OnMessage func(map[string]string) error")
+
+// extension hooks into what clients do, after the rules and script. Either
+// hook may be nil; an error refuses the client or rejects the message.
+//
+// Builds without plugin support, such as static ones, add extensions with
+// registerExtension from the init function of a file of their own.
+type extension struct {
+	name      string
+	onConnect func(c *Client) error
+	onMessage func(c *Client, msg *Message) error
+}
+
+var extensions []*extension
+
+func registerExtension(e *extension) {
+	extensions = append(extensions, e)
+}
+
+// loadPlugins registers the extensions of -plugins. Plugins cannot see the
+// types of the server, so their hooks get the client and message as
+// fields: nick, identity, role, addr and tenant for clients, and type,
+// author, body and room for messages, which OnMessage may change.
+func loadPlugins() {
+	if *pluginFiles == "" {
+		return
+	}
+	for _, path := range strings.Split(*pluginFiles, ",") {
+		path = strings.TrimSpace(path)
+		e, err := openPlugin(path)
+		if err != nil {
+			log.Fatalf("invalid plugin %s: %v", path, err)
+		}
+		registerExtension(e)
+		log.Println("Loaded plugin", e.name)
+	}
+}
+
+func openPlugin(path string) (*extension, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	e := &extension{name: strings.TrimSuffix(filepath.Base(path), ".so")}
+	if sym, err := p.Lookup("OnConnect"); err == nil {
+		hook, ok := sym.(func(map[string]string) error)
+		if !ok {
+			return nil, fmt.Errorf("OnConnect is a %T, not a func(map[string]string) error", sym)
+		}
+		e.onConnect = func(c *Client) error {
+			return hook(map[string]string{"nick": c.nick, "identity": c.identity, "role": c.role, "addr": c.addr, "tenant": c.hub.tenant})
+		}
+	}
+	if sym, err := p.Lookup("OnMessage"); err == nil {
+		hook, ok := sym.(func(map[string]string) error)
+		if !ok {
+			return nil, fmt.Errorf("OnMessage is a %T, not a func(map[string]string) error", sym)
+		}
+		e.onMessage = func(c *Client, msg *Message) error {
+			fields := map[string]string{"type": msg.Type, "author": msg.Author, "body": msg.Body, "room": msg.Room}
+			if err := hook(fields); err != nil {
+				return err
+			}
+			if room := fields["room"]; room != msg.Room && (!validPattern(room) || hasWildcard(room)) {
+				return &validationError{"plugin sent the message to an invalid room"}
+			}
+			msg.Body, msg.Room = fields["body"], fields["room"]
+			return nil
+		}
+	}
+	if e.onConnect == nil && e.onMessage == nil {
+		return nil, errors.New("exports neither OnConnect nor OnMessage")
+	}
+	return e, nil
+}
+
+// extensionError turns what a hook of e returned into what the client is
+// told.
+func extensionError(e *extension, err error) error {
+	if _, ok := err.(*clientError); ok {
+		return err
+	}
+	if _, ok := err.(*validationError); ok {
+		return err
+	}
+	debugf("Extension %s rejected: %v", e.name, err)
+	return &clientError{codeFiltered, err.Error()}
+}
+
+// extensionsConnect runs the connect hooks for c.
+func extensionsConnect(c *Client) error {
+	for _, e := range extensions {
+		if e.onConnect == nil {
+			continue
+		}
+		if err := e.onConnect(c); err != nil {
+			return extensionError(e, err)
+		}
+	}
+	return nil
+}
+
+// extensionsMessage runs the message hooks for msg from c.
+func extensionsMessage(c *Client, msg *Message) error {
+	for _, e := range extensions {
+		if e.onMessage == nil {
+			continue
+		}
+		if err := e.onMessage(c, msg); err != nil {
+			return extensionError(e, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// typePresence asks for who is in Room, and answers with them in
+	// Presence. Clients get one for every room they join.
+	typePresence = "presence"
+	// typePresenceDiff tells the members of Room that the one member in
+	// Presence joined, left or changed status. Each diff raises the
+	// PresenceVersion of the room by one; a client that misses one asks
+	// for a presence message again.
+	typePresenceDiff = "presence_diff"
+)
+
+// Changes of presence diffs.
+const (
+	presenceJoin   = "join"
+	presenceLeave  = "leave"
+	presenceStatus = "status"
+)
+
+// lastSeenInterval is how often the activity of a busy user is saved.
+const lastSeenInterval = time.Minute
+
+// presence describes a member of a room.
+type presence struct {
+	Nick     string `json:"nick"`
+	Identity string `json:"identity,omitempty"`
+	// Status is the one set in the member's profile.
+	Status string `json:"status,omitempty"`
+	// Meta is what the member declared about itself, see clientMeta.
+	Meta map[string][]string `json:"meta,omitempty"`
+	// LastSeen is when the member last sent anything.
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// active records that c just sent something. The time is saved for
+// identified users, at most once per lastSeenInterval.
+func (c *Client) active() {
+	now := time.Now()
+	c.lastActive.Store(now.UnixNano())
+	if c.identity == "" {
+		return
+	}
+	saved := c.lastSaved.Load()
+	if now.UnixNano()-saved < int64(lastSeenInterval) || !c.lastSaved.CompareAndSwap(saved, now.UnixNano()) {
+		return
+	}
+	saveLastSeen(c, now)
+}
+
+// lastSeen returns when c last sent anything, or connected.
+func (c *Client) lastSeen() time.Time {
+	return time.Unix(0, c.lastActive.Load()).UTC()
+}
+
+// saveLastSeen stores when c was last active.
+func saveLastSeen(c *Client, at time.Time) {
+	if err := dataStore().SaveLastSeen(context.Background(), c.identity, at); err != nil {
+		log.Println("Cannot save last seen time:", err)
+	}
+}
+
+// presenceOf returns c as shown in presence messages.
+func presenceOf(c *Client) presence {
+	c.mu.Lock()
+	status := c.status
+	c.mu.Unlock()
+	return presence{Nick: c.nick, Identity: c.identity, Status: status, Meta: c.meta, LastSeen: c.lastSeen()}
+}
+
+// presence returns the members of the room, by nickname, and their
+// version. Clients in the room through a pattern, and observers, are not
+// listed. It is called with r.mu held.
+func (r *room) presence() ([]presence, uint64) {
+	list := make([]presence, 0, len(r.members))
+	for c := range r.members {
+		if c.observer {
+			continue
+		}
+		list = append(list, presenceOf(c))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Nick < list[j].Nick })
+	return list, r.presenceVersion
+}
+
+func (r *room) presenceMessage() *Message {
+	list, version := r.presence()
+	return &Message{Type: typePresence, Author: "Server", Room: r.name, Presence: list, PresenceVersion: version}
+}
+
+// sendPresence queues the members of the room for client, which just
+// joined. It is called with r.mu held.
+func (r *room) sendPresence(client *Client) {
+	// Everyone is in the lobby; its members are only sent on request.
+	if r.name == "" {
+		return
+	}
+	client.queue.push(r.presenceMessage())
+}
+
+// notifyPresence tells the other members of the room that c joined, left
+// or changed status, so they need not be sent all members again. It is
+// called with r.mu held.
+func (r *room) notifyPresence(change string, c *Client) {
+	if c.observer {
+		return
+	}
+	r.presenceVersion++
+	if r.name == "" {
+		return
+	}
+	diff := &Message{Type: typePresenceDiff, Author: "Server", Room: r.name, Change: change, PresenceVersion: r.presenceVersion, Presence: []presence{presenceOf(c)}}
+	for m := range r.members {
+		if m == c {
+			continue
+		}
+		m.queue.push(diff)
+	}
+}
+
+// presence returns what a presence request for room is answered with.
+func (h *Hub) presence(name string) *Message {
+	r := h.existingRoom(name)
+	if r == nil {
+		return &Message{Type: typePresence, Author: "Server", Room: name, Presence: []presence{}}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.presenceMessage()
+}
+
+// setStatus changes the status shown for the clients of identity, and
+// tells the rooms they are in.
+func (h *Hub) setStatus(identity, status string) {
+	var clients []*Client
+	h.clients.each(func(c *Client) {
+		if c.identity == identity {
+			clients = append(clients, c)
+		}
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, c := range clients {
+		c.mu.Lock()
+		changed := c.status != status
+		c.status = status
+		c.mu.Unlock()
+		if !changed {
+			continue
+		}
+		for name := range c.rooms {
+			if r := h.rooms[name]; r != nil {
+				r.mu.Lock()
+				if r.members[c] {
+					r.notifyPresence(presenceStatus, c)
+				}
+				r.mu.Unlock()
+			}
+		}
+	}
+}
+
+// sendPresence answers a presence request of c.
+func sendPresence(c *Client, req *Message) {
+	if req.Room != "" && !c.joined(req.Room) {
+		sendError(c, &validationError{"not in room " + req.Room})
+		return
+	}
+	c.send(c.hub.presence(req.Room))
+}
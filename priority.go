@@ -0,0 +1,61 @@
+package main
+
+// Message priorities. Urgent messages skip the fan-out limit, bulk ones
+// are the first dropped when the server or a client falls behind. An
+// empty priority is normal.
+const (
+	priorityUrgent = "urgent"
+	prioritySystem = "system"
+	priorityNormal = "normal"
+	priorityBulk   = "bulk"
+)
+
+var errInvalidPriority = &validationError{"priority must be urgent, system, normal or bulk"}
+
+// parsePriority validates a priority given to the broadcast API, and
+// returns it with normal as "".
+func parsePriority(p string) (string, error) {
+	switch p {
+	case "", priorityNormal:
+		return "", nil
+	case priorityUrgent, prioritySystem, priorityBulk:
+		return p, nil
+	}
+	return "", errInvalidPriority
+}
+
+// checkPriority validates the priority of msg from a client, which may
+// only be normal or bulk.
+func checkPriority(msg *Message) error {
+	p, err := parsePriority(msg.Priority)
+	if err != nil {
+		return err
+	}
+	if p == priorityUrgent || p == prioritySystem {
+		return &validationError{"only the server sends " + p + " messages"}
+	}
+	msg.Priority = p
+	return nil
+}
+
+// bulkBacklog is how full a client's queue may be before bulk messages
+// are no longer queued for it, leaving the rest to others.
+func bulkBacklog(c *Client) bool {
+	return c.queue.len() >= c.queue.limit/2
+}
+
+// batchPriority is the priority the fan-out limit treats a batch with:
+// urgent if any of its messages is, bulk if all are.
+func batchPriority(msgs []*Message) string {
+	bulk := true
+	for _, msg := range msgs {
+		if msg.Priority == priorityUrgent {
+			return priorityUrgent
+		}
+		bulk = bulk && msg.Priority == priorityBulk
+	}
+	if bulk {
+		return priorityBulk
+	}
+	return ""
+}
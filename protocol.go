@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mycodesmells/golang-websockets/chatpb"
+	"golang.org/x/net/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// Subprotocols a client may offer on /ws. Clients that offer none are
+// served as chat.v1.json.
+const (
+	jsonV1Protocol  = "chat.v1.json"
+	jsonV2Protocol  = "chat.v2.json"
+	protoV2Protocol = "chat.v2.proto"
+	jsonrpcProtocol = "jsonrpc-2.0"
+)
+
+var supportedProtocols = []string{jsonV1Protocol, jsonV2Protocol, protoV2Protocol, jsonrpcProtocol}
+
+// v1Message is the bare format spoken before envelopes were versioned.
+type v1Message struct {
+	Author string `json:"author"`
+	Body   string `json:"body"`
+	Room   string `json:"room,omitempty"`
+}
+
+// jsonV1Codec keeps pre-envelope clients working: it reads and writes bare
+// {author, body} messages.
+var jsonV1Codec = websocket.Codec{Marshal: marshalWith(encodeJSONV1), Unmarshal: jsonV1Unmarshal}
+
+func encodeJSONV1(buf *bytes.Buffer, msg *Message) (byte, error) {
+	return websocket.TextFrame, encodeJSON(buf, v1Message{msg.Author, msg.Body, msg.Room})
+}
+
+func jsonV1Unmarshal(data []byte, payloadType byte, v interface{}) error {
+	var in v1Message
+	if err := decodeJSON(data, &in); err != nil {
+		return err
+	}
+	*v.(*Message) = Message{Type: typeMessage, Author: in.Author, Body: in.Body, Room: in.Room}
+	return checkRequired(v.(*Message))
+}
+
+// jsonV2Codec reads and writes versioned envelopes.
+var jsonV2Codec = websocket.Codec{Marshal: marshalWith(encodeJSONV2), Unmarshal: jsonV2Unmarshal}
+
+func encodeJSONV2(buf *bytes.Buffer, m *Message) (byte, error) {
+	if m.Type == typeAudio {
+		return encodeAudioFrame(buf, m)
+	}
+	msg := *m
+	msg.Version = protocolVersion
+	if msg.Type == "" {
+		msg.Type = typeMessage
+	}
+	return websocket.TextFrame, encodeJSON(buf, &msg)
+}
+
+func jsonV2Unmarshal(data []byte, payloadType byte, v interface{}) error {
+	msg := v.(*Message)
+	if payloadType == websocket.BinaryFrame {
+		return decodeAudioFrame(data, msg)
+	}
+	if err := decodeJSON(data, msg); err != nil {
+		return err
+	}
+	if err := inflateBody(msg); err != nil {
+		return err
+	}
+	if msg.Version != protocolVersion {
+		return fmt.Errorf("unsupported envelope version %d", msg.Version)
+	}
+	msg.Version = 0
+	if msg.Type == "" {
+		msg.Type = typeMessage
+	}
+	if err := checkRequired(msg); err != nil {
+		return err
+	}
+	return validateEnvelope(data, msg.Type)
+}
+
+// protoCodec sends messages as binary chatpb.Message frames.
+var protoCodec = websocket.Codec{Marshal: marshalWith(encodeProto), Unmarshal: protoUnmarshal}
+
+func encodeProto(buf *bytes.Buffer, msg *Message) (byte, error) {
+	data, err := proto.MarshalOptions{}.MarshalAppend(buf.AvailableBuffer(), toProto(msg))
+	buf.Write(data)
+	return websocket.BinaryFrame, err
+}
+
+func protoUnmarshal(data []byte, payloadType byte, v interface{}) error {
+	var in chatpb.Message
+	if err := proto.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	fromProto(&in, v.(*Message))
+	return nil
+}
+
+func toProto(msg *Message) *chatpb.Message {
+	return &chatpb.Message{Author: msg.Author, Body: msg.Body, Room: msg.Room, Type: msg.Type}
+}
+
+func fromProto(in *chatpb.Message, msg *Message) {
+	*msg = Message{Type: in.Type, Author: in.Author, Body: in.Body, Room: in.Room}
+	if msg.Type == "" {
+		msg.Type = typeMessage
+	}
+}
+
+func offeredProtocols(r *http.Request) []string {
+	var offered []string
+	for _, p := range strings.Split(r.Header.Get("Sec-Websocket-Protocol"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			offered = append(offered, p)
+		}
+	}
+	return offered
+}
+
+// selectProtocol picks the first of the client's offers the server
+// supports. It returns an empty string when there is no match.
+func selectProtocol(offered []string) string {
+	for _, p := range offered {
+		for _, s := range supportedProtocols {
+			if p == s {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// requireKnownProtocol turns away upgrade requests that only offer
+// subprotocols we don't speak, instead of silently falling back to JSON.
+func requireKnownProtocol(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if offered := offeredProtocols(r); len(offered) > 0 && selectProtocol(offered) == "" {
+			httpError(w, r, "unsupported subprotocol, expected one of: "+strings.Join(supportedProtocols, ", "), http.StatusBadRequest)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+// Delivery guarantees a message can ask for in its qos field.
+const (
+	// qosAtMostOnce sends the message once to whoever is connected.
+	qosAtMostOnce = 0
+	// qosAtLeastOnce keeps the message for each recipient until they
+	// acknowledge it, sending it again when they reconnect.
+	qosAtLeastOnce = 1
+)
+
+// typeAck acknowledges the at-least-once message whose ID is in Ref.
+const typeAck = "ack"
+
+const maxPending = 1000
+
+// recipientKey names a client across connections, so unacknowledged
+// messages can follow it: by who it authenticated as or, for anonymous
+// clients, by the session it resumes, see keepSession. Nicknames are
+// not enough, whoever takes one next would get the messages. Clients
+// with neither cannot be tracked.
+func (c *Client) recipientKey() string {
+	if c.identity != "" {
+		return "id:" + c.identity
+	}
+	if c.sessionID != "" {
+		return "session:" + c.sessionID
+	}
+	return ""
+}
+
+// track remembers msg for c until acknowledged. It is called with the hub
+// lock held.
+func (h *Hub) track(c *Client, msg *Message) {
+	key := c.recipientKey()
+	if key == "" {
+		return
+	}
+	pending := h.pending[key]
+	if len(pending) >= maxPending {
+		// Drop the oldest rather than grow without bounds.
+		pending = pending[1:]
+	}
+	h.pending[key] = append(pending, msg)
+}
+
+// ack forgets the message with id for c.
+func (h *Hub) ack(c *Client, id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := c.recipientKey()
+	pending := h.pending[key]
+	for i, msg := range pending {
+		if msg.ID == id {
+			pending = append(pending[:i:i], pending[i+1:]...)
+			break
+		}
+	}
+	if len(pending) == 0 {
+		delete(h.pending, key)
+	} else {
+		h.pending[key] = pending
+	}
+}
+
+// redeliver sends c the messages it has not acknowledged on an earlier
+// connection. It is called with the hub lock held.
+func (h *Hub) redeliver(c *Client) {
+	for _, msg := range h.pending[c.recipientKey()] {
+		if !c.queue.push(msg) {
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+var quotaFile = flag.String("tenant-quotas", "", "JSON file capping the usage of each tenant, e.g. {\"acme\": {\"connections\": 500, \"rooms\": 100, \"history\": 50, \"messagesPerSecond\": 20}}; the default tenant is \"\" and caps left out or 0 are unlimited")
+
+// quota caps what one tenant may use. Zero is no limit.
+type quota struct {
+	// Connections is the number of clients connected at once.
+	Connections int `json:"connections"`
+	// Rooms is the number of rooms created, not counting the lobby.
+	Rooms int `json:"rooms"`
+	// History is the number of messages each room remembers, at most
+	// historySize.
+	History int `json:"history"`
+	// MessagesPerSecond is the broadcast rate, over all clients and the
+	// broadcast API, with bursts up to Burst.
+	MessagesPerSecond float64 `json:"messagesPerSecond"`
+	Burst             int     `json:"burst"`
+}
+
+var (
+	errTenantFull      = clientErrorf(codeQuota, "too many clients connected, try again later")
+	errTooManyRooms    = clientErrorf(codeQuota, "no more rooms can be created")
+	errTenantThrottled = clientErrorf(codeRateLimited, "too many messages, message dropped")
+)
+
+var (
+	quotasOnce sync.Once
+	quotas     map[string]quota
+)
+
+// loadQuotas reads -tenant-quotas, keyed by tenant.
+func loadQuotas() map[string]quota {
+	quotasOnce.Do(func() {
+		quotas = make(map[string]quota)
+		if *quotaFile == "" {
+			return
+		}
+		data, err := os.ReadFile(*quotaFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &quotas); err != nil {
+			log.Fatalf("invalid tenant quotas %s: %v", *quotaFile, err)
+		}
+		for tenant, q := range quotas {
+			if !knownTenant(tenant) {
+				log.Fatalf("quota for unknown tenant %q", tenant)
+			}
+			if q.Connections < 0 || q.Rooms < 0 || q.History < 0 || q.MessagesPerSecond < 0 || q.Burst < 0 {
+				log.Fatalf("quota for tenant %q must not be negative", tenant)
+			}
+		}
+	})
+	return quotas
+}
+
+// quota returns the caps of h's tenant.
+func (h *Hub) quota() quota {
+	return loadQuotas()[h.tenant]
+}
+
+// roomsFull reports whether h may not create another room. It is called
+// with the hub lock held.
+func (h *Hub) roomsFull() bool {
+	q := h.quota()
+	if q.Rooms == 0 {
+		return false
+	}
+	n := len(h.rooms)
+	if h.rooms[""] != nil {
+		n--
+	}
+	return n >= q.Rooms
+}
+
+// historyLimit returns how many messages each room of h remembers.
+func (h *Hub) historyLimit() int {
+	if q := h.quota(); q.History > 0 && q.History < historySize {
+		return q.History
+	}
+	return historySize
+}
+
+// withinRate spends n messages of h's rate quota, and reports whether
+// there were enough.
+func (h *Hub) withinRate(n int) bool {
+	q := h.quota()
+	if q.MessagesPerSecond == 0 {
+		return true
+	}
+	burst := q.Burst
+	if burst == 0 {
+		burst = max(1, int(math.Ceil(q.MessagesPerSecond)))
+	}
+	if ok, _, _ := h.rate.take(q.MessagesPerSecond, burst, float64(n)); ok {
+		return true
+	}
+	h.throttled.Add(int64(n))
+	return false
+}
+
+// tenantUsage is what GET /admin/tenants returns for each tenant.
+type tenantUsage struct {
+	Tenant      string `json:"tenant"`
+	Connections int    `json:"connections"`
+	Rooms       int    `json:"rooms"`
+	History     int    `json:"history"`
+	// Throttled counts the messages dropped over the rate quota since the
+	// server started.
+	Throttled int64 `json:"throttled"`
+	Quota     quota `json:"quota"`
+}
+
+func (h *Hub) usage() tenantUsage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	u := tenantUsage{Tenant: h.tenant, Connections: h.clients.len(), Throttled: h.throttled.Load(), Quota: h.quota()}
+	for name, r := range h.rooms {
+		if name != "" {
+			u.Rooms++
+		}
+		r.mu.Lock()
+		u.History += len(r.history)
+		r.mu.Unlock()
+	}
+	return u
+}
+
+// adminTenantsHandler serves GET /admin/tenants, the usage and quota of
+// each tenant in use.
+func adminTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var usage []tenantUsage
+	for _, h := range allHubs() {
+		usage = append(usage, h.usage())
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tenant < usage[j].Tenant })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows bursts of up to burst events, refilled at rate per
+// second. Both are passed on every call so they can change at runtime.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take spends n tokens if there are enough, otherwise it returns how long
+// until there will be. It also returns the tokens left.
+func (b *tokenBucket) take(rate float64, burst int, n float64) (bool, float64, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, b.tokens, 0
+	}
+	return false, b.tokens, time.Duration((n - b.tokens) / rate * float64(time.Second))
+}
+
+// sweeper spaces out the scans dropping expired entries from a map, which
+// would be slow on every use of a large one. It is guarded by the lock of
+// the map.
+type sweeper struct {
+	next time.Time
+}
+
+// due reports whether the map should be scanned at now, at most once per
+// every, or each second for shorter periods.
+func (s *sweeper) due(now time.Time, every time.Duration) bool {
+	if now.Before(s.next) {
+		return false
+	}
+	if every < time.Second {
+		every = time.Second
+	}
+	s.next = now.Add(every)
+	return true
+}
+
+// requestBuckets are the token buckets of HTTP API callers, by
+// requestActor.
+var requestBuckets = struct {
+	sync.Mutex
+	byActor map[string]*tokenBucket
+	sweep   sweeper
+}{byActor: make(map[string]*tokenBucket)}
+
+func requestBucket(actor string, idle time.Duration) *tokenBucket {
+	requestBuckets.Lock()
+	defer requestBuckets.Unlock()
+
+	// Buckets idle long enough to be full again are as good as new ones.
+	now := time.Now()
+	if requestBuckets.sweep.due(now, idle) {
+		for a, b := range requestBuckets.byActor {
+			b.mu.Lock()
+			if now.Sub(b.last) > idle {
+				delete(requestBuckets.byActor, a)
+			}
+			b.mu.Unlock()
+		}
+	}
+	b := requestBuckets.byActor[actor]
+	if b == nil {
+		b = &tokenBucket{}
+		requestBuckets.byActor[actor] = b
+	}
+	return b
+}
+
+// limitRequests answers 429 Too Many Requests to callers exceeding the
+// broadcast rate limit, with Retry-After saying when to try again. Every
+// response carries X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset, the seconds until the caller's allowance is full.
+func limitRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := liveSettings()
+		if s.BroadcastRateLimit <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		idle := time.Duration(float64(s.BroadcastRateBurst) / s.BroadcastRateLimit * float64(time.Second))
+		ok, left, wait := requestBucket(requestActor(r), idle).take(s.BroadcastRateLimit, s.BroadcastRateBurst, 1)
+		reset := (float64(s.BroadcastRateBurst) - left) / s.BroadcastRateLimit
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(s.BroadcastRateBurst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(left)))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset))))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			httpError(w, r, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := b.take(1, 3, 1); !ok {
+			t.Fatalf("take %d of a burst of 3 refused", i+1)
+		}
+	}
+	ok, left, wait := b.take(1, 3, 1)
+	if ok {
+		t.Fatal("take past the burst accepted")
+	}
+	if left >= 1 || wait <= 0 || wait > time.Second {
+		t.Errorf("got %v tokens left and a wait of %v, want under one and up to a second", left, wait)
+	}
+
+	// A bucket idle long enough is full again, but no fuller.
+	b.last = time.Now().Add(-time.Hour)
+	if _, left, _ := b.take(1, 3, 1); left != 2 {
+		t.Errorf("got %v tokens left after refilling, want 2", left)
+	}
+}
+
+func TestSweeperDue(t *testing.T) {
+	var s sweeper
+	now := time.Now()
+	if !s.due(now, time.Minute) {
+		t.Fatal("first sweep not due")
+	}
+	if s.due(now.Add(30*time.Second), time.Minute) {
+		t.Error("sweep due again within the period")
+	}
+	if !s.due(now.Add(time.Minute), time.Minute) {
+		t.Error("sweep not due after the period")
+	}
+	// Short periods are stretched to a second.
+	later := now.Add(time.Hour)
+	s.due(later, time.Millisecond)
+	if s.due(later.Add(500*time.Millisecond), time.Millisecond) {
+		t.Error("sweep due twice within a second")
+	}
+}
+
+func TestRequestBucketsAreSwept(t *testing.T) {
+	idle := time.Second
+	stale := requestBucket("stale-caller", idle)
+	stale.take(1, 1, 1)
+	stale.last = time.Now().Add(-time.Minute)
+	fresh := requestBucket("fresh-caller", idle)
+	fresh.take(1, 1, 1)
+
+	requestBuckets.Lock()
+	requestBuckets.sweep = sweeper{}
+	requestBuckets.Unlock()
+	requestBucket("another-caller", idle)
+
+	requestBuckets.Lock()
+	defer requestBuckets.Unlock()
+	if _, ok := requestBuckets.byActor["stale-caller"]; ok {
+		t.Error("idle bucket kept")
+	}
+	if requestBuckets.byActor["fresh-caller"] != fresh {
+		t.Error("active bucket dropped")
+	}
+}
+
+func TestAddrConnectBucketsAreSwept(t *testing.T) {
+	oldRate, oldBurst := *connectRatePerIP, *connectBurstPerIP
+	*connectRatePerIP, *connectBurstPerIP = 1, 1
+	defer func() { *connectRatePerIP, *connectBurstPerIP = oldRate, oldBurst }()
+
+	stale := addrConnectBucket("192.0.2.1")
+	stale.take(1, 1, 1)
+	stale.last = time.Now().Add(-time.Minute)
+	if addrConnectBucket("192.0.2.1") != stale {
+		t.Fatal("bucket not kept between sweeps")
+	}
+
+	connectBuckets.Lock()
+	connectBuckets.sweep = sweeper{}
+	connectBuckets.Unlock()
+	if addrConnectBucket("192.0.2.1") == stale {
+		t.Error("idle bucket kept after a sweep")
+	}
+}
+
+func TestAdmitConnectionsPerAddress(t *testing.T) {
+	oldRate, oldBurst := *connectRatePerIP, *connectBurstPerIP
+	*connectRatePerIP, *connectBurstPerIP = 0.001, 2
+	defer func() { *connectRatePerIP, *connectBurstPerIP = oldRate, oldBurst }()
+
+	h := admitConnections(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	connect := func(addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.RemoteAddr = addr + ":1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := connect("198.51.100.1"); w.Code != http.StatusNoContent {
+			t.Fatalf("connection %d refused with %d", i+1, w.Code)
+		}
+	}
+	w := connect("198.51.100.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d and Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := connect("198.51.100.2"); w.Code != http.StatusNoContent {
+		t.Errorf("another address refused with %d", w.Code)
+	}
+}
+
+func TestLimitRequests(t *testing.T) {
+	old := liveSettings()
+	s := *old
+	s.BroadcastRateLimit, s.BroadcastRateBurst = 0.001, 1
+	currentSettings.Store(&s)
+	defer currentSettings.Store(old)
+
+	h := limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/broadcast/hello", nil)
+		r.RemoteAddr = "203.0.113.9:1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := send(); w.Code != http.StatusNoContent || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("got status %d with %q remaining, want 204 with 0", w.Code, w.Header().Get("X-RateLimit-Remaining"))
+	}
+	if w := send(); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d and Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+}
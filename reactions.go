@@ -0,0 +1,17 @@
+package main
+
+// typeReaction carries an emoji in the body reacting to the message
+// referenced by Ref. Reactions are published like messages, and kept in
+// the history, but never held for moderation.
+const typeReaction = "reaction"
+
+// checkReaction validates a reaction from a client.
+func checkReaction(msg *Message) error {
+	if err := checkFeature(featureReactions); err != nil {
+		return err
+	}
+	if msg.Ref == "" || msg.Body == "" {
+		return &validationError{"reaction needs a ref and a body"}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// cidrList is a comma separated list of networks, written on the command
+// line as -trusted-proxies 10.0.0.0/8,192.168.1.10.
+type cidrList []*net.IPNet
+
+func (cl *cidrList) String() string {
+	nets := make([]string, len(*cl))
+	for i, n := range *cl {
+		nets[i] = n.String()
+	}
+	return strings.Join(nets, ",")
+}
+
+func (cl *cidrList) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		*cl = append(*cl, n)
+	}
+	return nil
+}
+
+func (cl cidrList) contains(ip net.IP) bool {
+	for _, n := range cl {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var trustedProxies cidrList
+
+func init() {
+	flag.Var(&trustedProxies, "trusted-proxies", "comma separated networks of reverse proxies whose X-Forwarded-For and X-Real-IP headers are believed")
+}
+
+// clientIP returns the address of the client behind r. Forwarding headers
+// are only honoured when the peer is a trusted proxy; X-Forwarded-For is
+// walked from the right, skipping the trusted hops, so a client cannot
+// spoof its address by sending the header itself.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !trustedProxies.contains(peer) {
+		return host
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				return host
+			}
+			if i == 0 || !trustedProxies.contains(ip) {
+				return ip.String()
+			}
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return host
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+const (
+	// typeRead says the sender read the messages of Room up to Seq.
+	typeRead = "read"
+	// typeReceipt tells a room that the author read up to Seq.
+	typeReceipt = "receipt"
+	// typeReceipts asks for the read markers of Room, and answers with
+	// them in Receipts.
+	typeReceipts = "receipts"
+)
+
+// reader names c in read receipts, or is empty when it has no name.
+func (c *Client) reader() string {
+	if c.identity != "" {
+		return c.identity
+	}
+	return c.nick
+}
+
+// lastSeq returns the last sequence number given out in room.
+func (h *Hub) lastSeq(name string) uint64 {
+	r := h.existingRoom(name)
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.seq
+}
+
+// markRead moves the read marker of c in room forward to seq and tells
+// the room. Markers never move back.
+func (h *Hub) markRead(c *Client, room string, seq uint64) error {
+	reader := c.reader()
+	if reader == "" {
+		return &validationError{"read receipts need a nickname"}
+	}
+	if room != "" && !c.joined(room) {
+		return &validationError{"not in room " + room}
+	}
+	if seq == 0 || seq > h.lastSeq(room) {
+		return &validationError{"read needs the seq of a message in the room"}
+	}
+
+	moved, err := dataStore().SaveReceipt(context.Background(), h.storeKey(room), reader, seq)
+	if err != nil {
+		log.Println("Cannot save read receipt:", err)
+		return clientErrorf(codeInternal, "cannot save read receipt")
+	}
+	if moved {
+		h.relay(c, &Message{Type: typeReceipt, Author: reader, Room: room, Seq: seq})
+	}
+	return nil
+}
+
+// receipts returns the read markers of room by reader.
+func (h *Hub) receipts(ctx context.Context, room string) (map[string]uint64, error) {
+	m, err := dataStore().Receipts(ctx, h.storeKey(room))
+	if m == nil && err == nil {
+		m = map[string]uint64{}
+	}
+	return m, err
+}
+
+// sendReceipts answers a receipts request of c.
+func sendReceipts(c *Client, req *Message) {
+	if req.Room != "" && !c.joined(req.Room) {
+		sendError(c, &validationError{"not in room " + req.Room})
+		return
+	}
+	m, err := c.hub.receipts(context.Background(), req.Room)
+	if err != nil {
+		log.Println("Cannot load read receipts:", err)
+		sendError(c, clientErrorf(codeInternal, "cannot load read receipts"))
+		return
+	}
+	c.send(&Message{Type: typeReceipts, Author: "Server", Room: req.Room, Receipts: m})
+}
+
+// receiptsHandler serves GET /rooms/{room}/receipts, the read markers of
+// the room by reader, so UIs can count unread messages against the seq of
+// the room's history. Only moderators and members may see them.
+func receiptsHandler(w http.ResponseWriter, r *http.Request, room string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !canReadRoom(r, room) {
+		httpError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	m, err := hubFor(r).receipts(r.Context(), room)
+	if err != nil {
+		log.Println("Cannot load read receipts:", err)
+		httpError(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// panicCount counts recovered panics, reported in the server stats.
+var panicCount atomic.Int64
+
+func logPanic(where string, r any) {
+	panicCount.Add(1)
+	log.Printf("Panic in %s: %v\n%s", where, r, debug.Stack())
+}
+
+// recoverPanic, when deferred, stops a panic from going beyond the
+// function deferring it, which returns normally.
+func recoverPanic(where string) {
+	if r := recover(); r != nil {
+		logPanic(where, r)
+	}
+}
+
+// recoverError, when deferred, turns a panic into an error returned by the
+// function deferring it, which must name its error result.
+func recoverError(where string, err *error) {
+	if r := recover(); r != nil {
+		logPanic(where, r)
+		*err = fmt.Errorf("panic in %s: %v", where, r)
+	}
+}
+
+// recoverHandler answers 500 Internal Server Error when h panics, instead
+// of leaving it to net/http, which would not count it.
+func recoverHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				logPanic(r.Method+" "+r.URL.Path, p)
+				httpError(w, r, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// gRPC does not recover panics in handlers at all.
+func recoverUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			logPanic(info.FullMethod, p)
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+func recoverStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			logPanic(info.FullMethod, p)
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+	return handler(srv, ss)
+}
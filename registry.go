@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const registryShards = 64
+
+// registry holds the connected clients, spread over shards by client ID so
+// clients coming and going only contend when they land on the same shard.
+// Shard locks are taken last, after the hub and room locks.
+type registry struct {
+	shards [registryShards]struct {
+		sync.Mutex
+		clients map[uint64]*Client
+	}
+	size atomic.Int64
+	// nicks maps lowercased nicknames to the client using them.
+	nicks sync.Map
+}
+
+var lastClientID atomic.Uint64
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.shards {
+		r.shards[i].clients = make(map[uint64]*Client)
+	}
+	return r
+}
+
+// add registers c, failing if its nickname is in use.
+func (r *registry) add(c *Client) error {
+	if c.nick != "" {
+		if _, taken := r.nicks.LoadOrStore(strings.ToLower(c.nick), c); taken {
+			return errNickTaken
+		}
+	}
+	s := &r.shards[c.id%registryShards]
+	s.Lock()
+	s.clients[c.id] = c
+	s.Unlock()
+	r.size.Add(1)
+	return nil
+}
+
+func (r *registry) remove(c *Client) {
+	s := &r.shards[c.id%registryShards]
+	s.Lock()
+	_, ok := s.clients[c.id]
+	delete(s.clients, c.id)
+	s.Unlock()
+	if !ok {
+		return
+	}
+	r.size.Add(-1)
+	if c.nick != "" {
+		r.nicks.CompareAndDelete(strings.ToLower(c.nick), c)
+	}
+}
+
+func (r *registry) len() int {
+	return int(r.size.Load())
+}
+
+// each calls f for every client, holding one shard lock at a time.
+func (r *registry) each(f func(*Client)) {
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.Lock()
+		for _, c := range s.clients {
+			f(c)
+		}
+		s.Unlock()
+	}
+}
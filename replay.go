@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	broadcastMaxSkew = 5 * time.Minute
+	maxNonceLength   = 64
+)
+
+var broadcastKeyFile = flag.String("broadcast-key-file", "", "file with a secret key /broadcast requests of the default tenant must be signed with; those of each of -tenants are signed with the hex encoded HMAC-SHA256 of its name under this key instead; disabled when empty")
+
+var (
+	broadcastKeyOnce sync.Once
+	broadcastKey     []byte
+)
+
+func loadBroadcastKey() []byte {
+	broadcastKeyOnce.Do(func() {
+		key, err := os.ReadFile(*broadcastKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		broadcastKey = []byte(strings.TrimSpace(string(key)))
+	})
+	return broadcastKey
+}
+
+// tenantBroadcastKey returns the key broadcasts to tenant are signed with,
+// so holders of one tenant's key cannot broadcast to another.
+func tenantBroadcastKey(key []byte, tenant string) []byte {
+	if tenant == "" {
+		return key
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(tenant))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// nonceCache remembers the nonces seen for keep, which for signed
+// requests is the allowed clock skew both ways: older ones need not be
+// kept, their timestamps are rejected anyway.
+type nonceCache struct {
+	mu    sync.Mutex
+	keep  time.Duration
+	seen  map[string]time.Time
+	sweep sweeper
+}
+
+var broadcastNonces = nonceCache{keep: 2 * broadcastMaxSkew, seen: make(map[string]time.Time)}
+
+// add returns false if nonce was already used.
+func (nc *nonceCache) add(nonce string, now time.Time) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if nc.sweep.due(now, nc.keep) {
+		for n, t := range nc.seen {
+			if now.Sub(t) > nc.keep {
+				delete(nc.seen, n)
+			}
+		}
+	}
+	if t, ok := nc.seen[nonce]; ok && now.Sub(t) <= nc.keep {
+		return false
+	}
+	nc.seen[nonce] = now
+	return true
+}
+
+// requireSignedRequest rejects requests that are not signed with the
+// -broadcast-key-file key of their tenant, are older than broadcastMaxSkew
+// or reuse a nonce. Clients send X-Timestamp (unix seconds), X-Nonce and
+// X-Signature, the hex encoded HMAC-SHA256 of method, path and query,
+// timestamp, nonce and, for requests with a body, the hex encoded SHA-256
+// of the body, joined by newlines.
+func requireSignedRequest(h http.Handler) http.Handler {
+	if *broadcastKeyFile == "" {
+		return h
+	}
+	key := loadBroadcastKey()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timestamp, nonce := r.Header.Get("X-Timestamp"), r.Header.Get("X-Nonce")
+		signature, err := hex.DecodeString(r.Header.Get("X-Signature"))
+		if err != nil || nonce == "" || len(nonce) > maxNonceLength {
+			httpError(w, r, "Missing or invalid request signature", http.StatusUnauthorized)
+			return
+		}
+
+		signed := []string{r.Method, r.URL.RequestURI(), timestamp, nonce}
+		if r.ContentLength != 0 && r.Body != nil {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+			if err != nil {
+				httpError(w, r, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256.Sum256(body)
+			signed = append(signed, hex.EncodeToString(sum[:]))
+		}
+		mac := hmac.New(sha256.New, tenantBroadcastKey(key, requestTenant(r)))
+		mac.Write([]byte(strings.Join(signed, "\n")))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			httpError(w, r, "Missing or invalid request signature", http.StatusUnauthorized)
+			return
+		}
+
+		now := time.Now()
+		sec, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			httpError(w, r, "Invalid timestamp", http.StatusUnauthorized)
+			return
+		}
+		if skew := now.Sub(time.Unix(sec, 0)); skew > broadcastMaxSkew || skew < -broadcastMaxSkew {
+			httpError(w, r, "Stale request", http.StatusUnauthorized)
+			return
+		}
+		if !broadcastNonces.add(nonce, now) {
+			httpError(w, r, "Replayed request", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
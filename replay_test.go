@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBroadcastKey = "test-broadcast-key"
+
+// signedBroadcastHandler returns requireSignedRequest in front of a handler
+// answering 204, with the key in testBroadcastKey.
+func signedBroadcastHandler(t *testing.T) http.Handler {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "broadcast.key")
+	if err := os.WriteFile(file, []byte(testBroadcastKey+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	old := *broadcastKeyFile
+	*broadcastKeyFile = file
+	t.Cleanup(func() { *broadcastKeyFile = old })
+
+	return requireSignedRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// signRequest signs r the way requireSignedRequest checks it.
+func signRequest(r *http.Request, key string, at time.Time, nonce string, body []byte) {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	signed := []string{r.Method, r.URL.RequestURI(), timestamp, nonce}
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		signed = append(signed, hex.EncodeToString(sum[:]))
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.Join(signed, "\n")))
+	r.Header.Set("X-Timestamp", timestamp)
+	r.Header.Set("X-Nonce", nonce)
+	r.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// testNonce returns a nonce no other request of the tests uses.
+func testNonce(name string) string {
+	return name + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+func TestRequireSignedRequest(t *testing.T) {
+	h := signedBroadcastHandler(t)
+	body := []byte(`[{"body":"hello"}]`)
+
+	tests := []struct {
+		name string
+		// prepare returns a request signed or tampered with.
+		prepare func() *http.Request
+		want    int
+	}{
+		{"signed", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/broadcast/hello?select=role=admin", nil)
+			signRequest(r, testBroadcastKey, time.Now(), testNonce("signed"), nil)
+			return r
+		}, http.StatusNoContent},
+		{"signed with body", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/broadcast/batch", bytes.NewReader(body))
+			signRequest(r, testBroadcastKey, time.Now(), testNonce("body"), body)
+			return r
+		}, http.StatusNoContent},
+		{"unsigned", func() *http.Request {
+			return httptest.NewRequest(http.MethodPost, "/broadcast/hello", nil)
+		}, http.StatusUnauthorized},
+		{"wrong key", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/broadcast/hello", nil)
+			signRequest(r, "other-key", time.Now(), testNonce("key"), nil)
+			return r
+		}, http.StatusUnauthorized},
+		{"query changed", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/broadcast/hello?select=role=admin", nil)
+			signRequest(r, testBroadcastKey, time.Now(), testNonce("query"), nil)
+			r.URL.RawQuery = "select=role=user"
+			r.RequestURI = r.URL.RequestURI()
+			return r
+		}, http.StatusUnauthorized},
+		{"body changed", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/broadcast/batch", bytes.NewReader([]byte(`[{"body":"bye"}]`)))
+			signRequest(r, testBroadcastKey, time.Now(), testNonce("changed"), body)
+			return r
+		}, http.StatusUnauthorized},
+		{"stale", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/broadcast/hello", nil)
+			signRequest(r, testBroadcastKey, time.Now().Add(-2*broadcastMaxSkew), testNonce("stale"), nil)
+			return r
+		}, http.StatusUnauthorized},
+		{"from the future", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/broadcast/hello", nil)
+			signRequest(r, testBroadcastKey, time.Now().Add(2*broadcastMaxSkew), testNonce("future"), nil)
+			return r
+		}, http.StatusUnauthorized},
+		{"nonce too long", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/broadcast/hello", nil)
+			signRequest(r, testBroadcastKey, time.Now(), strings.Repeat("n", maxNonceLength+1), nil)
+			return r
+		}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, tt.prepare())
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestRequireSignedRequestRefusesReplays(t *testing.T) {
+	h := signedBroadcastHandler(t)
+	r := httptest.NewRequest(http.MethodPost, "/broadcast/hello", nil)
+	signRequest(r, testBroadcastKey, time.Now(), testNonce("replay"), nil)
+
+	for i, want := range []int{http.StatusNoContent, http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r.Clone(r.Context()))
+		if w.Code != want {
+			t.Errorf("request %d: got status %d, want %d", i+1, w.Code, want)
+		}
+	}
+}
+
+func TestTenantBroadcastKey(t *testing.T) {
+	key := []byte(testBroadcastKey)
+	if got := tenantBroadcastKey(key, ""); !bytes.Equal(got, key) {
+		t.Errorf("default tenant key is %q, want the key itself", got)
+	}
+	a, b := tenantBroadcastKey(key, "a"), tenantBroadcastKey(key, "b")
+	if bytes.Equal(a, key) || bytes.Equal(a, b) {
+		t.Error("tenants share broadcast keys")
+	}
+	if !bytes.Equal(a, tenantBroadcastKey(key, "a")) {
+		t.Error("tenant key is not stable")
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	nc := nonceCache{keep: time.Minute, seen: make(map[string]time.Time)}
+	now := time.Now()
+
+	if !nc.add("a", now) {
+		t.Fatal("new nonce refused")
+	}
+	if nc.add("a", now.Add(30*time.Second)) {
+		t.Error("nonce accepted twice within keep")
+	}
+	if !nc.add("b", now.Add(30*time.Second)) {
+		t.Error("other nonce refused")
+	}
+	// Past keep, a is forgotten and swept.
+	if !nc.add("a", now.Add(2*time.Minute)) {
+		t.Error("nonce refused after keep")
+	}
+	nc.add("c", now.Add(5*time.Minute))
+	if _, ok := nc.seen["b"]; ok {
+		t.Error("expired nonce not swept")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	replicaOf             = flag.String("replica-of", "", "websocket URL of the /replication endpoint of a primary, such as wss://chat.example.com/replication, to run as its read replica: rooms are fed from the primary's messages and what local clients send is forwarded to it")
+	replicationSecretFile = flag.String("replication-secret-file", "", "file with the secret replicas authenticate to their primary with; /replication accepts no replicas without it")
+)
+
+// replicationBuffer is how many messages a replica may fall behind before
+// the primary drops it, to catch up by reconnecting.
+const replicationBuffer = 4096
+
+// replicationFrame is a message on its way between primary and replica,
+// with what its JSON leaves out.
+type replicationFrame struct {
+	Tenant  string   `json:"tenant,omitempty"`
+	Select  []string `json:"select,omitempty"`
+	Message *Message `json:"message,omitempty"`
+	// Session is handed over by a draining cluster node, see keepSession.
+	Session *clientSession `json:"session,omitempty"`
+}
+
+// replication holds the streams of the replicas connected to this server
+// and the connections to the primary or the other nodes of the cluster,
+// by URL, guarded by upstreamMu so forwarding does not hold up the
+// streams.
+var replication = struct {
+	sync.Mutex
+	secret     string
+	streams    map[chan []byte]bool
+	count      atomic.Int32
+	upstreamMu sync.Mutex
+	upstreams  map[string]*websocket.Conn
+}{streams: make(map[chan []byte]bool), upstreams: make(map[string]*websocket.Conn)}
+
+// startReplication reads the replication secret and, on a replica,
+// connects to the primary.
+func startReplication() {
+	if *replicationSecretFile != "" {
+		replication.secret = readSecretFile(*replicationSecretFile)
+	}
+	if *replicaOf == "" {
+		return
+	}
+	if replication.secret == "" {
+		log.Fatal("-replica-of needs -replication-secret-file")
+	}
+	go runReplica(*replicaOf, nil)
+}
+
+var replicationHandler = websocket.Server{Handshake: replicationHandshake, Handler: onReplicaConnect}
+
+func replicationHandshake(config *websocket.Config, r *http.Request) error {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if replication.secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(replication.secret)) != 1 {
+		return errors.New("not a replica")
+	}
+	return nil
+}
+
+// onReplicaConnect streams every delivered message to a replica and
+// broadcasts the messages it forwards.
+func onReplicaConnect(ws *websocket.Conn) {
+	defer ws.Close()
+	defer recoverPanic("replica connection")
+	log.Println("Replica connected from", clientIP(ws.Request()))
+
+	stream := make(chan []byte, replicationBuffer)
+	replication.Lock()
+	replication.streams[stream] = true
+	replication.count.Add(1)
+	replication.Unlock()
+	defer func() {
+		replication.Lock()
+		if replication.streams[stream] {
+			delete(replication.streams, stream)
+			replication.count.Add(-1)
+		}
+		replication.Unlock()
+	}()
+
+	go func() {
+		defer ws.Close()
+		for data := range stream {
+			if err := websocket.Message.Send(ws, string(data)); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var f replicationFrame
+		if err := websocket.JSON.Receive(ws, &f); err != nil {
+			log.Println("Replica disconnected:", err)
+			return
+		}
+		if f.Session != nil {
+			storeSession(f.Session)
+			continue
+		}
+		h := tenantHub(f.Tenant)
+		if h == nil || f.Message == nil {
+			continue
+		}
+		msg := f.Message
+		msg.Select, _ = parseSelector(f.Select)
+		h.broadcast(msg)
+		h.unfurl(msg)
+	}
+}
+
+// replicate hands msg, just delivered to a room of tenant, to the
+// replicas. Replicas too far behind are dropped. Cluster nodes only pass
+// on the messages of the rooms they own, the other nodes follow every
+// owner.
+func replicate(tenant string, msg *Message) {
+	if replication.count.Load() == 0 || (msg.replicated && clustered()) {
+		return
+	}
+	data, err := json.Marshal(replicationFrame{Tenant: tenant, Select: msg.Select.strings(), Message: msg})
+	if err != nil {
+		log.Println("Cannot replicate message:", err)
+		return
+	}
+
+	replication.Lock()
+	defer replication.Unlock()
+
+	for stream := range replication.streams {
+		select {
+		case stream <- data:
+		default:
+			log.Println("Dropping replica that fell behind")
+			delete(replication.streams, stream)
+			replication.count.Add(-1)
+			close(stream)
+		}
+	}
+}
+
+func (sel selector) strings() []string {
+	var specs []string
+	for _, cr := range sel {
+		specs = append(specs, cr.key+"="+cr.value)
+	}
+	return specs
+}
+
+// runReplica keeps following the primary or cluster node at url, until
+// stop is closed.
+func runReplica(url string, stop chan struct{}) {
+	for {
+		err := replicaSession(url, stop)
+		log.Println("Replication from", url, "ended:", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// replicaSession delivers the messages from url to the local rooms, as
+// they were numbered there, until the connection fails or is closed to
+// stop following url.
+func replicaSession(url string, stop chan struct{}) error {
+	config, err := websocket.NewConfig(url, url)
+	if err != nil {
+		return err
+	}
+	config.Header.Set("Authorization", "Bearer "+replication.secret)
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	log.Println("Replicating", url)
+
+	replication.upstreamMu.Lock()
+	replication.upstreams[url] = ws
+	replication.upstreamMu.Unlock()
+	defer func() {
+		replication.upstreamMu.Lock()
+		if replication.upstreams[url] == ws {
+			delete(replication.upstreams, url)
+		}
+		replication.upstreamMu.Unlock()
+	}()
+	select {
+	case <-stop:
+		return errors.New("no longer followed")
+	default:
+	}
+
+	for {
+		var f replicationFrame
+		if err := websocket.JSON.Receive(ws, &f); err != nil {
+			return err
+		}
+		h := tenantHub(f.Tenant)
+		if h == nil || f.Message == nil {
+			continue
+		}
+		msg := f.Message
+		msg.Select, _ = parseSelector(f.Select)
+		msg.replicated = true
+		msg.received = time.Now()
+
+		h.mu.Lock()
+		r := h.broadcastRoom(msg.Room, msg)
+		h.mu.Unlock()
+		if r != nil {
+			r.submit([]*Message{msg})
+			h.release(r)
+		}
+	}
+}
+
+// forward sends msg to the node at url, see Hub.upstream, which
+// broadcasts it back along with everyone else. Without a connection to
+// that node it is shed.
+func (h *Hub) forward(url string, msg *Message) delivery {
+	replication.upstreamMu.Lock()
+	defer replication.upstreamMu.Unlock()
+
+	ws := replication.upstreams[url]
+	if ws == nil {
+		return delivery{Shed: true}
+	}
+	f := replicationFrame{Tenant: h.tenant, Select: msg.Select.strings(), Message: msg}
+	if err := websocket.JSON.Send(ws, f); err != nil {
+		log.Println("Cannot forward message to", url, err)
+		ws.Close()
+		delete(replication.upstreams, url)
+		return delivery{Shed: true}
+	}
+	return delivery{}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var resumeWindow = flag.Duration("resume-window", 2*time.Minute, "how long websocket clients can resume their session, its rooms, subscription and undelivered messages, by reconnecting with ?resume={id}; draining cluster nodes hand their sessions to the other nodes; 0 disables resuming")
+
+// typeSession tells a websocket client, in the body, the ID to resume its
+// session with after a reconnect.
+const typeSession = "session"
+
+// clientSession is what a client resuming its session gets back.
+type clientSession struct {
+	ID       string            `json:"id"`
+	Tenant   string            `json:"tenant,omitempty"`
+	Identity string            `json:"identity,omitempty"`
+	Rooms    []string          `json:"rooms,omitempty"`
+	Filter   map[string]string `json:"filter,omitempty"`
+	Pending  []*Message        `json:"pending,omitempty"`
+	Expires  time.Time         `json:"expires"`
+}
+
+// resumable are the sessions of clients that went away, by ID, until they
+// expire. Expired ones are swept at most once per -resume-window.
+var resumable = struct {
+	sync.Mutex
+	byID  map[string]*clientSession
+	sweep sweeper
+}{byID: make(map[string]*clientSession)}
+
+// keepSession keeps the session of a client that disconnected for
+// -resume-window, handing it to the other nodes when this one drains.
+// Kicked clients cannot resume.
+func keepSession(c *Client) {
+	if *resumeWindow <= 0 || c.sessionID == "" {
+		return
+	}
+	c.mu.Lock()
+	reason, filter := c.closeReason, c.filter
+	c.mu.Unlock()
+	if reason == reasonKicked {
+		if c.identity == "" {
+			c.hub.mu.Lock()
+			delete(c.hub.pending, c.recipientKey())
+			c.hub.mu.Unlock()
+		}
+		return
+	}
+
+	s := &clientSession{ID: c.sessionID, Tenant: c.hub.tenant, Identity: c.identity, Filter: filter, Expires: time.Now().Add(*resumeWindow)}
+	c.hub.mu.Lock()
+	for name := range c.rooms {
+		s.Rooms = append(s.Rooms, name)
+	}
+	c.hub.mu.Unlock()
+	for msg := c.queue.pop(); msg != nil; msg = c.queue.pop() {
+		s.Pending = append(s.Pending, msg)
+		msg.written()
+	}
+	storeSession(s)
+	if draining.Load() && clustered() {
+		handOverSession(s)
+	}
+}
+
+func storeSession(s *clientSession) {
+	now := time.Now()
+	var expired []*clientSession
+	resumable.Lock()
+	if resumable.sweep.due(now, *resumeWindow) {
+		for id, old := range resumable.byID {
+			if now.After(old.Expires) {
+				delete(resumable.byID, id)
+				expired = append(expired, old)
+			}
+		}
+	}
+	resumable.byID[s.ID] = s
+	resumable.Unlock()
+
+	// Nobody can come back for what was kept for them.
+	for _, old := range expired {
+		if h := tenantHub(old.Tenant); h != nil {
+			h.mu.Lock()
+			delete(h.pending, "session:"+old.ID)
+			h.mu.Unlock()
+		}
+	}
+}
+
+// takeSession removes and returns the session id, if c may resume it:
+// it has not expired and c is of the same tenant and identity.
+func takeSession(c *Client, id string) *clientSession {
+	resumable.Lock()
+	defer resumable.Unlock()
+
+	s := resumable.byID[id]
+	if s == nil || time.Now().After(s.Expires) || s.Tenant != c.hub.tenant || s.Identity != c.identity {
+		return nil
+	}
+	delete(resumable.byID, id)
+	return s
+}
+
+// resume puts c back in the rooms of s, with its subscription, and queues
+// what it had not been sent yet. Messages broadcast while it was away are
+// left to backfill.
+func (h *Hub) resume(c *Client, s *clientSession) {
+	for _, name := range s.Rooms {
+		if err := h.join(c, name); err != nil {
+			log.Printf("Cannot resume room %s of session %s: %v", name, s.ID, err)
+		}
+	}
+	h.subscribe(c, s.Filter)
+	for _, msg := range s.Pending {
+		c.queue.put(msg)
+	}
+	log.Printf("Resumed session %s with %d rooms and %d pending messages", s.ID, len(s.Rooms), len(s.Pending))
+}
+
+// handOverSession sends s to the other nodes of the cluster, where its
+// client may reconnect.
+func handOverSession(s *clientSession) {
+	replication.upstreamMu.Lock()
+	defer replication.upstreamMu.Unlock()
+
+	for node, ws := range replication.upstreams {
+		if err := websocket.JSON.Send(ws, replicationFrame{Tenant: s.Tenant, Session: s}); err != nil {
+			log.Printf("Cannot hand session %s over to %s: %v", s.ID, node, err)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// room is the hub's shard for one room: its members, what it remembers and
+// a goroutine delivering its messages in order. Rooms do not wait for each
+// other, so one busy room does not hold up the rest. The lobby, the room
+// named "", has every client as a member.
+type room struct {
+	hub  *Hub
+	name string
+	// label names the room in metrics, see roomLabel.
+	label string
+	jobs  chan roomJob
+	// snapshot is a copy of members, replaced rather than changed, so
+	// deliveries read it without taking mu.
+	snapshot atomic.Pointer[[]*Client]
+
+	mu sync.Mutex
+	// members joined the room by name. Clients that joined a pattern
+	// covering it are found through Hub.patterns.
+	members  map[*Client]bool
+	history  []*Message
+	retained *Message
+	// seq is the last sequence number given out, and seqLimit the last
+	// one reserved in the store, see reserveSeqs.
+	seq      uint64
+	seqLimit uint64
+	// pins are sent to everyone joining.
+	pins []*Message
+	// presenceVersion counts the changes to the members and their status,
+	// see notifyPresence.
+	presenceVersion uint64
+	// memberTime adds up the time members spent in the room until
+	// accruedAt, and messages and bytes what was broadcast to it, for
+	// usage accounting, since the room was created or created again once
+	// what was kept of it was evicted.
+	since      time.Time
+	memberTime time.Duration
+	accruedAt  time.Time
+	messages   atomic.Int64
+	bytes      atomic.Int64
+	// speaker holds the floor of a push-to-talk room since floorSince,
+	// and last sent audio at lastAudio, see Hub.floor.
+	speaker    *Client
+	floorSince time.Time
+	lastAudio  time.Time
+	// broadcasts counts those handed the room and not yet delivered,
+	// which keep it from being reclaimed, see Hub.reclaim.
+	broadcasts atomic.Int32
+}
+
+// retiredRoom is what is kept of a reclaimed room: the sequence numbers
+// it gave out go on, and its usage still counts. It is kept for
+// retiredTTL, see Hub.retire.
+type retiredRoom struct {
+	at         time.Time
+	since      time.Time
+	seq        uint64
+	seqLimit   uint64
+	memberTime time.Duration
+	messages   int64
+	bytes      int64
+}
+
+// roomJob asks the room goroutine to deliver msgs, in order, and report
+// back on done.
+type roomJob struct {
+	msgs []*Message
+	done chan []delivery
+}
+
+func newRoom(h *Hub, name string) *room {
+	r := &room{hub: h, name: name, label: roomLabel(name), jobs: make(chan roomJob, 64), members: make(map[*Client]bool), since: time.Now()}
+	r.snapshot.Store(&[]*Client{})
+	go r.run()
+	return r
+}
+
+func (r *room) run() {
+	for job := range r.jobs {
+		ds := make([]delivery, len(job.msgs))
+		for i, msg := range job.msgs {
+			ds[i] = r.deliver(msg)
+		}
+		job.done <- ds
+	}
+}
+
+// submit hands msgs to the room goroutine and waits until they are
+// delivered.
+func (r *room) submit(msgs []*Message) []delivery {
+	done := make(chan []delivery, 1)
+	r.jobs <- roomJob{msgs, done}
+	return <-done
+}
+
+// deliver runs on the room goroutine. The store is written outside r.mu,
+// so joins and history reads do not wait on it.
+func (r *room) deliver(msg *Message) delivery {
+	// Targeted messages would reach everyone through the history.
+	kept := msg.Type != typeKeyExchange && msg.Select == nil
+	if kept && !msg.replicated {
+		r.reserveSeqs()
+	}
+	r.mu.Lock()
+	if msg.Type != typeKeyExchange {
+		msg.To = ""
+	}
+	if kept {
+		if msg.replicated {
+			r.seq = msg.Seq
+		} else {
+			r.seq++
+			msg.Seq = r.seq
+		}
+	}
+	// Signed once the sequence number is known, before anyone can read
+	// it from the history.
+	sign(msg)
+	if kept {
+		r.remember(msg)
+		r.retain(msg)
+	}
+	r.mu.Unlock()
+	if kept {
+		r.save(msg)
+	}
+	replicate(r.hub.tenant, msg)
+
+	roomMessages.WithLabelValues(r.hub.tenant, r.label).Inc()
+	roomBytes.WithLabelValues(r.hub.tenant, r.label).Add(float64(len(msg.Body)))
+	r.messages.Add(1)
+	r.bytes.Add(int64(len(msg.Body)))
+	msg.track()
+	defer msg.written()
+	d := delivery{ID: msg.ID}
+	var tracked []*Client
+	members := *r.snapshot.Load()
+	recipients := members
+	if r.name != "" {
+		if others := r.hub.patternSubscribers(r.name, members); len(others) > 0 {
+			recipients = append(others, members...)
+		}
+	}
+	for _, c := range recipients {
+		if msg.To != "" && !strings.EqualFold(c.nick, msg.To) {
+			continue
+		}
+		if !c.matches(msg.Select) || !c.wants(msg) {
+			continue
+		}
+		d.Targeted++
+		if msg.QoS == qosAtLeastOnce {
+			tracked = append(tracked, c)
+		}
+		if msg.Priority == priorityBulk && bulkBacklog(c) {
+			d.Skipped++
+			continue
+		}
+		msg.queued()
+		if c.queue.push(msg) {
+			d.Delivered++
+			c.skipped.Store(0)
+		} else {
+			d.Skipped++
+			msg.written()
+			c.skippedMessage()
+		}
+	}
+	if len(tracked) > 0 {
+		r.hub.mu.Lock()
+		for _, c := range tracked {
+			r.hub.track(c, msg)
+		}
+		r.hub.mu.Unlock()
+	}
+	return d
+}
+
+// seqBlock is how many sequence numbers rooms reserve in the store at a
+// time. Those left unused when the server stops are skipped.
+const seqBlock = 1000
+
+// reserveSeqs reserves more sequence numbers in the store when those
+// reserved ran out, so they keep going up across restarts and readers'
+// markers stay valid. It runs on the room goroutine, the only one changing
+// seq and seqLimit once the room runs, so it reads them without r.mu.
+func (r *room) reserveSeqs() {
+	if r.seq < r.seqLimit {
+		return
+	}
+	limit, err := dataStore().ReserveSeqs(context.Background(), r.hub.storeKey(r.name), seqBlock)
+	if err != nil {
+		// Numbers go on from memory, and are reserved again next time.
+		log.Println("Cannot reserve sequence numbers:", err)
+		return
+	}
+	r.mu.Lock()
+	if r.seq < limit-seqBlock {
+		r.seq = limit - seqBlock
+	}
+	r.seqLimit = limit
+	r.mu.Unlock()
+}
+
+// remember and retain are called with r.mu held.
+func (r *room) remember(msg *Message) {
+	limit := r.hub.historyLimit()
+	r.history = append(r.history, msg)
+	if len(r.history) > limit {
+		r.history = r.history[len(r.history)-limit:]
+	}
+}
+
+// save saves msg to the history in the store, which backfills read from:
+// it outlives the room. It runs on the room goroutine, so messages are
+// saved in order.
+func (r *room) save(msg *Message) {
+	if err := dataStore().SaveMessage(context.Background(), r.hub.storeKey(r.name), msg, r.hub.historyLimit()); err != nil {
+		log.Printf("Cannot save message %s of room %s: %v", msg.ID, r.name, err)
+	}
+}
+
+func (r *room) retain(msg *Message) {
+	if !msg.Retain || r.name == "" {
+		msg.Retain = false
+		return
+	}
+	if msg.Body == "" {
+		r.retained = nil
+	} else {
+		r.retained = msg
+	}
+}
+
+// welcome adds client to the members and queues the pins and retained
+// message for it.
+func (r *room) welcome(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.members[client] {
+		r.accrue(time.Now())
+		r.members[client] = true
+		r.updateSnapshot()
+		roomMembers.WithLabelValues(r.hub.tenant, r.label).Inc()
+		r.notifyPresence(presenceJoin, client)
+		r.sendPresence(client)
+		r.greet(client)
+	}
+	r.sendPins(client)
+	if r.retained != nil {
+		client.queue.push(r.retained)
+	}
+}
+
+// greet queues the room greeting for client, which just joined. It is
+// called with r.mu held.
+func (r *room) greet(client *Client) {
+	if r.name == "" {
+		return
+	}
+	s := liveSettings()
+	if msg := s.greeting(s.roomWelcome, client, r.name, len(r.members)); msg != nil {
+		client.queue.push(msg)
+	}
+}
+
+func (r *room) remove(client *Client) {
+	r.mu.Lock()
+	if r.members[client] {
+		r.accrue(time.Now())
+		delete(r.members, client)
+		r.updateSnapshot()
+		roomMembers.WithLabelValues(r.hub.tenant, r.label).Dec()
+		r.notifyPresence(presenceLeave, client)
+		if r.speaker == client {
+			r.setSpeaker(nil, time.Now())
+		}
+	}
+	r.mu.Unlock()
+}
+
+// updateSnapshot is called with r.mu held after members changed.
+func (r *room) updateSnapshot() {
+	members := make([]*Client, 0, len(r.members))
+	for c := range r.members {
+		members = append(members, c)
+	}
+	r.snapshot.Store(&members)
+}
+
+// room returns the room named name, creating it if needed. It is called
+// with the hub lock held.
+func (h *Hub) room(name string) *room {
+	r := h.rooms[name]
+	if r == nil {
+		r = newRoom(h, name)
+		if old, ok := h.retired[name]; ok {
+			r.seq, r.seqLimit, r.since, r.memberTime = old.seq, old.seqLimit, old.since, old.memberTime
+			r.messages.Store(old.messages)
+			r.bytes.Store(old.bytes)
+			delete(h.retired, name)
+		}
+		h.rooms[name] = r
+	}
+	return r
+}
+
+// broadcastRoom returns the room called name for broadcasting msgs to,
+// held until release, or nil when there is no such room and nobody would
+// receive or keep them: rooms are not created only for messages to pass
+// through. It is called with the hub lock held.
+func (h *Hub) broadcastRoom(name string, msgs ...*Message) *room {
+	r := h.rooms[name]
+	if r == nil {
+		keep := replication.count.Load() > 0 || len(h.patternSubscribers(name, nil)) > 0
+		for _, msg := range msgs {
+			keep = keep || (msg.Retain && msg.Body != "")
+		}
+		if !keep {
+			return nil
+		}
+		r = h.room(name)
+	}
+	r.broadcasts.Add(1)
+	return r
+}
+
+// release lets go of r once a broadcast to it is delivered.
+func (h *Hub) release(r *room) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r.broadcasts.Add(-1)
+	h.reclaim(r)
+}
+
+// reclaim stops r and forgets it once it has no members, nothing to show
+// those joining and no broadcasts underway, so rooms that emptied do not
+// pile up. Its history goes with it. It is called with the hub lock held.
+func (h *Hub) reclaim(r *room) {
+	if r.name == "" || h.rooms[r.name] != r || r.broadcasts.Load() > 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.members) > 0 || len(r.pins) > 0 || r.retained != nil || r.speaker != nil {
+		return
+	}
+	now := time.Now()
+	r.accrue(now)
+	h.retire(r.name, retiredRoom{at: now, since: r.since, seq: r.seq, seqLimit: r.seqLimit, memberTime: r.memberTime, messages: r.messages.Load(), bytes: r.bytes.Load()}, now)
+	delete(h.rooms, r.name)
+	close(r.jobs)
+}
+
+const (
+	// retiredTTL is how long what is kept of a reclaimed room stays, and
+	// maxRetired how many rooms at most it is kept for. Rooms created
+	// again after that take up their sequence numbers from the store,
+	// skipping those reserved and not given out.
+	retiredTTL = time.Hour
+	maxRetired = 10000
+)
+
+// evictedRooms names the usage record adding up the rooms no longer kept
+// as retired. No room can have this name, it is a wildcard.
+const evictedRooms = "#"
+
+// retire keeps old for the room called name. Rooms retired past retiredTTL
+// are dropped once a minute, and a quarter of them when there are more
+// than maxRetired, their usage added to h.evicted. It is called with the
+// hub lock held.
+func (h *Hub) retire(name string, old retiredRoom, now time.Time) {
+	h.retired[name] = old
+	if h.retiredSweep.due(now, time.Minute) {
+		for name, old := range h.retired {
+			if now.Sub(old.at) > retiredTTL {
+				h.evict(name, old)
+			}
+		}
+	}
+	if len(h.retired) > maxRetired {
+		for name, old := range h.retired {
+			if len(h.retired) <= maxRetired*3/4 {
+				break
+			}
+			h.evict(name, old)
+		}
+	}
+}
+
+// evict forgets the retired room called name, counting its usage in
+// h.evicted. It is called with the hub lock held.
+func (h *Hub) evict(name string, old retiredRoom) {
+	h.evicted.memberTime += old.memberTime
+	h.evicted.messages += old.messages
+	h.evicted.bytes += old.bytes
+	delete(h.retired, name)
+}
+
+// existingRoom returns the room named name, or nil if there is none yet.
+func (h *Hub) existingRoom(name string) *room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.rooms[name]
+}
+
+// patternSubscribers returns the clients that joined a pattern covering
+// topic, leaving out those in skip.
+func (h *Hub) patternSubscribers(topic string, skip []*Client) []*Client {
+	patterns := *h.patternSnapshot.Load()
+	if len(patterns) == 0 {
+		return nil
+	}
+	var seen map[*Client]bool
+	var found []*Client
+	for pattern, clients := range patterns {
+		if !topicMatches(pattern, topic) {
+			continue
+		}
+		if seen == nil {
+			seen = make(map[*Client]bool, len(skip))
+			for _, c := range skip {
+				seen[c] = true
+			}
+		}
+		for _, c := range clients {
+			if !seen[c] {
+				seen[c] = true
+				found = append(found, c)
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// roomNodeHeader is the websocket handshake response header naming, for
+// each room given as a room query parameter, the node owning it, as
+// room=URL.
+const roomNodeHeader = "X-Room-Node"
+
+// roomNode is what GET /rooms/{room}/node returns. Node is the websocket
+// URL of the node owning the room, empty when not clustered; Local says
+// whether it is the node asked.
+type roomNode struct {
+	Room  string `json:"room"`
+	Node  string `json:"node,omitempty"`
+	Local bool   `json:"local"`
+}
+
+// nodeWebsocketURL turns the /replication URL of a node, as listed in the
+// cluster, into the URL clients connect to.
+func nodeWebsocketURL(node string) string {
+	return strings.TrimSuffix(node, "/replication") + "/ws"
+}
+
+// roomNodeOf returns where clients of h in room are best connected.
+func (h *Hub) roomNodeOf(room string) roomNode {
+	rn := roomNode{Room: room, Local: true}
+	r := ring.Load()
+	if r == nil {
+		return rn
+	}
+	owner := r.owner(h.storeKey(room))
+	rn.Node, rn.Local = nodeWebsocketURL(owner), owner == *clusterSelf
+	return rn
+}
+
+// roomNodeHandler serves GET /rooms/{room}/node, so smart clients and load
+// balancers can connect to the node owning the room, whose deliveries do
+// not take a detour.
+func roomNodeHandler(w http.ResponseWriter, r *http.Request, room string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hubFor(r).roomNodeOf(room))
+}
+
+// addRoomNodes answers a websocket handshake with the owners of the rooms
+// the client says it is going to join.
+func addRoomNodes(config *websocket.Config, req *http.Request) {
+	if !clustered() {
+		return
+	}
+	h := hubFor(req)
+	for _, room := range req.URL.Query()["room"] {
+		if room == "" || hasWildcard(room) {
+			continue
+		}
+		if config.Header == nil {
+			config.Header = make(http.Header)
+		}
+		config.Header.Add(roomNodeHeader, room+"="+h.roomNodeOf(room).Node)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+)
+
+var rulesFile = flag.String("rules", "", "JSON file of the rules applied, in order, to what clients send, e.g. [{\"room\": \"support\", \"match\": \"(?i)refund\", \"action\": \"route\", \"to\": \"billing\"}]; a rule matching room, author, body regexp and client selectors, all optional, can drop, route, tag, annotate or post the message to a webhook")
+
+// Rule actions.
+const (
+	ruleDrop     = "drop"
+	ruleRoute    = "route"
+	ruleTag      = "tag"
+	ruleAnnotate = "annotate"
+	ruleWebhook  = "webhook"
+)
+
+// rule acts on the messages clients send that it matches. Room may be a
+// wildcard pattern, Client holds selector criteria such as device=mobile.
+type rule struct {
+	Room   string   `json:"room"`
+	Author string   `json:"author"`
+	Match  string   `json:"match"`
+	Client []string `json:"client"`
+
+	Action string `json:"action"`
+	// To is the room route sends the message to instead.
+	To string `json:"to"`
+	// Tag is added by tag, Key and Value by annotate.
+	Tag   string `json:"tag"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// URL is where webhook posts the message, leaving it otherwise be.
+	URL string `json:"url"`
+
+	match  *regexp.Regexp
+	client selector
+}
+
+var rules []*rule
+
+// rulesHTTP posts messages to the webhooks of rules.
+var rulesHTTP = &http.Client{Timeout: 10 * time.Second}
+
+// ruleWebhookWorkers post the messages queued in ruleWebhooks, which holds
+// up to ruleWebhookBuffer of them: those coming when it is full are
+// dropped, so slow webhooks cannot pile up goroutines.
+const (
+	ruleWebhookWorkers = 4
+	ruleWebhookBuffer  = 1000
+)
+
+// ruleWebhookPost is a message in JSON for the webhook at url.
+type ruleWebhookPost struct {
+	url  string
+	body []byte
+}
+
+var ruleWebhooks = make(chan ruleWebhookPost, ruleWebhookBuffer)
+
+func loadRules() {
+	if *rulesFile == "" {
+		return
+	}
+	data, err := os.ReadFile(*rulesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		log.Fatalf("invalid rules %s: %v", *rulesFile, err)
+	}
+	for i, r := range rules {
+		if err := r.compile(); err != nil {
+			log.Fatalf("invalid rule %d in %s: %v", i, *rulesFile, err)
+		}
+	}
+	for range ruleWebhookWorkers {
+		go func() {
+			for p := range ruleWebhooks {
+				postToRuleWebhook(p.url, p.body)
+			}
+		}()
+	}
+	log.Println("Loaded", len(rules), "rules")
+}
+
+func (r *rule) compile() error {
+	if r.Room != "" && !validPattern(r.Room) {
+		return fmt.Errorf("invalid room %q", r.Room)
+	}
+	if r.Match != "" {
+		m, err := regexp.Compile(r.Match)
+		if err != nil {
+			return err
+		}
+		r.match = m
+	}
+	sel, err := parseSelector(r.Client)
+	if err != nil {
+		return err
+	}
+	r.client = sel
+
+	switch r.Action {
+	case ruleDrop:
+	case ruleRoute:
+		if r.To == "" || hasWildcard(r.To) || !validPattern(r.To) {
+			return fmt.Errorf("route needs a room to, not %q", r.To)
+		}
+	case ruleTag:
+		if r.Tag == "" {
+			return errors.New("tag needs a tag")
+		}
+	case ruleAnnotate:
+		if r.Key == "" {
+			return errors.New("annotate needs a key")
+		}
+	case ruleWebhook:
+		if r.URL == "" {
+			return errors.New("webhook needs a url")
+		}
+	default:
+		return fmt.Errorf("unknown action %q, expected drop, route, tag, annotate or webhook", r.Action)
+	}
+	return nil
+}
+
+// matches reports whether r applies to msg from c. Bodies of encrypted
+// rooms are never matched.
+func (r *rule) matches(c *Client, msg *Message) bool {
+	if r.Room != "" && !topicMatches(r.Room, msg.Room) {
+		return false
+	}
+	if r.Author != "" && r.Author != msg.Author {
+		return false
+	}
+	if r.match != nil && (encryptedRoom(msg.Room) || !r.match.MatchString(msg.Body)) {
+		return false
+	}
+	return c.matches(r.client)
+}
+
+// applyRules runs the rules on msg from c, in order, and reports whether
+// the message is still to be broadcast. Later rules see what earlier ones
+// did, such as a new room.
+func applyRules(c *Client, msg *Message) bool {
+	for _, r := range rules {
+		if !r.matches(c, msg) {
+			continue
+		}
+		switch r.Action {
+		case ruleDrop:
+			debugf("Rule dropped message from %s to room %s", msg.Author, msg.Room)
+			return false
+		case ruleRoute:
+			msg.Room = r.To
+		case ruleTag:
+			if !slices.Contains(msg.Tags, r.Tag) {
+				msg.Tags = append(msg.Tags, r.Tag)
+			}
+		case ruleAnnotate:
+			if msg.Notes == nil {
+				msg.Notes = make(map[string]string)
+			}
+			msg.Notes[r.Key] = r.Value
+		case ruleWebhook:
+			body, err := json.Marshal(msg)
+			if err != nil {
+				log.Println("Cannot encode message for rule webhook:", err)
+				continue
+			}
+			select {
+			case ruleWebhooks <- ruleWebhookPost{r.URL, body}:
+			default:
+				log.Printf("Rule webhook %s too far behind, dropping message to room %s", r.URL, msg.Room)
+			}
+		}
+	}
+	return true
+}
+
+// postToRuleWebhook posts body, a message in JSON, to url. Failures are
+// logged.
+func postToRuleWebhook(url string, body []byte) {
+	resp, err := rulesHTTP.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("Rule webhook failed:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Rule webhook %s answered %s", url, resp.Status)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"html"
+	"log"
+	"sync"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+var sanitizeMode = flag.String("sanitize", "none", "how to make message bodies safe for clients rendering them as HTML: none, escape (all markup shown as text), strip (markup removed), ugc (safe formatting kept)")
+
+// htmlSanitizer is the ContentFilter applying -sanitize to the author and
+// body of messages, and the title and description of link previews, see
+// sanitize.
+type htmlSanitizer struct {
+	clean func(string) string
+}
+
+func (s htmlSanitizer) Filter(msg *Message) error {
+	msg.Author = s.clean(msg.Author)
+	msg.Body = s.clean(msg.Body)
+	if msg.Preview != nil {
+		// Previews are shared through the cache, see preview.
+		p := *msg.Preview
+		p.Title = s.clean(p.Title)
+		p.Description = s.clean(p.Description)
+		msg.Preview = &p
+	}
+	return nil
+}
+
+// newSanitizer returns the filter for -sanitize, or nil when disabled.
+func newSanitizer() *htmlSanitizer {
+	switch *sanitizeMode {
+	case "none":
+		return nil
+	case "escape":
+		return &htmlSanitizer{html.EscapeString}
+	case "strip":
+		return &htmlSanitizer{bluemonday.StrictPolicy().Sanitize}
+	case "ugc":
+		return &htmlSanitizer{bluemonday.UGCPolicy().Sanitize}
+	}
+	log.Fatalf("invalid -sanitize %q, expected none, escape, strip or ugc", *sanitizeMode)
+	return nil
+}
+
+var (
+	sanitizerOnce sync.Once
+	sanitizer     *htmlSanitizer
+)
+
+func loadSanitizer() {
+	sanitizer = newSanitizer()
+}
+
+// sanitize applies -sanitize to msg, unless its room is end-to-end
+// encrypted or has content filters disabled. Every broadcast goes through
+// it, see Hub.prepare, whether a client, an HTTP caller, an integration or
+// the server sent it.
+func sanitize(msg *Message) {
+	if !filteredRoom(msg.Room) {
+		return
+	}
+	sanitizerOnce.Do(loadSanitizer)
+	if sanitizer != nil {
+		sanitizer.Filter(msg)
+	}
+}
+
+// sanitizeText applies -sanitize to s, which is shown along messages in
+// every room, such as users' display names and status.
+func sanitizeText(s string) string {
+	sanitizerOnce.Do(loadSanitizer)
+	if sanitizer == nil {
+		return s
+	}
+	return sanitizer.clean(s)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// typeSchedule asks for the message to be delivered at the time in At
+	// instead of right away.
+	typeSchedule = "schedule"
+	// typeScheduled answers a schedule request with the ID of the
+	// delivery in Ref.
+	typeScheduled = "scheduled"
+	// typeUnschedule cancels the scheduled delivery whose ID is in Ref.
+	typeUnschedule = "unschedule"
+)
+
+const (
+	maxScheduleDelay = 30 * 24 * time.Hour
+	// maxScheduledPerOwner caps the deliveries anyone has waiting.
+	maxScheduledPerOwner = 100
+)
+
+// scheduledMessage waits in the store until it is due.
+type scheduledMessage struct {
+	ID     string    `json:"id"`
+	At     time.Time `json:"at"`
+	Tenant string    `json:"tenant,omitempty"`
+	// Owner scheduled the message, and alone may cancel it: the reader
+	// name of a client or the requestActor of an HTTP caller.
+	Owner string  `json:"owner,omitempty"`
+	Msg   Message `json:"msg"`
+}
+
+var (
+	errBadDeliveryTime  = &validationError{"delivery time must be in the future and at most 30 days away"}
+	errTooManyScheduled = clientErrorf(codeQuota, "at most %d messages can be scheduled at once", maxScheduledPerOwner)
+	errNoScheduled      = &clientError{codeInvalid, "no such scheduled message"}
+)
+
+func checkDeliveryTime(at time.Time) error {
+	if d := time.Until(at); d <= 0 || d > maxScheduleDelay {
+		return errBadDeliveryTime
+	}
+	return nil
+}
+
+// timers holds the pending deliveries of this process, so a message is not
+// set up twice when restoring.
+var timers = struct {
+	sync.Mutex
+	byID map[string]*time.Timer
+}{byID: make(map[string]*time.Timer)}
+
+// scheduleMessage stores msg and broadcasts it through h at the given time,
+// on behalf of owner. It returns the ID of the scheduled delivery.
+func (h *Hub) scheduleMessage(msg *Message, at time.Time, owner string) (string, error) {
+	if msg.Select != nil {
+		// Selectors are not stored, and the message must not reach
+		// everyone after a restart.
+		return "", errors.New("targeted messages cannot be scheduled")
+	}
+	pending, err := dataStore().ScheduledMessages(context.Background())
+	if err != nil {
+		return "", err
+	}
+	waiting := 0
+	for _, s := range pending {
+		if s.Tenant == h.tenant && s.Owner == owner {
+			waiting++
+		}
+	}
+	if waiting >= maxScheduledPerOwner {
+		return "", errTooManyScheduled
+	}
+
+	s := scheduledMessage{ID: newMessageID(), At: at, Tenant: h.tenant, Owner: owner, Msg: *msg}
+	if err := dataStore().SaveScheduled(context.Background(), &s); err != nil {
+		return "", err
+	}
+	if leading() {
+		startTimer(s)
+	}
+	log.Printf("Scheduled message %s for %s", s.ID, at.Format(time.RFC3339))
+	return s.ID, nil
+}
+
+// startTimer sets up the delivery of s, unless it already was, and
+// reports whether it did.
+func startTimer(s scheduledMessage) bool {
+	timers.Lock()
+	defer timers.Unlock()
+
+	if timers.byID[s.ID] != nil {
+		return false
+	}
+	timers.byID[s.ID] = time.AfterFunc(time.Until(s.At), func() {
+		timers.Lock()
+		delete(timers.byID, s.ID)
+		timers.Unlock()
+
+		// A leader that lost its lease leaves the message to the next.
+		if !leading() {
+			return
+		}
+		// Only the instance that removes the message from a shared store
+		// delivers it.
+		ok, err := dataStore().DeleteScheduled(context.Background(), s.ID)
+		if err != nil {
+			log.Println("Cannot deliver scheduled message:", err)
+			return
+		}
+		if !ok {
+			return
+		}
+		h := tenantHub(s.Tenant)
+		if h == nil {
+			log.Printf("Dropping scheduled message %s of unknown tenant %s", s.ID, s.Tenant)
+			return
+		}
+		msg := s.Msg
+		// Latency is measured from the delivery time.
+		msg.received = time.Now()
+		h.broadcast(&msg)
+	})
+	return true
+}
+
+// unschedule cancels the delivery with id that owner scheduled.
+func (h *Hub) unschedule(id, owner string) error {
+	n, err := purgeScheduled(context.Background(), func(s *scheduledMessage) bool {
+		return s.ID == id && s.Tenant == h.tenant && s.Owner == owner
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNoScheduled
+	}
+	log.Printf("Cancelled scheduled message %s", id)
+	return nil
+}
+
+// purgeScheduled cancels the scheduled deliveries match selects, such as
+// those of erased or banned users, and returns how many there were.
+func purgeScheduled(ctx context.Context, match func(*scheduledMessage) bool) (int, error) {
+	pending, err := dataStore().ScheduledMessages(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range pending {
+		s := &pending[i]
+		if !match(s) {
+			continue
+		}
+		timers.Lock()
+		if t := timers.byID[s.ID]; t != nil {
+			t.Stop()
+			delete(timers.byID, s.ID)
+		}
+		timers.Unlock()
+		// Another instance may deliver it meanwhile, then it is gone.
+		if ok, err := dataStore().DeleteScheduled(ctx, s.ID); err != nil {
+			return n, err
+		} else if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// restoreScheduled sets up delivery of the messages scheduled before a
+// restart, or through other instances, on the leader. Overdue ones are
+// sent right away.
+func restoreScheduled() {
+	if !leading() {
+		return
+	}
+	pending, err := dataStore().ScheduledMessages(context.Background())
+	if err != nil {
+		log.Println("Cannot restore scheduled messages:", err)
+		return
+	}
+	restored := 0
+	for _, s := range pending {
+		if startTimer(s) {
+			restored++
+		}
+	}
+	if restored > 0 {
+		log.Printf("Restored %d scheduled messages", restored)
+	}
+}
+
+// requestedDeliveryTime reads when an HTTP broadcast is to be delivered,
+// from an at parameter in RFC 3339 format or a delay such as 90s. It is
+// zero for immediate delivery.
+func requestedDeliveryTime(r *http.Request) (time.Time, error) {
+	q := r.URL.Query()
+	switch {
+	case q.Get("at") != "":
+		at, err := time.Parse(time.RFC3339, q.Get("at"))
+		if err != nil {
+			return at, &validationError{"invalid at, expected RFC 3339 time"}
+		}
+		return at, checkDeliveryTime(at)
+	case q.Get("delay") != "":
+		d, err := time.ParseDuration(q.Get("delay"))
+		if err != nil {
+			return time.Time{}, &validationError{"invalid delay"}
+		}
+		at := time.Now().Add(d)
+		return at, checkDeliveryTime(at)
+	}
+	return time.Time{}, nil
+}
+
+// scheduleFromRequest schedules msg for delivery at at and answers with
+// 202 Accepted and the ID of the delivery.
+func scheduleFromRequest(w http.ResponseWriter, r *http.Request, msg *Message, at time.Time) {
+	id, err := hubFor(r).scheduleMessage(msg, at, requestActor(r))
+	if err == errTooManyScheduled {
+		httpError(w, r, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"scheduled": id, "at": at})
+}
+
+// unscheduleHandler serves DELETE /broadcast/scheduled/{id}, cancelling a
+// delivery the caller scheduled.
+func unscheduleHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch err := hubFor(r).unschedule(id, requestActor(r)); {
+	case err == errNoScheduled:
+		httpError(w, r, "Not found", http.StatusNotFound)
+	case err != nil:
+		log.Println("Cannot cancel scheduled message:", err)
+		httpError(w, r, "Internal server error", http.StatusInternalServerError)
+	default:
+		auditAction(requestActor(r), "unschedule", "", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
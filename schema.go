@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+var schemaDir = flag.String("schema-dir", "", "directory of JSON Schemas named <type>.json that inbound chat.v2.json envelopes of that type must match")
+
+// validationError is returned by codecs for frames the client should be
+// told about rather than have silently dropped. It is sent as an error
+// event with the invalid code.
+type validationError struct {
+	msg string
+}
+
+func (e *validationError) Error() string {
+	return e.msg
+}
+
+var (
+	schemasOnce sync.Once
+	schemas     map[string]*jsonschema.Schema
+)
+
+func loadSchemas() map[string]*jsonschema.Schema {
+	schemasOnce.Do(func() {
+		if *schemaDir == "" {
+			return
+		}
+		files, err := filepath.Glob(filepath.Join(*schemaDir, "*.json"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		schemas = make(map[string]*jsonschema.Schema)
+		compiler := jsonschema.NewCompiler()
+		for _, file := range files {
+			s, err := compiler.Compile(file)
+			if err != nil {
+				log.Fatal(err)
+			}
+			schemas[strings.TrimSuffix(filepath.Base(file), ".json")] = s
+		}
+	})
+	return schemas
+}
+
+// validateEnvelope checks data against the schema registered for typ, if
+// there is one.
+func validateEnvelope(data []byte, typ string) error {
+	schema := loadSchemas()[typ]
+	if schema == nil {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return &validationError{err.Error()}
+	}
+	if err := schema.Validate(v); err != nil {
+		return &validationError{err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var (
+	scriptFile    = flag.String("script", "", "Lua file defining on_connect(client) and on_message(msg) hooks, called in a sandbox when clients connect and send; hooks may change the message, return false or a reason to reject, and emit(room, body) server messages")
+	scriptTimeout = flag.Duration("script-timeout", 50*time.Millisecond, "how long a script hook may run before it is stopped and what it was called for rejected")
+)
+
+// script runs the hooks of -script. Lua states are not safe for concurrent
+// use, so hooks run one at a time.
+var script struct {
+	sync.Mutex
+	L *lua.LState
+	// emitted collects the messages a hook emits, broadcast once it is
+	// done.
+	emitted []*Message
+}
+
+var errScriptFailed = clientErrorf(codeInternal, "script failed")
+
+// loadScript compiles -script into a state with only the base, string,
+// table and math libraries, without access to files or other modules.
+func loadScript() {
+	if *scriptFile == "" {
+		return
+	}
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("emit", L.NewFunction(luaEmit))
+	if err := L.DoFile(*scriptFile); err != nil {
+		log.Fatalf("invalid script %s: %v", *scriptFile, err)
+	}
+	script.L = L
+	log.Println("Loaded script", *scriptFile)
+}
+
+// luaEmit is emit(room, body), queueing a server message.
+func luaEmit(L *lua.LState) int {
+	script.emitted = append(script.emitted, &Message{Author: "Server", Room: L.CheckString(1), Body: L.CheckString(2)})
+	return 0
+}
+
+// callHook calls the hook called name, if the script defines it, with arg
+// and returns an error if it failed or rejected what it was called for.
+// Otherwise read, if set, is called while arg cannot change. Messages it
+// emitted are broadcast through h.
+func callHook(h *Hub, name string, arg *lua.LTable, read func()) error {
+	script.Lock()
+	fn := script.L.GetGlobal(name)
+	if fn.Type() != lua.LTFunction {
+		script.Unlock()
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *scriptTimeout)
+	defer cancel()
+	script.L.SetContext(ctx)
+	err := script.L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, arg)
+	var ret lua.LValue = lua.LNil
+	if err == nil {
+		ret = script.L.Get(-1)
+		script.L.Pop(1)
+		if read != nil && ret != lua.LFalse && ret.Type() != lua.LTString {
+			read()
+		}
+	}
+	script.L.RemoveContext()
+	emitted := script.emitted
+	script.emitted = nil
+	script.Unlock()
+
+	if err != nil {
+		log.Printf("Script hook %s failed: %v", name, err)
+		return errScriptFailed
+	}
+	for _, msg := range emitted {
+		if validPattern(msg.Room) && !hasWildcard(msg.Room) {
+			h.broadcast(msg)
+		}
+	}
+	switch ret.Type() {
+	case lua.LTBool:
+		if ret == lua.LFalse {
+			return &clientError{codeFiltered, "rejected"}
+		}
+	case lua.LTString:
+		return &clientError{codeFiltered, ret.String()}
+	}
+	return nil
+}
+
+// scriptConnect runs the on_connect hook for client, which may refuse it.
+func scriptConnect(client *Client) error {
+	if script.L == nil {
+		return nil
+	}
+	t := &lua.LTable{}
+	t.RawSetString("nick", lua.LString(client.nick))
+	t.RawSetString("identity", lua.LString(client.identity))
+	t.RawSetString("role", lua.LString(client.role))
+	t.RawSetString("addr", lua.LString(client.addr))
+	t.RawSetString("tenant", lua.LString(client.hub.tenant))
+	meta := &lua.LTable{}
+	for key, values := range client.meta {
+		if len(values) > 0 {
+			meta.RawSetString(key, lua.LString(values[0]))
+		}
+	}
+	t.RawSetString("meta", meta)
+	return callHook(client.hub, "on_connect", t, nil)
+}
+
+// scriptMessage runs the on_message hook for msg from c. The hook may
+// change its body and room, and add tags and notes, or reject it.
+func scriptMessage(c *Client, msg *Message) error {
+	if script.L == nil {
+		return nil
+	}
+	t := &lua.LTable{}
+	t.RawSetString("type", lua.LString(msg.Type))
+	t.RawSetString("author", lua.LString(msg.Author))
+	t.RawSetString("body", lua.LString(msg.Body))
+	t.RawSetString("room", lua.LString(msg.Room))
+	tags := &lua.LTable{}
+	for _, tag := range msg.Tags {
+		tags.Append(lua.LString(tag))
+	}
+	t.RawSetString("tags", tags)
+	notes := &lua.LTable{}
+	for k, v := range msg.Notes {
+		notes.RawSetString(k, lua.LString(v))
+	}
+	t.RawSetString("notes", notes)
+	var err error
+	read := func() {
+		if body, ok := t.RawGetString("body").(lua.LString); ok {
+			msg.Body = string(body)
+		}
+		if room, ok := t.RawGetString("room").(lua.LString); ok {
+			if string(room) != msg.Room && (!validPattern(string(room)) || hasWildcard(string(room))) {
+				err = &validationError{"script sent the message to an invalid room"}
+				return
+			}
+			msg.Room = string(room)
+		}
+		msg.Tags = nil
+		if tags, ok := t.RawGetString("tags").(*lua.LTable); ok {
+			tags.ForEach(func(_, v lua.LValue) {
+				if s, ok := v.(lua.LString); ok {
+					msg.Tags = append(msg.Tags, string(s))
+				}
+			})
+		}
+		msg.Notes = nil
+		if notes, ok := t.RawGetString("notes").(*lua.LTable); ok {
+			notes.ForEach(func(k, v lua.LValue) {
+				ks, kok := k.(lua.LString)
+				vs, vok := v.(lua.LString)
+				if kok && vok {
+					if msg.Notes == nil {
+						msg.Notes = make(map[string]string)
+					}
+					msg.Notes[string(ks)] = string(vs)
+				}
+			})
+		}
+	}
+	if hookErr := callHook(c.hub, "on_message", t, read); hookErr != nil {
+		return hookErr
+	}
+	return err
+}
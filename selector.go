@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// selector limits a broadcast to clients whose metadata matches all of its
+// criteria, written as key=value: role, nick and identity match those of
+// the client, any other key one of the values it announced when
+// connecting, see clientMeta, e.g. tag=beta from /ws?tag=beta or
+// device=mobile from an X-Device-Type: mobile header.
+type selector []criterion
+
+type criterion struct {
+	key, value string
+}
+
+func parseSelector(specs []string) (selector, error) {
+	var sel selector
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid selector %q, expected key=value", spec)
+		}
+		sel = append(sel, criterion{key, value})
+	}
+	return sel, nil
+}
+
+func (c *Client) matches(sel selector) bool {
+	for _, cr := range sel {
+		var ok bool
+		switch cr.key {
+		case "role":
+			ok = c.role == cr.value
+		case "nick":
+			ok = strings.EqualFold(c.nick, cr.value)
+		case "identity":
+			ok = c.identity == cr.value
+		default:
+			for _, v := range c.meta[cr.key] {
+				if v == cr.value {
+					ok = true
+					break
+				}
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package main
+
+import "sync"
+
+// Lanes of a send queue, from the first written to the last.
+const (
+	laneUrgent = iota
+	laneSystem
+	laneNormal
+	laneBulk
+	numLanes
+)
+
+// lane picks the lane for msg by its priority. Messages without one go to
+// the normal lane if they are chat, and to the system lane if they tell
+// clients about the server or the room, such as presence and receipts.
+func lane(msg *Message) int {
+	switch msg.Priority {
+	case priorityUrgent:
+		return laneUrgent
+	case prioritySystem:
+		return laneSystem
+	case priorityBulk:
+		return laneBulk
+	}
+	switch msg.Type {
+	case "", typeMessage, typeReaction:
+		return laneNormal
+	}
+	return laneSystem
+}
+
+// sendQueue holds the messages broadcast to a client until its writer gets
+// to them, higher priority lanes first, so urgent and control messages are
+// not stuck behind a backlog of chat. When the queue is full, messages make
+// room by dropping the oldest of a lower lane, or are refused.
+type sendQueue struct {
+	mu    sync.Mutex
+	lanes [numLanes][]*Message
+	size  int
+	limit int
+	// ready is signalled whenever a message is queued.
+	ready chan struct{}
+}
+
+func newSendQueue(limit int) *sendQueue {
+	return &sendQueue{limit: limit, ready: make(chan struct{}, 1)}
+}
+
+// push queues msg unless the queue is full of messages as important, and
+// reports whether it did.
+func (q *sendQueue) push(msg *Message) bool {
+	l := lane(msg)
+
+	q.mu.Lock()
+	if q.size >= q.limit && !q.dropBelow(l) {
+		q.mu.Unlock()
+		return false
+	}
+	q.add(l, msg)
+	q.mu.Unlock()
+	return true
+}
+
+// put queues msg even when the queue is full, for the few messages that
+// are answers the client asked for or must not miss.
+func (q *sendQueue) put(msg *Message) {
+	q.mu.Lock()
+	q.add(lane(msg), msg)
+	q.mu.Unlock()
+}
+
+func (q *sendQueue) add(l int, msg *Message) {
+	q.lanes[l] = append(q.lanes[l], msg)
+	q.size++
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// dropBelow drops the oldest message of the lowest lane after l that has
+// any, and reports whether there was one. It is called with q.mu held.
+func (q *sendQueue) dropBelow(l int) bool {
+	for low := numLanes - 1; low > l; low-- {
+		if len(q.lanes[low]) > 0 {
+			dropped := q.lanes[low][0]
+			q.lanes[low][0] = nil
+			q.lanes[low] = q.lanes[low][1:]
+			q.size--
+			dropped.written()
+			return true
+		}
+	}
+	return false
+}
+
+// pop takes the next message to write, or returns nil when there is none.
+func (q *sendQueue) pop() *Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for l := range q.lanes {
+		if len(q.lanes[l]) > 0 {
+			msg := q.lanes[l][0]
+			q.lanes[l][0] = nil
+			q.lanes[l] = q.lanes[l][1:]
+			q.size--
+			return msg
+		}
+	}
+	return nil
+}
+
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.size
+}
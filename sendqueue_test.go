@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestSendQueuePushRespectsLimit(t *testing.T) {
+	q := newSendQueue(2)
+	a, b := &Message{Body: "a"}, &Message{Body: "b"}
+	if !q.push(a) || !q.push(b) {
+		t.Fatal("push refused below the limit")
+	}
+	if q.push(&Message{Body: "c"}) {
+		t.Error("push accepted past the limit")
+	}
+	if q.len() != 2 {
+		t.Errorf("queue has %d messages, want 2", q.len())
+	}
+	if got := q.pop(); got != a {
+		t.Errorf("popped %v, want the oldest", got)
+	}
+}
+
+func TestSendQueueDropsLowerLanesWhenFull(t *testing.T) {
+	q := newSendQueue(2)
+	bulk := &Message{Body: "bulk", Priority: priorityBulk}
+	chat := &Message{Body: "chat"}
+	q.push(bulk)
+	q.push(chat)
+
+	urgent := &Message{Body: "urgent", Priority: priorityUrgent}
+	if !q.push(urgent) {
+		t.Fatal("urgent message refused with bulk queued")
+	}
+	if q.len() != 2 {
+		t.Errorf("queue has %d messages, want 2", q.len())
+	}
+	for _, want := range []*Message{urgent, chat} {
+		if got := q.pop(); got != want {
+			t.Errorf("popped %v, want %v", got, want)
+		}
+	}
+	if got := q.pop(); got != nil {
+		t.Errorf("popped %v from an empty queue", got)
+	}
+
+	// Messages never make room by dropping more important ones.
+	q.push(urgent)
+	q.push(urgent)
+	if q.push(&Message{Body: "chat"}) {
+		t.Error("chat accepted into a queue full of urgent messages")
+	}
+}
+
+func TestSendQueuePutIgnoresLimit(t *testing.T) {
+	q := newSendQueue(1)
+	q.push(&Message{Body: "a"})
+	q.put(&Message{Body: "answer"})
+	if q.len() != 2 {
+		t.Errorf("queue has %d messages, want 2", q.len())
+	}
+}
+
+func TestSignalLimits(t *testing.T) {
+	c := &Client{}
+	tests := []struct {
+		name string
+		msg  *Message
+		code string
+	}{
+		{"no peer", &Message{Type: typeOffer, Room: "call", Body: "sdp"}, codeInvalid},
+		{"no room", &Message{Type: typeOffer, To: "bob", Body: "sdp"}, codeInvalid},
+		{"too large", &Message{Type: typeOffer, Room: "call", To: "bob", Body: string(make([]byte, maxSignalSize+1))}, codeTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := errorCode(hub.signal(c, tt.msg)); code != tt.code {
+				t.Errorf("got error code %q, want %q", code, tt.code)
+			}
+		})
+	}
+}
@@ -1,31 +1,149 @@
 package main
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
 
 	"golang.org/x/net/websocket"
 )
 
-var clients []Client
+var wsHandler = requireKnownProtocol(websocket.Server{Handshake: wsHandshake, Handler: onWsConnect})
 
-var wsHandler = websocket.Handler(onWsConnect)
+type wsConn struct {
+	ws      *websocket.Conn
+	codec   websocket.Codec
+	encode  frameEncoder
+	version int
+}
+
+func (c wsConn) Send(msg *Message) error {
+	if c.version < protocolVersion && msg.Type != "" && msg.Type != typeMessage {
+		// Older clients only understand chat messages.
+		return nil
+	}
+	return sendFrame(c.ws, func(buf *bytes.Buffer) (byte, error) {
+		return c.encode(buf, msg)
+	})
+}
+
+func (c wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c wsConn) Receive(msg *Message) error {
+	return c.codec.Receive(c.ws, msg)
+}
+
+func wsHandshake(config *websocket.Config, req *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, req)
+	if err == nil && config.Origin == nil {
+		return errors.New("null origin")
+	}
+	if err != nil {
+		return err
+	}
+	v := lookupVhost(req.Host)
+	if !v.originAllowed(liveSettings(), config.Origin.String()) {
+		return errors.New("origin not allowed")
+	}
+	if v.requiresLogin() && requestIdentity(req) == "" {
+		return errors.New("not logged in")
+	}
+	// Browsers send the session cookie along with cross-site websocket
+	// handshakes, so sessions are only honoured for pages of our own origin.
+	if sessionIdentity(req) != "" && config.Origin.Host != req.Host {
+		return errors.New("cross-origin request with session cookie")
+	}
+
+	if p := selectProtocol(config.Protocol); p != "" {
+		config.Protocol = []string{p}
+	} else {
+		config.Protocol = nil
+	}
+	addRoomNodes(config, req)
+	return nil
+}
 
 func onWsConnect(ws *websocket.Conn) {
 	defer ws.Close()
-	client := NewClient(ws)
-	clients = addClientAndGreet(clients, client)
-	client.listen()
+	defer recoverPanic("websocket connection")
+	log.Println("Client connected from", clientIP(ws.Request()))
+	client := newWsClient(ws)
+	client.hub = hubFor(ws.Request())
+	client.vhost = lookupVhost(ws.Request().Host)
+	client.addr = clientIP(ws.Request())
+	client.origin = ws.Config().Origin.String()
+	client.identity = requestIdentity(ws.Request())
+	client.name = requestName(ws.Request())
+	client.role = sessionRole(ws.Request())
+	client.observer = observing(ws.Request(), client.role)
+	client.heartbeatEvery = negotiateHeartbeat(ws.Request())
+	client.meta = clientMeta(ws.Request().URL.Query(), ws.Request().Header.Values)
+	client.locale = requestLocale(ws.Request())
+	var resumed *clientSession
+	if *resumeWindow > 0 {
+		client.sessionID = newMessageID()
+		if id := ws.Request().URL.Query().Get("resume"); id != "" {
+			if resumed = takeSession(client, id); resumed != nil {
+				client.sessionID = id
+			}
+		}
+	}
+	if err := register(ws.Request().Context(), client, ws.Request().URL.Query().Get("nick")); err != nil {
+		if resumed != nil {
+			storeSession(resumed)
+		}
+		refuse(client, err)
+		return
+	}
+	defer client.hub.removeClient(client)
+	if resumed != nil {
+		client.hub.resume(client, resumed)
+	} else if client.observer {
+		client.hub.watch(client, ws.Request())
+	}
+	client.listen(ws.Request().Context())
 }
 
-func broadcast(msg *Message) {
-	fmt.Printf("Broadcasting %+v\n", msg)
-	for _, c := range clients {
-		c.ch <- msg
+// requestIdentity returns who the client behind r authenticated as, from
+// its certificate or login session.
+func requestIdentity(r *http.Request) string {
+	if name := certIdentity(r); name != "" {
+		return name
 	}
+	return sessionIdentity(r)
 }
 
-func addClientAndGreet(list []Client, client Client) []Client {
-	clients = append(list, client)
-	websocket.JSON.Send(client.connection, Message{"Server", "Welcome!"})
-	return clients
+// requestName returns what the client authenticated by requestIdentity is
+// called, or an empty string.
+func requestName(r *http.Request) string {
+	if name := certIdentity(r); name != "" {
+		return name
+	}
+	return sessionName(r)
+}
+
+func newWsClient(ws *websocket.Conn) *Client {
+	var protocol string
+	if len(ws.Config().Protocol) > 0 {
+		protocol = ws.Config().Protocol[0]
+	}
+
+	switch protocol {
+	case jsonrpcProtocol:
+		conn := &jsonrpcConn{ws: ws}
+		conn.client = NewClient(conn)
+		return conn.client
+	case jsonV2Protocol:
+		if wantsCompression(ws.Request()) {
+			return NewClient(wsConn{ws, jsonV2Codec, encodeJSONV2Compressed, 2})
+		}
+		return NewClient(wsConn{ws, jsonV2Codec, encodeJSONV2, 2})
+	case protoV2Protocol:
+		return NewClient(wsConn{ws, protoCodec, encodeProto, 2})
+	default:
+		return NewClient(wsConn{ws, jsonV1Codec, encodeJSONV1, 1})
+	}
 }
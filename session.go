@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	sessionCookie = "session"
+	csrfCookie    = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+	sessionMaxAge = 7 * 24 * time.Hour
+)
+
+var (
+	sessionRedis  = flag.String("session-redis", "", "address of a Redis server to keep login sessions, nickname reservations and user profiles in, so they survive restarts and are shared between instances")
+	secureCookies = flag.Bool("secure-cookies", false, "mark session cookies Secure even on plain HTTP listeners, for deployments behind a TLS terminating proxy")
+)
+
+// Chat roles. Users get defaultRole unless another role was given to them,
+// e.g. through -ldap-group-role.
+const (
+	defaultRole   = "user"
+	moderatorRole = "moderator"
+	adminRole     = "admin"
+	// observerRole only receives broadcasts, see observing.
+	observerRole = "observer"
+)
+
+type session struct {
+	Identity string `json:"identity"`
+	// Name is what the user is called, their default nickname.
+	Name string `json:"name,omitempty"`
+	Role string `json:"role"`
+	// Tenant the user belongs to, see resolveTenant.
+	Tenant  string    `json:"tenant,omitempty"`
+	CSRF    string    `json:"csrf"`
+	Expires time.Time `json:"expires"`
+}
+
+// sessionStore keeps the sessions of logged in browsers, keyed by the ID in
+// their session cookie.
+type sessionStore interface {
+	get(ctx context.Context, id string) (session, bool)
+	put(ctx context.Context, id string, s session) error
+	delete(ctx context.Context, id string)
+}
+
+type memorySessions struct {
+	mu    sync.Mutex
+	byID  map[string]session
+	sweep sweeper
+}
+
+func (m *memorySessions) get(ctx context.Context, id string) (session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.byID[id]
+	if ok && time.Now().After(s.Expires) {
+		delete(m.byID, id)
+		return session{}, false
+	}
+	return s, ok
+}
+
+// put also drops the expired sessions, at most once a minute, those never
+// looked up again included.
+func (m *memorySessions) put(ctx context.Context, id string, s session) error {
+	now := time.Now()
+	m.mu.Lock()
+	if m.sweep.due(now, time.Minute) {
+		for id, s := range m.byID {
+			if now.After(s.Expires) {
+				delete(m.byID, id)
+			}
+		}
+	}
+	m.byID[id] = s
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memorySessions) delete(ctx context.Context, id string) {
+	m.mu.Lock()
+	delete(m.byID, id)
+	m.mu.Unlock()
+}
+
+type redisSessions struct {
+	rdb *redis.Client
+}
+
+func (r redisSessions) get(ctx context.Context, id string) (session, bool) {
+	var s session
+	data, err := r.rdb.Get(ctx, "session:"+id).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Println("Session lookup failed:", err)
+		}
+		return s, false
+	}
+	if data, err = unseal("session:"+id, data); err != nil {
+		log.Println("Session lookup failed:", err)
+		return s, false
+	}
+	return s, json.Unmarshal(data, &s) == nil
+}
+
+func (r redisSessions) put(ctx context.Context, id string, s session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return r.rdb.Set(ctx, "session:"+id, seal("session:"+id, data), time.Until(s.Expires)).Err()
+}
+
+func (r redisSessions) delete(ctx context.Context, id string) {
+	r.rdb.Del(ctx, "session:"+id)
+}
+
+var (
+	sessionsOnce sync.Once
+	sessions     sessionStore
+)
+
+// sessionBackend returns the store picked by -session-redis.
+func sessionBackend() sessionStore {
+	sessionsOnce.Do(func() {
+		if c := redisClient(); c != nil {
+			sessions = redisSessions{c}
+		} else {
+			sessions = &memorySessions{byID: make(map[string]session)}
+		}
+	})
+	return sessions
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, name, value string, httpOnly bool, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: httpOnly,
+		Secure:   r.TLS != nil || *secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// startSession remembers identity, name and role for the browser behind r.
+// Next to the session it gets a CSRF token in a cookie readable by scripts,
+// which the page echoes in the X-CSRF-Token header of state-changing
+// requests.
+func startSession(w http.ResponseWriter, r *http.Request, identity, name, role, tenant string) error {
+	id := randomToken()
+	s := session{Identity: identity, Name: name, Role: role, Tenant: tenant, CSRF: randomToken(), Expires: time.Now().Add(sessionMaxAge)}
+	if err := sessionBackend().put(r.Context(), id, s); err != nil {
+		return err
+	}
+
+	setSessionCookie(w, r, sessionCookie, id, true, sessionMaxAge)
+	setSessionCookie(w, r, csrfCookie, s.CSRF, false, sessionMaxAge)
+	return nil
+}
+
+func currentSession(r *http.Request) (string, session, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return "", session{}, false
+	}
+	s, ok := sessionBackend().get(r.Context(), c.Value)
+	return c.Value, s, ok
+}
+
+// tenantSession returns the session behind r if it belongs to the tenant r
+// is for: sessions only count in the tenant the user belongs to.
+func tenantSession(r *http.Request) session {
+	_, s, _ := currentSession(r)
+	if s.Tenant != requestTenant(r) {
+		return session{}
+	}
+	return s
+}
+
+// sessionRole returns the chat role of the session behind r, or an empty
+// string without a session.
+func sessionRole(r *http.Request) string {
+	return tenantSession(r).Role
+}
+
+// sessionIdentity returns who logged in from the browser behind r, or an
+// empty string.
+func sessionIdentity(r *http.Request) string {
+	return tenantSession(r).Identity
+}
+
+// sessionName returns the name of who logged in from the browser behind r,
+// or an empty string.
+func sessionName(r *http.Request) string {
+	s := tenantSession(r)
+	if s.Name == "" {
+		return s.Identity
+	}
+	return s.Name
+}
+
+// logoutHandler ends the session of the browser.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if id, _, ok := currentSession(r); ok {
+		sessionBackend().delete(r.Context(), id)
+	}
+	setSessionCookie(w, r, sessionCookie, "", true, -time.Second)
+	setSessionCookie(w, r, csrfCookie, "", false, -time.Second)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// csrfProtect rejects requests made with a session cookie unless they carry
+// the session's CSRF token. Requests without a session, e.g. from scripts
+// using basic auth, are passed through.
+func csrfProtect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, s, ok := currentSession(r); ok {
+			token := r.Header.Get(csrfHeader)
+			if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRF)) != 1 {
+				httpError(w, r, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
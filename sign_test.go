@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSignatureSeparatesFields(t *testing.T) {
+	key := []byte("test-signing-key")
+	// Each pair would sign the same if the fields were only concatenated.
+	pairs := [][2]Message{
+		{{Author: "ab", Body: "c"}, {Author: "a", Body: "bc"}},
+		{{Room: "x", To: ""}, {Room: "", To: "x"}},
+		{{ID: "1", Room: "2"}, {ID: "12"}},
+	}
+	for _, p := range pairs {
+		if bytes.Equal(signature(key, &p[0]), signature(key, &p[1])) {
+			t.Errorf("%+v and %+v have the same signature", p[0], p[1])
+		}
+	}
+}
+
+func TestSignatureCoversEveryField(t *testing.T) {
+	key := []byte("test-signing-key")
+	msg := Message{Type: typeMessage, ID: "id", Room: "room", To: "peer", Author: "alice", Body: "hello", Seq: 7}
+	want := signature(key, &msg)
+
+	changes := map[string]func(*Message){
+		"type":   func(m *Message) { m.Type = typeReaction },
+		"id":     func(m *Message) { m.ID = "other" },
+		"room":   func(m *Message) { m.Room = "other" },
+		"to":     func(m *Message) { m.To = "other" },
+		"author": func(m *Message) { m.Author = "mallory" },
+		"body":   func(m *Message) { m.Body = "goodbye" },
+		"seq":    func(m *Message) { m.Seq = 8 },
+	}
+	for field, change := range changes {
+		changed := msg
+		change(&changed)
+		if bytes.Equal(signature(key, &changed), want) {
+			t.Errorf("changing the %s does not change the signature", field)
+		}
+	}
+	if bytes.Equal(signature([]byte("other-key"), &msg), want) {
+		t.Error("another key makes the same signature")
+	}
+}
+
+func TestSignatureReadsEmptyTypeAsMessage(t *testing.T) {
+	key := []byte("test-signing-key")
+	plain := Message{Author: "alice", Body: "hello"}
+	typed := Message{Type: typeMessage, Author: "alice", Body: "hello"}
+	if !bytes.Equal(signature(key, &plain), signature(key, &typed)) {
+		t.Error("a message without a type signs differently from a typed one")
+	}
+}
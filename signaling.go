@@ -0,0 +1,60 @@
+package main
+
+import "strings"
+
+// WebRTC signaling messages, exchanged by two members of a room setting up
+// a call. The body is the SDP of an offer or answer, or an ICE candidate
+// as JSON; To is the nickname of the peer. They go to the peer alone and
+// are never remembered.
+const (
+	typeOffer        = "offer"
+	typeAnswer       = "answer"
+	typeICECandidate = "ice-candidate"
+)
+
+// maxSignalSize is the largest signaling body relayed; SDP of calls with
+// many tracks runs to tens of kilobytes.
+const maxSignalSize = 64 << 10
+
+var (
+	errNoPeer   = &clientError{codeInvalid, "no such peer in the room"}
+	errPeerBusy = &clientError{codeBusy, "peer is not keeping up, try again"}
+)
+
+// signal passes a signaling message from c to the member of its room
+// nicknamed in To. Signaling counts against the size and rate limits of c
+// like chat does.
+func (h *Hub) signal(c *Client, msg *Message) error {
+	if msg.Room == "" || msg.To == "" || msg.Body == "" {
+		return &validationError{msg.Type + " needs a room, a body and a peer in to"}
+	}
+	if len(msg.Body) > maxSignalSize {
+		return clientErrorf(codeTooLarge, "%s is larger than %d bytes", msg.Type, maxSignalSize)
+	}
+	if err := checkLimits(c, msg); err != nil {
+		return err
+	}
+	r := h.existingRoom(msg.Room)
+	if r == nil || !c.joined(msg.Room) {
+		return &validationError{msg.Type + " needs a room the client is in"}
+	}
+
+	var peer *Client
+	for _, m := range *r.snapshot.Load() {
+		if m != c && strings.EqualFold(m.nick, msg.To) {
+			peer = m
+			break
+		}
+	}
+	if peer == nil {
+		return errNoPeer
+	}
+	out := &Message{Type: msg.Type, Author: c.nick, Body: msg.Body, Room: msg.Room, To: peer.nick, CorrelationID: msg.CorrelationID}
+	sign(out)
+	// Calls cannot be set up with a lost offer or candidate, so the sender
+	// is told to retry rather than it being dropped unseen.
+	if !peer.queue.push(out) {
+		return errPeerBusy
+	}
+	return nil
+}
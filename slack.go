@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	slackTokenFile         = flag.String("slack-token-file", "", "file with the bot token the Slack bridge posts with; the bridge is off when empty")
+	slackSigningSecretFile = flag.String("slack-signing-secret-file", "", "file with the signing secret of the Slack app, checked on the events Slack posts to /bridges/slack/events")
+	slackChannels          = flag.String("slack-channels", "", "comma separated room=channel pairs the Slack bridge mirrors, channel being a Slack channel ID such as C0123456789")
+)
+
+const (
+	slackAPI = "https://slack.com/api/"
+	// slackRetries is how often a post rate limited by Slack is retried.
+	slackRetries = 3
+)
+
+var (
+	slackToken         string
+	slackSigningSecret string
+	slackBridge        *bridge
+)
+
+// Slack escapes &, < and > in message text.
+var (
+	slackEscaper   = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	slackUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+)
+
+// startSlackBridge mirrors the -slack-channels rooms to Slack, if
+// configured.
+func startSlackBridge() {
+	if *slackTokenFile == "" {
+		return
+	}
+	if *slackSigningSecretFile == "" {
+		log.Fatal("the Slack bridge needs -slack-signing-secret-file")
+	}
+	slackToken = readSecretFile(*slackTokenFile)
+	slackSigningSecret = readSecretFile(*slackSigningSecretFile)
+	slackBridge = startBridge("slack", parseBridgeRooms("slack", *slackChannels), postToSlack)
+}
+
+// slackCall makes the Slack Web API request built by req, again after
+// waiting out rate limits, and decodes the response into out.
+func slackCall(req func() (*http.Request, error), out any) error {
+	for attempt := 0; ; attempt++ {
+		r, err := req()
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Authorization", "Bearer "+slackToken)
+		resp, err := bridgeHTTP.Do(r)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < slackRetries {
+			resp.Body.Close()
+			time.Sleep(retryAfter(resp))
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.New("Slack API: " + resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+}
+
+// postToSlack posts msg to channel under the name of its author.
+func postToSlack(channel string, msg *Message) error {
+	body, err := json.Marshal(map[string]string{
+		"channel":  channel,
+		"text":     slackEscaper.Replace(msg.Body),
+		"username": msg.Author,
+	})
+	if err != nil {
+		return err
+	}
+	var out struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	err = slackCall(func() (*http.Request, error) {
+		r, err := http.NewRequest(http.MethodPost, slackAPI+"chat.postMessage", bytes.NewReader(body))
+		if err == nil {
+			r.Header.Set("Content-Type", "application/json; charset=utf-8")
+		}
+		return r, err
+	}, &out)
+	if err == nil && !out.OK {
+		err = errors.New("Slack API: " + out.Error)
+	}
+	return err
+}
+
+// slackNames caches the display names of Slack users by ID.
+var slackNames = struct {
+	sync.Mutex
+	byID map[string]string
+}{byID: make(map[string]string)}
+
+// slackUserName returns the name Slack shows for the user with id, or id
+// when it cannot be looked up.
+func slackUserName(id string) string {
+	slackNames.Lock()
+	name, ok := slackNames.byID[id]
+	slackNames.Unlock()
+	if ok {
+		return name
+	}
+
+	var out struct {
+		OK   bool `json:"ok"`
+		User struct {
+			Name    string `json:"name"`
+			Profile struct {
+				DisplayName string `json:"display_name"`
+				RealName    string `json:"real_name"`
+			} `json:"profile"`
+		} `json:"user"`
+	}
+	err := slackCall(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, slackAPI+"users.info?user="+url.QueryEscape(id), nil)
+	}, &out)
+	if err != nil || !out.OK {
+		log.Println("Cannot look up Slack user", id, err)
+		return id
+	}
+	switch {
+	case out.User.Profile.DisplayName != "":
+		name = out.User.Profile.DisplayName
+	case out.User.Profile.RealName != "":
+		name = out.User.Profile.RealName
+	default:
+		name = out.User.Name
+	}
+	slackNames.Lock()
+	slackNames.byID[id] = name
+	slackNames.Unlock()
+	return name
+}
+
+// slackEventsHandler serves POST /bridges/slack/events, the Events API
+// requests of the Slack app, relaying channel messages to their rooms.
+func slackEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !slackBridge.serves(r) {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	if err != nil {
+		httpError(w, r, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := (&webhook{Style: "slack", Secret: slackSigningSecret}).verify(r, body); err != nil {
+		log.Printf("Refused Slack event from %s: %v", clientIP(r), err)
+		httpError(w, r, "Missing or invalid request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var in struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Event     struct {
+			Type    string `json:"type"`
+			Subtype string `json:"subtype"`
+			BotID   string `json:"bot_id"`
+			User    string `json:"user"`
+			Channel string `json:"channel"`
+			Text    string `json:"text"`
+		} `json:"event"`
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		httpError(w, r, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	switch in.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"challenge": in.Challenge})
+		return
+	case "event_callback":
+		e := in.Event
+		// Slack retries events it got no answer for in time, they were
+		// relayed already. Edits, joins and the like have a subtype, and
+		// bot messages include the bridge's own.
+		if r.Header.Get("X-Slack-Retry-Num") == "" && e.Type == "message" && e.Subtype == "" && e.BotID == "" {
+			// Slack wants an answer within 3 seconds, looking up the
+			// author may take longer.
+			go func() {
+				slackBridge.relay(e.Channel, slackUserName(e.User), slackUnescaper.Replace(e.Text))
+			}()
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
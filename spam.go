@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spamWindow         = 30 * time.Second
+	maxDuplicates      = 3
+	maxLinkMessages    = 5
+	maxSimilarSenders  = 4
+	minSimilarBodySize = 10
+)
+
+// typeModeration tells admins about automatic moderation actions.
+const typeModeration = "moderation"
+
+var spamMute = flag.Duration("spam-mute", time.Minute, "how long clients caught flooding or spamming are muted, 0 disables spam detection")
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// spamState is what a client sent recently.
+type spamState struct {
+	mu         sync.Mutex
+	recent     []sentMessage
+	mutedUntil time.Time
+}
+
+type sentMessage struct {
+	at   time.Time
+	body string
+	link bool
+}
+
+// similarBodies tracks who sent the same text recently, to catch the same
+// spam coming from many connections.
+var similarBodies = struct {
+	sync.Mutex
+	senders map[string]map[*Client]time.Time
+}{senders: make(map[string]map[*Client]time.Time)}
+
+func normalizeBody(body string) string {
+	return strings.Join(strings.Fields(strings.ToLower(body)), " ")
+}
+
+// checkSpam returns an error when c is muted or msg makes it look like a
+// spammer, in which case c gets muted.
+func checkSpam(c *Client, msg *Message) error {
+	if *spamMute <= 0 || encryptedRoom(msg.Room) {
+		return nil
+	}
+	now := time.Now()
+	body := normalizeBody(msg.Body)
+
+	s := &c.spam
+	s.mu.Lock()
+	if now.Before(s.mutedUntil) {
+		until := s.mutedUntil
+		s.mu.Unlock()
+		return clientErrorf(codeMuted, "you are muted until %s", until.Format(time.Kitchen))
+	}
+
+	kept := s.recent[:0]
+	for _, m := range s.recent {
+		if now.Sub(m.at) < spamWindow {
+			kept = append(kept, m)
+		}
+	}
+	s.recent = append(kept, sentMessage{now, body, linkPattern.MatchString(msg.Body)})
+
+	var duplicates, links int
+	for _, m := range s.recent {
+		if m.body == body {
+			duplicates++
+		}
+		if m.link {
+			links++
+		}
+	}
+	reason := ""
+	switch {
+	case duplicates > maxDuplicates:
+		reason = "repeated messages"
+	case links > maxLinkMessages:
+		reason = "link flood"
+	case similarSenders(c, body, now) > maxSimilarSenders:
+		reason = "same message as many other clients"
+	}
+	if reason == "" {
+		s.mu.Unlock()
+		return nil
+	}
+	s.mutedUntil = now.Add(*spamMute)
+	s.recent = nil
+	s.mu.Unlock()
+
+	log.Printf("Muting %s for %s: %s", c.nick, *spamMute, reason)
+	auditAction("system", "mute", c.nick, reason)
+	c.hub.notifyRole(adminRole, &Message{Type: typeModeration, Author: "Server", Body: fmt.Sprintf("%s muted for %s: %s", c.nick, *spamMute, reason)})
+	return clientErrorf(codeMuted, "muted for %s: %s", *spamMute, reason)
+}
+
+// similarSenders records that c sent body and returns how many clients
+// sent it within spamWindow.
+func similarSenders(c *Client, body string, now time.Time) int {
+	if len(body) < minSimilarBodySize {
+		return 0
+	}
+
+	similarBodies.Lock()
+	defer similarBodies.Unlock()
+
+	for b, senders := range similarBodies.senders {
+		for sender, at := range senders {
+			if now.Sub(at) >= spamWindow {
+				delete(senders, sender)
+			}
+		}
+		if len(senders) == 0 {
+			delete(similarBodies.senders, b)
+		}
+	}
+	senders := similarBodies.senders[body]
+	if senders == nil {
+		senders = make(map[*Client]time.Time)
+		similarBodies.senders[body] = senders
+	}
+	senders[c] = now
+	return len(senders)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+// statsRoom is where the server posts typeStats messages. Only the server
+// can send to it, clients join it like any room.
+const (
+	statsRoom = "#stats"
+	typeStats = "stats"
+)
+
+var statsInterval = flag.Duration("stats-interval", 10*time.Second, "how often server stats are posted to the #stats room, 0 disables")
+
+type serverStats struct {
+	Connections int `json:"connections"`
+	// Rooms is the number of rooms with history.
+	Rooms int `json:"rooms"`
+	// MessagesPerSecond is the broadcast rate since the last stats.
+	MessagesPerSecond float64 `json:"messagesPerSecond"`
+	// QueuedMessages is the total of the clients' send queues, and
+	// MaxQueueDepth the longest of them.
+	QueuedMessages int `json:"queuedMessages"`
+	MaxQueueDepth  int `json:"maxQueueDepth"`
+	// Panics is the number of panics recovered since the server started.
+	Panics int64 `json:"panics"`
+}
+
+func (h *Hub) stats(since time.Duration, messages int64) serverStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := serverStats{
+		Connections:       h.clients.len(),
+		MessagesPerSecond: float64(messages) / since.Seconds(),
+		Panics:            panicCount.Load(),
+	}
+	for _, r := range h.rooms {
+		r.mu.Lock()
+		if len(r.history) > 0 {
+			s.Rooms++
+		}
+		r.mu.Unlock()
+	}
+	h.clients.each(func(c *Client) {
+		n := c.queue.len()
+		s.QueuedMessages += n
+		if n > s.MaxQueueDepth {
+			s.MaxQueueDepth = n
+		}
+	})
+	return s
+}
+
+// postStats sends stats to the clients in statsRoom. They are not
+// remembered, the next ones replace them soon enough.
+func (h *Hub) postStats(s serverStats) {
+	msg := &Message{Type: typeStats, Author: "Server", Room: statsRoom, Stats: &s}
+	sign(msg)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.clients.each(func(c *Client) {
+		if c.inRoom(statsRoom) {
+			c.queue.push(msg)
+		}
+	})
+}
+
+// runStats posts server stats every -stats-interval.
+func runStats() {
+	if *statsInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(*statsInterval)
+	last := time.Now()
+	for now := range ticker.C {
+		for _, h := range allHubs() {
+			h.postStats(h.stats(now.Sub(last), h.broadcasts.Swap(0)))
+		}
+		last = now
+	}
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisOnce sync.Once
+	rdb       *redis.Client
+)
+
+// redisClient returns the connection to the -session-redis server, or nil
+// when everything is kept in memory.
+func redisClient() *redis.Client {
+	redisOnce.Do(func() {
+		if *sessionRedis != "" {
+			rdb = redis.NewClient(&redis.Options{Addr: *sessionRedis})
+		}
+	})
+	return rdb
+}
+
+// Profile is what a user tells others about themselves.
+type Profile struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName,omitempty"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+	Status      string `json:"status,omitempty"`
+}
+
+// Store persists user data. Lookups of missing entries return nil without
+// an error.
+type Store interface {
+	Profile(ctx context.Context, id string) (*Profile, error)
+	SaveProfile(ctx context.Context, p *Profile) error
+	DeleteProfile(ctx context.Context, id string) error
+
+	SaveScheduled(ctx context.Context, s *scheduledMessage) error
+	// DeleteScheduled reports whether the message was still there.
+	DeleteScheduled(ctx context.Context, id string) (bool, error)
+	ScheduledMessages(ctx context.Context) ([]scheduledMessage, error)
+
+	// SaveReceipt moves the read marker of reader in room to seq, unless
+	// it is already there or further, and reports whether it moved.
+	SaveReceipt(ctx context.Context, room, reader string, seq uint64) (bool, error)
+	Receipts(ctx context.Context, room string) (map[string]uint64, error)
+	// ReserveSeqs sets aside the next n sequence numbers of room and
+	// returns the last of them, so numbers given out are never given out
+	// again, restarts included.
+	ReserveSeqs(ctx context.Context, room string, n uint64) (uint64, error)
+
+	// SaveMessage adds msg to the history of room, replacing one with the
+	// same sequence number, and keeps the last keep messages.
+	SaveMessage(ctx context.Context, room string, msg *Message, keep int) error
+	// History returns the messages of room with sequence numbers from
+	// from to to, oldest first.
+	History(ctx context.Context, room string, from, to uint64) ([]*Message, error)
+	// DeleteMessages removes the messages match selects from the history
+	// of every room.
+	DeleteMessages(ctx context.Context, match func(*Message) bool) error
+	// DeleteReceipts removes the read markers of the readers match
+	// selects in every room.
+	DeleteReceipts(ctx context.Context, match func(reader string) bool) error
+
+	SaveLastSeen(ctx context.Context, id string, at time.Time) error
+	// LastSeen returns the zero time for users never seen.
+	LastSeen(ctx context.Context, id string) (time.Time, error)
+	DeleteLastSeen(ctx context.Context, id string) error
+
+	// SaveDigestEmail sets where to send the digests of user id, or opts
+	// them out with an empty email.
+	SaveDigestEmail(ctx context.Context, id, email string) error
+	// DigestEmail returns "" for users without digests.
+	DigestEmail(ctx context.Context, id string) (string, error)
+	// AddToDigest adds e to what user id missed, keeping the last max
+	// entries.
+	AddToDigest(ctx context.Context, id string, e digestEntry, max int) error
+	// TakeDigest removes and returns what user id missed, and how many
+	// older entries were dropped.
+	TakeDigest(ctx context.Context, id string) ([]digestEntry, int, error)
+	// DigestUsers returns the users who missed something.
+	DigestUsers(ctx context.Context) ([]string, error)
+}
+
+type memoryStore struct {
+	mu        sync.Mutex
+	profiles  map[string]Profile
+	scheduled map[string]scheduledMessage
+	receipts  map[string]map[string]uint64
+	seqs      map[string]uint64
+	history   map[string][]Message
+	lastSeen  map[string]time.Time
+	digests   map[string]string
+	missed    map[string]*pendingDigest
+}
+
+func (m *memoryStore) Profile(ctx context.Context, id string) (*Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.profiles[id]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+func (m *memoryStore) SaveProfile(ctx context.Context, p *Profile) error {
+	m.mu.Lock()
+	m.profiles[p.ID] = *p
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) DeleteProfile(ctx context.Context, id string) error {
+	m.mu.Lock()
+	delete(m.profiles, id)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) SaveScheduled(ctx context.Context, s *scheduledMessage) error {
+	m.mu.Lock()
+	m.scheduled[s.ID] = *s
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) DeleteScheduled(ctx context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.scheduled[id]
+	delete(m.scheduled, id)
+	return ok, nil
+}
+
+func (m *memoryStore) ScheduledMessages(ctx context.Context) ([]scheduledMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]scheduledMessage, 0, len(m.scheduled))
+	for _, s := range m.scheduled {
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+func (m *memoryStore) SaveReceipt(ctx context.Context, room, reader string, seq uint64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.receipts[room] == nil {
+		m.receipts[room] = make(map[string]uint64)
+	}
+	if m.receipts[room][reader] >= seq {
+		return false, nil
+	}
+	m.receipts[room][reader] = seq
+	return true, nil
+}
+
+func (m *memoryStore) Receipts(ctx context.Context, room string) (map[string]uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	receipts := make(map[string]uint64, len(m.receipts[room]))
+	for reader, seq := range m.receipts[room] {
+		receipts[reader] = seq
+	}
+	return receipts, nil
+}
+
+func (m *memoryStore) ReserveSeqs(ctx context.Context, room string, n uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seqs[room] += n
+	return m.seqs[room], nil
+}
+
+func (m *memoryStore) SaveMessage(ctx context.Context, room string, msg *Message, keep int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := m.history[room]
+	i := sort.Search(len(list), func(i int) bool { return list[i].Seq >= msg.Seq })
+	if i < len(list) && list[i].Seq == msg.Seq {
+		list[i] = *msg
+	} else {
+		list = append(list, Message{})
+		copy(list[i+1:], list[i:])
+		list[i] = *msg
+	}
+	if len(list) > keep {
+		list = append([]Message{}, list[len(list)-keep:]...)
+	}
+	m.history[room] = list
+	return nil
+}
+
+func (m *memoryStore) History(ctx context.Context, room string, from, to uint64) ([]*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var found []*Message
+	for _, msg := range m.history[room] {
+		if msg.Seq >= from && msg.Seq <= to {
+			msg := msg
+			found = append(found, &msg)
+		}
+	}
+	return found, nil
+}
+
+func (m *memoryStore) DeleteMessages(ctx context.Context, match func(*Message) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for room, list := range m.history {
+		kept := list[:0:0]
+		for i := range list {
+			if !match(&list[i]) {
+				kept = append(kept, list[i])
+			}
+		}
+		m.history[room] = kept
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteReceipts(ctx context.Context, match func(reader string) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, receipts := range m.receipts {
+		for reader := range receipts {
+			if match(reader) {
+				delete(receipts, reader)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) SaveLastSeen(ctx context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	m.lastSeen[id] = at
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) LastSeen(ctx context.Context, id string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lastSeen[id], nil
+}
+
+func (m *memoryStore) DeleteLastSeen(ctx context.Context, id string) error {
+	m.mu.Lock()
+	delete(m.lastSeen, id)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) SaveDigestEmail(ctx context.Context, id, email string) error {
+	m.mu.Lock()
+	if email == "" {
+		delete(m.digests, id)
+	} else {
+		m.digests[id] = email
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) DigestEmail(ctx context.Context, id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.digests[id], nil
+}
+
+func (m *memoryStore) AddToDigest(ctx context.Context, id string, e digestEntry, max int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.missed[id]
+	if p == nil {
+		p = &pendingDigest{}
+		m.missed[id] = p
+	}
+	p.entries = append(p.entries, e)
+	if n := len(p.entries) - max; n > 0 {
+		p.entries = p.entries[n:]
+		p.dropped += n
+	}
+	return nil
+}
+
+func (m *memoryStore) TakeDigest(ctx context.Context, id string) ([]digestEntry, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.missed[id]
+	delete(m.missed, id)
+	if p == nil {
+		return nil, 0, nil
+	}
+	return p.entries, p.dropped, nil
+}
+
+func (m *memoryStore) DigestUsers(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users := make([]string, 0, len(m.missed))
+	for id := range m.missed {
+		users = append(users, id)
+	}
+	return users, nil
+}
+
+type redisStore struct {
+	rdb *redis.Client
+}
+
+func (r redisStore) Profile(ctx context.Context, id string) (*Profile, error) {
+	data, err := r.rdb.HGet(ctx, "profiles", id).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = unseal("profiles:"+id, data); err != nil {
+		return nil, err
+	}
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (r redisStore) SaveProfile(ctx context.Context, p *Profile) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return r.rdb.HSet(ctx, "profiles", p.ID, seal("profiles:"+p.ID, data)).Err()
+}
+
+func (r redisStore) DeleteProfile(ctx context.Context, id string) error {
+	return r.rdb.HDel(ctx, "profiles", id).Err()
+}
+
+func (r redisStore) SaveScheduled(ctx context.Context, s *scheduledMessage) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return r.rdb.HSet(ctx, "scheduled", s.ID, seal("scheduled:"+s.ID, data)).Err()
+}
+
+func (r redisStore) DeleteScheduled(ctx context.Context, id string) (bool, error) {
+	n, err := r.rdb.HDel(ctx, "scheduled", id).Result()
+	return n == 1, err
+}
+
+func (r redisStore) ScheduledMessages(ctx context.Context) ([]scheduledMessage, error) {
+	all, err := r.rdb.HGetAll(ctx, "scheduled").Result()
+	if err != nil {
+		return nil, err
+	}
+	var list []scheduledMessage
+	for id, value := range all {
+		data, err := unseal("scheduled:"+id, []byte(value))
+		if err != nil {
+			return nil, err
+		}
+		var s scheduledMessage
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// saveReceipt only ever moves a read marker forward.
+var saveReceipt = redis.NewScript(`
+local current = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+if tonumber(ARGV[2]) <= current then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+func (r redisStore) SaveReceipt(ctx context.Context, room, reader string, seq uint64) (bool, error) {
+	moved, err := saveReceipt.Run(ctx, r.rdb, []string{"receipts:" + room}, reader, seq).Int()
+	return moved == 1, err
+}
+
+func (r redisStore) Receipts(ctx context.Context, room string) (map[string]uint64, error) {
+	all, err := r.rdb.HGetAll(ctx, "receipts:"+room).Result()
+	if err != nil {
+		return nil, err
+	}
+	receipts := make(map[string]uint64, len(all))
+	for reader, value := range all {
+		seq, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		receipts[reader] = seq
+	}
+	return receipts, nil
+}
+
+func (r redisStore) ReserveSeqs(ctx context.Context, room string, n uint64) (uint64, error) {
+	last, err := r.rdb.IncrBy(ctx, "seq:"+room, int64(n)).Result()
+	return uint64(last), err
+}
+
+// saveMessage adds a message to the history of a room, scored by its
+// sequence number, and trims the oldest.
+var saveMessage = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+redis.call("ZREMRANGEBYRANK", KEYS[1], 0, -tonumber(ARGV[3]) - 1)
+return 1
+`)
+
+func (r redisStore) SaveMessage(ctx context.Context, room string, msg *Message, keep int) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return saveMessage.Run(ctx, r.rdb, []string{"history:" + room}, msg.Seq, seal("history:"+room, data), keep).Err()
+}
+
+func (r redisStore) History(ctx context.Context, room string, from, to uint64) ([]*Message, error) {
+	values, err := r.rdb.ZRangeByScore(ctx, "history:"+room, &redis.ZRangeBy{
+		Min: strconv.FormatUint(from, 10),
+		Max: strconv.FormatUint(to, 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	found := make([]*Message, 0, len(values))
+	for _, value := range values {
+		data, err := unseal("history:"+room, []byte(value))
+		if err != nil {
+			return nil, err
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		found = append(found, &msg)
+	}
+	return found, nil
+}
+
+func (r redisStore) DeleteMessages(ctx context.Context, match func(*Message) bool) error {
+	iter := r.rdb.Scan(ctx, 0, "history:*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		values, err := r.rdb.ZRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			data, err := unseal(key, []byte(value))
+			if err != nil {
+				return err
+			}
+			var msg Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				return err
+			}
+			if match(&msg) {
+				if err := r.rdb.ZRem(ctx, key, value).Err(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return iter.Err()
+}
+
+func (r redisStore) DeleteReceipts(ctx context.Context, match func(reader string) bool) error {
+	iter := r.rdb.Scan(ctx, 0, "receipts:*", 100).Iterator()
+	for iter.Next(ctx) {
+		readers, err := r.rdb.HKeys(ctx, iter.Val()).Result()
+		if err != nil {
+			return err
+		}
+		for _, reader := range readers {
+			if !match(reader) {
+				continue
+			}
+			if err := r.rdb.HDel(ctx, iter.Val(), reader).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return iter.Err()
+}
+
+func (r redisStore) SaveLastSeen(ctx context.Context, id string, at time.Time) error {
+	return r.rdb.HSet(ctx, "lastseen", id, at.UTC().Format(time.RFC3339Nano)).Err()
+}
+
+func (r redisStore) LastSeen(ctx context.Context, id string) (time.Time, error) {
+	value, err := r.rdb.HGet(ctx, "lastseen", id).Result()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func (r redisStore) DeleteLastSeen(ctx context.Context, id string) error {
+	return r.rdb.HDel(ctx, "lastseen", id).Err()
+}
+
+func (r redisStore) SaveDigestEmail(ctx context.Context, id, email string) error {
+	if email == "" {
+		return r.rdb.HDel(ctx, "digests", id).Err()
+	}
+	return r.rdb.HSet(ctx, "digests", id, seal("digests:"+id, []byte(email))).Err()
+}
+
+func (r redisStore) DigestEmail(ctx context.Context, id string) (string, error) {
+	data, err := r.rdb.HGet(ctx, "digests", id).Bytes()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if data, err = unseal("digests:"+id, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// addToDigest appends to the list of what a user missed, trimming it and
+// counting what was trimmed, and notes that the user has a digest.
+var addToDigest = redis.NewScript(`
+local n = redis.call("RPUSH", KEYS[1], ARGV[2])
+local over = n - tonumber(ARGV[3])
+if over > 0 then
+	redis.call("LTRIM", KEYS[1], over, -1)
+	redis.call("HINCRBY", KEYS[2], ARGV[1], over)
+end
+redis.call("SADD", KEYS[3], ARGV[1])
+return n
+`)
+
+// takeDigest returns and removes what a user missed, with the number of
+// trimmed entries last.
+var takeDigest = redis.NewScript(`
+local entries = redis.call("LRANGE", KEYS[1], 0, -1)
+table.insert(entries, redis.call("HGET", KEYS[2], ARGV[1]) or "0")
+redis.call("DEL", KEYS[1])
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("SREM", KEYS[3], ARGV[1])
+return entries
+`)
+
+func (r redisStore) AddToDigest(ctx context.Context, id string, e digestEntry, max int) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	keys := []string{"missed:" + id, "missed:dropped", "missed:users"}
+	return addToDigest.Run(ctx, r.rdb, keys, id, seal("missed:"+id, data), max).Err()
+}
+
+func (r redisStore) TakeDigest(ctx context.Context, id string) ([]digestEntry, int, error) {
+	keys := []string{"missed:" + id, "missed:dropped", "missed:users"}
+	values, err := takeDigest.Run(ctx, r.rdb, keys, id).StringSlice()
+	if err != nil {
+		return nil, 0, err
+	}
+	dropped, _ := strconv.Atoi(values[len(values)-1])
+	entries := make([]digestEntry, 0, len(values)-1)
+	for _, value := range values[:len(values)-1] {
+		data, err := unseal("missed:"+id, []byte(value))
+		if err != nil {
+			return nil, 0, err
+		}
+		var e digestEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, dropped, nil
+}
+
+func (r redisStore) DigestUsers(ctx context.Context) ([]string, error) {
+	return r.rdb.SMembers(ctx, "missed:users").Result()
+}
+
+var (
+	storeOnce sync.Once
+	store     Store
+)
+
+// dataStore returns the store picked by -session-redis.
+func dataStore() Store {
+	storeOnce.Do(func() {
+		if c := redisClient(); c != nil {
+			store = redisStore{c}
+		} else {
+			store = &memoryStore{
+				profiles:  make(map[string]Profile),
+				scheduled: make(map[string]scheduledMessage),
+				receipts:  make(map[string]map[string]uint64),
+				seqs:      make(map[string]uint64),
+				history:   make(map[string][]Message),
+				lastSeen:  make(map[string]time.Time),
+				digests:   make(map[string]string),
+				missed:    make(map[string]*pendingDigest),
+			}
+		}
+	})
+	return store
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// streamConn writes the chat messages of the rooms a GET /stream consumer
+// follows as newline-delimited JSON. Nothing is read from it.
+type streamConn struct {
+	client *Client
+	w      io.Writer
+	flush  func()
+	rooms  []string
+	// seqs are the last sequence numbers written, by room, so messages
+	// delivered while history was being written are not repeated.
+	seqs   map[string]uint64
+	closed chan struct{}
+}
+
+// Send writes msg if it is a chat message of a followed room. Pings are
+// written too, keeping proxies from closing a quiet stream, and count as
+// the consumer being alive since it takes what is written.
+func (c *streamConn) Send(msg *Message) error {
+	switch {
+	case msg.Type == typePing:
+	case msg.Type != "" && msg.Type != typeMessage:
+		return nil
+	case !c.follows(msg.Room):
+		return nil
+	case msg.Seq != 0 && msg.Seq <= c.seqs[msg.Room]:
+		return nil
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if _, err := encodeJSONV2(buf, msg); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	if _, err := c.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	c.flush()
+	if msg.Seq != 0 {
+		c.seqs[msg.Room] = msg.Seq
+	}
+	if msg.Type == typePing {
+		c.client.active()
+	}
+	return nil
+}
+
+// follows reports whether messages of room are streamed: those of the
+// rooms asked for, or of every room when none were.
+func (c *streamConn) follows(room string) bool {
+	if len(c.rooms) == 0 {
+		return true
+	}
+	for _, r := range c.rooms {
+		if topicMatches(r, room) {
+			return true
+		}
+	}
+	return false
+}
+
+// Receive waits for the stream to end, consumers send nothing.
+func (c *streamConn) Receive(msg *Message) error {
+	<-c.closed
+	return io.EOF
+}
+
+// streamHandler serves GET /stream?room={room}&since={seq}, an unending
+// application/x-ndjson response of the messages broadcast to the rooms,
+// which may be patterns, or to every room the consumer is in when none
+// are given: the lobby. With since, and a single room, the remembered
+// messages after that sequence number come first.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, r, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	rooms := query["room"]
+	for _, room := range rooms {
+		if !validPattern(room) {
+			httpError(w, r, "Invalid room "+room, http.StatusBadRequest)
+			return
+		}
+	}
+	var since uint64
+	if s := query.Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil || len(rooms) != 1 || hasWildcard(rooms[0]) {
+			httpError(w, r, "since needs a sequence number and a single room", http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn := &streamConn{w: w, flush: flusher.Flush, rooms: rooms, seqs: make(map[string]uint64), closed: make(chan struct{})}
+	client := NewClient(conn)
+	conn.client = client
+	client.hub = hubFor(r)
+	client.addr = clientIP(r)
+	client.identity = requestIdentity(r)
+	client.name = requestName(r)
+	client.role = sessionRole(r)
+	client.meta = clientMeta(query, r.Header.Values)
+	// Consumers only listen, and are not shown as members.
+	client.observer = true
+	if err := register(r.Context(), client, query.Get("nick")); err != nil {
+		status := http.StatusForbidden
+		if errorCode(err) == codeBusy || errorCode(err) == codeQuota {
+			status = http.StatusServiceUnavailable
+		}
+		httpError(w, r, err.Error(), status)
+		return
+	}
+	defer client.hub.removeClient(client)
+	for _, room := range rooms {
+		if err := client.hub.join(client, room); err != nil {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	// The writer does not run yet, history goes out first.
+	if query.Has("since") {
+		msgs, err := client.hub.backfill(rooms[0], seqRange{From: since + 1, To: math.MaxUint64})
+		if err != nil {
+			return
+		}
+		for _, msg := range msgs {
+			if err := conn.Send(msg); err != nil {
+				return
+			}
+		}
+	}
+
+	go func() {
+		<-r.Context().Done()
+		close(conn.closed)
+	}()
+	client.listen(r.Context())
+}
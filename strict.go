@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+)
+
+var strictDecoding = flag.Bool("strict", false, "reject inbound JSON with unknown fields, mistyped values or missing required fields with an invalid error event, instead of decoding what can be decoded")
+
+// decodeJSON unmarshals data into v, refusing unknown fields in strict
+// mode. Errors in strict mode are validationErrors, so the client learns
+// about them.
+func decodeJSON(data []byte, v interface{}) error {
+	if !*strictDecoding {
+		return json.Unmarshal(data, v)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return &validationError{err.Error()}
+	}
+	if dec.More() {
+		return &validationError{"unexpected data after JSON value"}
+	}
+	return nil
+}
+
+// checkRequired reports fields msg cannot do without, in strict mode.
+func checkRequired(msg *Message) error {
+	if !*strictDecoding {
+		return nil
+	}
+	switch {
+	case (msg.Type == "" || msg.Type == typeMessage) && msg.Body == "":
+		return &validationError{"missing body"}
+	case msg.Type == typeKeyExchange && msg.Room == "":
+		return &validationError{"missing room"}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+)
+
+// Clients send typeSubscribe with a filter to only receive the chat
+// messages matching it, and typeUnsubscribe to receive everything again.
+// Other events are not filtered.
+const (
+	typeSubscribe   = "subscribe"
+	typeUnsubscribe = "unsubscribe"
+)
+
+// filterKeys are the message fields a subscription can match on.
+var filterKeys = map[string]bool{"author": true, "room": true}
+
+func validFilter(filter map[string]string) error {
+	for k := range filter {
+		if !filterKeys[k] {
+			return &validationError{"cannot filter on " + k + ", expected author or room"}
+		}
+	}
+	return nil
+}
+
+func (h *Hub) subscribe(client *Client, filter map[string]string) {
+	if len(filter) == 0 {
+		filter = nil
+	}
+	client.mu.Lock()
+	client.filter = filter
+	client.mu.Unlock()
+}
+
+// wants reports whether msg passes the client's subscription filter.
+func (c *Client) wants(msg *Message) bool {
+	c.mu.Lock()
+	filter := c.filter
+	c.mu.Unlock()
+
+	if filter == nil || (msg.Type != "" && msg.Type != typeMessage) {
+		return true
+	}
+	for k, v := range filter {
+		switch k {
+		case "author":
+			if !strings.EqualFold(msg.Author, v) {
+				return false
+			}
+		case "room":
+			if msg.Room != v {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	tenantList = flag.String("tenants", "", "comma separated tenants served in isolated namespaces, each with its own clients, rooms, presence, history and metrics; when empty everyone shares the default one")
+	tenantFrom = flag.String("tenant-from", "claim,host,path", "where the tenant of a request comes from, tried in order: claim (the -oauth-tenant-claim of the logged in user), host (the -vhosts tenant of the Host header, or its first label) or path (a /t/{tenant} prefix)")
+)
+
+// tenants are the hubs of the tenants, created as they are first used.
+// The default tenant, named "", is served by hub.
+var tenants = struct {
+	sync.Mutex
+	once  sync.Once
+	known map[string]bool
+	hubs  map[string]*Hub
+}{}
+
+func loadTenants() {
+	tenants.known = make(map[string]bool)
+	tenants.hubs = map[string]*Hub{"": hub}
+	for _, name := range strings.Split(*tenantList, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if strings.ContainsAny(name, "/.") {
+				log.Fatalf("invalid tenant %q", name)
+			}
+			tenants.known[name] = true
+		}
+	}
+	for _, source := range strings.Split(*tenantFrom, ",") {
+		switch source {
+		case "claim", "host", "path":
+		default:
+			log.Fatalf("invalid -tenant-from source %q, expected claim, host or path", source)
+		}
+	}
+}
+
+// knownTenant reports whether name is the default tenant or one of
+// -tenants.
+func knownTenant(name string) bool {
+	tenants.once.Do(loadTenants)
+	return name == "" || tenants.known[name]
+}
+
+// tenantHub returns the hub of tenant name, or nil when there is no such
+// tenant.
+func tenantHub(name string) *Hub {
+	if !knownTenant(name) {
+		return nil
+	}
+	tenants.Lock()
+	defer tenants.Unlock()
+
+	h := tenants.hubs[name]
+	if h == nil {
+		h = newHub(name)
+		tenants.hubs[name] = h
+	}
+	return h
+}
+
+// allHubs returns the hubs of the tenants in use, for what concerns the
+// whole server.
+func allHubs() []*Hub {
+	tenants.once.Do(loadTenants)
+	tenants.Lock()
+	defer tenants.Unlock()
+
+	hubs := make([]*Hub, 0, len(tenants.hubs))
+	for _, h := range tenants.hubs {
+		hubs = append(hubs, h)
+	}
+	return hubs
+}
+
+type tenantKey struct{}
+
+// resolveTenant finds the tenant of every request, by the first of the
+// -tenant-from sources that names one, and strips the /t/{tenant} prefix
+// before passing it on to h. Requests for unknown tenants, or with a path
+// prefix naming another tenant than the one found first, are not found.
+func resolveTenant(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pathTenant, prefixed := "", false
+		if rest, found := strings.CutPrefix(r.URL.Path, "/t/"); found {
+			pathTenant, rest, _ = strings.Cut(rest, "/")
+			r = r.Clone(r.Context())
+			r.URL.Path = "/" + rest
+			r.URL.RawPath = ""
+			prefixed = true
+		}
+
+		tenant, found := "", false
+		for _, source := range strings.Split(*tenantFrom, ",") {
+			switch source {
+			case "claim":
+				_, s, _ := currentSession(r)
+				tenant, found = s.Tenant, s.Tenant != ""
+			case "host":
+				if v := lookupVhost(r.Host); v != nil {
+					tenant, found = v.Tenant, true
+					break
+				}
+				host, _, err := net.SplitHostPort(r.Host)
+				if err != nil {
+					host = r.Host
+				}
+				label, _, _ := strings.Cut(host, ".")
+				tenant, found = label, label != "" && knownTenant(label)
+			case "path":
+				tenant, found = pathTenant, prefixed
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			tenant = ""
+		}
+		if !knownTenant(tenant) || (prefixed && pathTenant != tenant) {
+			httpError(w, r, "Not found", http.StatusNotFound)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+	})
+}
+
+// requestTenant returns the tenant resolveTenant found for r.
+func requestTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantKey{}).(string)
+	return tenant
+}
+
+// storeKey names room of h in the store, which all tenants share. Room
+// names only have + as a wildcard level, so "+tenant/room" is no room of
+// the default tenant.
+func (h *Hub) storeKey(room string) string {
+	if h.tenant == "" {
+		return room
+	}
+	return "+" + h.tenant + "/" + room
+}
+
+// hubFor returns the hub of the tenant of r.
+func hubFor(r *http.Request) *Hub {
+	if h := tenantHub(requestTenant(r)); h != nil {
+		return h
+	}
+	return hub
+}
+
+// connectedClients counts the clients of all tenants.
+func connectedClients() int {
+	n := 0
+	for _, h := range allHubs() {
+		n += h.count()
+	}
+	return n
+}
+
+// disconnectAll is Hub.disconnect over all tenants.
+func disconnectAll(reason string, match func(*Client) bool) int {
+	n := 0
+	for _, h := range allHubs() {
+		n += h.disconnect(reason, match)
+	}
+	return n
+}
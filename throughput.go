@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	fanoutRate   = flag.Float64("fanout-rate", 0, "messages per second the server delivers to clients at most, counting each recipient, 0 for no limit")
+	fanoutBytes  = flag.Float64("fanout-bytes", 0, "message body bytes per second the server delivers to clients at most, counting each recipient, 0 for no limit")
+	fanoutPolicy = flag.String("fanout-policy", "queue", "what happens to broadcasts over -fanout-rate or -fanout-bytes: queue (wait their turn, slowing senders down) or shed (dropped)")
+)
+
+// fanoutLimiter caps what broadcasts cost across the server. The cost of a
+// broadcast is only known once it has been delivered, so it is charged
+// afterwards and may run the allowance into debt, which later broadcasts
+// wait out or are shed for.
+type fanoutLimiter struct {
+	mu    sync.Mutex
+	msgs  float64
+	bytes float64
+	last  time.Time
+}
+
+var fanout fanoutLimiter
+
+func fanoutLimited() bool {
+	return *fanoutRate > 0 || *fanoutBytes > 0
+}
+
+func (l *fanoutLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		elapsed := now.Sub(l.last).Seconds()
+		// A second's worth of allowance can be saved up for bursts.
+		l.msgs = min(l.msgs+elapsed**fanoutRate, *fanoutRate)
+		l.bytes = min(l.bytes+elapsed**fanoutBytes, *fanoutBytes)
+	} else {
+		l.msgs, l.bytes = *fanoutRate, *fanoutBytes
+	}
+	l.last = now
+}
+
+// wait returns how long until the allowance is out of debt.
+func (l *fanoutLimiter) wait() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	var wait float64
+	if *fanoutRate > 0 && l.msgs < 0 {
+		wait = -l.msgs / *fanoutRate
+	}
+	if *fanoutBytes > 0 && l.bytes < 0 {
+		wait = max(wait, -l.bytes / *fanoutBytes)
+	}
+	return time.Duration(wait * float64(time.Second))
+}
+
+func (l *fanoutLimiter) charge(msg *Message, d delivery) {
+	if !fanoutLimited() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.msgs -= float64(d.Delivered)
+	l.bytes -= float64(d.Delivered * len(msg.Body))
+}
+
+// admit holds a broadcast of priority back until the fan-out allowance
+// permits it, or with the shed policy reports that it must be dropped.
+// Urgent broadcasts are always let through, bulk ones are shed rather
+// than queued.
+func (l *fanoutLimiter) admit(priority string) bool {
+	if !fanoutLimited() || priority == priorityUrgent {
+		return true
+	}
+	for {
+		wait := l.wait()
+		if wait <= 0 {
+			return true
+		}
+		if priority == priorityBulk {
+			return false
+		}
+		if *fanoutPolicy == "shed" {
+			return false
+		}
+		time.Sleep(wait)
+	}
+}
+
+// checkFanoutPolicy refuses to start with an unknown -fanout-policy rather
+// than at the first broadcast over the limits.
+func checkFanoutPolicy() {
+	if *fanoutPolicy != "queue" && *fanoutPolicy != "shed" {
+		log.Fatalf("invalid -fanout-policy %q, expected queue or shed", *fanoutPolicy)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+var (
+	tlsClientCA   = flag.String("tls-client-ca", "", "PEM file with the CAs that sign client certificates, enables mutual TLS on tls:// listeners")
+	tlsClientAuth = flag.String("tls-client-auth", "require", "with -tls-client-ca, whether client certificates are required or only verified when sent: require, verify")
+)
+
+// serverTLSConfig returns the TLS settings of tls:// listeners.
+func serverTLSConfig() (*tls.Config, error) {
+	certs, err := serverCertificates()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{GetCertificate: certs.GetCertificate}
+	if *tlsClientCA == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(*tlsClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + *tlsClientCA)
+	}
+
+	config.ClientCAs = pool
+	switch *tlsClientAuth {
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "verify":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid -tls-client-auth %q, expected require or verify", *tlsClientAuth)
+	}
+	return config, nil
+}
+
+// certIdentity is the chat name of a client that authenticated with a
+// certificate: its subject common name, falling back to the first DNS or
+// email SAN. It is empty for clients without a verified certificate.
+func certIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
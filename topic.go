@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Rooms are topics in a hierarchy separated by slashes, such as
+// sports/football/live. Clients may join patterns where + stands for any
+// one level and a trailing # for any number of levels, including none, as
+// in MQTT: sports/+/live or sports/#.
+
+var errInvalidTopic = errors.New("invalid topic pattern")
+
+func hasWildcard(topic string) bool {
+	return strings.ContainsAny(topic, "+#")
+}
+
+// validPattern reports whether pattern uses wildcards correctly: each one
+// must fill a whole level, and # may only be the last level.
+func validPattern(pattern string) bool {
+	if pattern == statsRoom {
+		return true
+	}
+	levels := strings.Split(pattern, "/")
+	for i, l := range levels {
+		switch {
+		case l == "#":
+			if i != len(levels)-1 {
+				return false
+			}
+		case l == "+":
+		case strings.ContainsAny(l, "+#"):
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatches reports whether topic falls under pattern.
+func topicMatches(pattern, topic string) bool {
+	if !hasWildcard(pattern) {
+		return pattern == topic
+	}
+
+	p, t := strings.Split(pattern, "/"), strings.Split(topic, "/")
+	for i, l := range p {
+		if l == "#" {
+			return true
+		}
+		if i >= len(t) || (l != "+" && l != t[i]) {
+			return false
+		}
+	}
+	return len(p) == len(t)
+}
+
+// joined reports whether the client is in room, under the hub lock.
+func (c *Client) joined(room string) bool {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+
+	return c.inRoom(room)
+}
+
+// inRoom reports whether the client joined room or a pattern covering it.
+// It is called with the hub lock held.
+func (c *Client) inRoom(room string) bool {
+	if c.rooms[room] {
+		return true
+	}
+	for pattern := range c.rooms {
+		if topicMatches(pattern, room) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+)
+
+var templatesFile = flag.String("templates", "", "JSON file of Go templates rewriting the bodies of broadcast messages, keyed by room or by hook:{name} for the posts of a /hooks/{name} integration, e.g. {\"alerts\": \"[{{.Room}}] {{.Body}}\"}; templates use the fields of the message, such as .Author, .Body, .Tags and .Notes")
+
+// hookTemplatePrefix starts the keys of the templates of integrations.
+const hookTemplatePrefix = "hook:"
+
+// readTemplates returns the templates of -templates.
+func readTemplates() map[string]string {
+	if *templatesFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(*templatesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var templates map[string]string
+	if err := json.Unmarshal(data, &templates); err != nil {
+		log.Fatalf("invalid templates %s: %v", *templatesFile, err)
+	}
+	return templates
+}
+
+// parseTemplates parses the templates of s. Empty ones are dropped, which
+// is how PATCH /admin/config removes one.
+func (s *settings) parseTemplates() error {
+	s.templates = make(map[string]*template.Template)
+	for key, text := range s.Templates {
+		if text == "" {
+			delete(s.Templates, key)
+			continue
+		}
+		if key == hookTemplatePrefix || (!strings.HasPrefix(key, hookTemplatePrefix) && (!validPattern(key) || hasWildcard(key))) {
+			return fmt.Errorf("invalid template key %q, expected a room or hook:{name}", key)
+		}
+		t, err := template.New(key).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("invalid template %s: %v", key, err)
+		}
+		s.templates[key] = t
+	}
+	return nil
+}
+
+// transform rewrites the body of chat message msg with the template of the
+// integration that posted it, then with that of its room. Bodies of
+// encrypted rooms are left alone, and so are those a template fails on.
+func transform(msg *Message) {
+	templates := liveSettings().templates
+	if len(templates) == 0 || (msg.Type != "" && msg.Type != typeMessage) || encryptedRoom(msg.Room) {
+		return
+	}
+	for _, key := range []string{hookTemplatePrefix + msg.hook, msg.Room} {
+		t := templates[key]
+		if t == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, msg); err != nil {
+			log.Printf("Cannot render template %s: %v", key, err)
+			continue
+		}
+		msg.Body = buf.String()
+	}
+}
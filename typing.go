@@ -0,0 +1,32 @@
+package main
+
+// typeTyping says the author is typing in a room. It is relayed to the
+// room but not remembered.
+const typeTyping = "typing"
+
+// typing tells the other members of room that c is typing.
+func (c *Client) typing(room string) error {
+	if err := checkFeature(featureTyping); err != nil {
+		return err
+	}
+	if room == "" || !c.joined(room) {
+		return &validationError{"typing needs a room the client is in"}
+	}
+	c.hub.relay(c, &Message{Type: typeTyping, Author: c.author(), Room: room})
+	return nil
+}
+
+// relay sends msg to the other clients in its room without numbering or
+// remembering it, for messages that only matter right now.
+func (h *Hub) relay(from *Client, msg *Message) {
+	sign(msg)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.clients.each(func(c *Client) {
+		if c != from && c.inRoom(msg.Room) {
+			c.queue.push(msg)
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+const assetMaxAge = "3600"
+
+//go:embed web
+var webFiles embed.FS
+
+// uiHandler serves the static frontend: the files from webroot when given,
+// the embedded chat page otherwise.
+func uiHandler(webroot string) http.Handler {
+	var root http.FileSystem
+	if webroot != "" {
+		root = http.Dir(webroot)
+	} else {
+		sub, err := fs.Sub(webFiles, "web")
+		if err != nil {
+			panic(err)
+		}
+		root = http.FS(sub)
+	}
+	return cacheControl(http.FileServer(root))
+}
+
+// cacheControl makes browsers revalidate HTML pages on every load, so a new
+// deployment is picked up immediately, and lets them keep other assets for
+// a while.
+func cacheControl(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") || strings.HasSuffix(r.URL.Path, ".html") {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age="+assetMaxAge)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
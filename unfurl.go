@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/sync/singleflight"
+)
+
+// typePreview follows a message containing a link, with what the linked
+// page says about itself. Ref is the ID of that message.
+const typePreview = "preview"
+
+const (
+	unfurlTimeout   = 5 * time.Second
+	unfurlMaxBody   = 512 << 10
+	unfurlCacheTTL  = time.Hour
+	unfurlCacheSize = 1000
+	// unfurlWorkers fetch the links queued in unfurlJobs, which holds up
+	// to unfurlQueue of them. Links coming when it is full go without a
+	// preview.
+	unfurlWorkers = 4
+	unfurlQueue   = 100
+)
+
+var unfurlLinks = flag.Bool("unfurl-links", false, "fetch the first link of each message and send a preview of the page to the room")
+
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+}
+
+var errForbiddenAddress = errors.New("address not allowed")
+
+var (
+	// internalPrefixes are refused along with the internal ranges netip
+	// knows of: the shared address space of carrier-grade NAT and "this
+	// network".
+	internalPrefixes = []netip.Prefix{
+		netip.MustParsePrefix("100.64.0.0/10"),
+		netip.MustParsePrefix("0.0.0.0/8"),
+	}
+	// nat64Prefixes reach the IPv4 address in their last 32 bits, which is
+	// checked instead.
+	nat64Prefixes = []netip.Prefix{
+		netip.MustParsePrefix("64:ff9b::/96"),
+		netip.MustParsePrefix("64:ff9b:1::/48"),
+	}
+)
+
+// publicOnly refuses connections to loopback, private and other internal
+// addresses. It runs on the address actually dialled, so names resolving
+// differently on a second lookup cannot sneak past it.
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !publicAddr(ip) {
+		return errForbiddenAddress
+	}
+	return nil
+}
+
+// publicAddr reports whether ip is public, looking through IPv4-mapped and
+// NAT64 addresses at the IPv4 address they stand for.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range nat64Prefixes {
+		if p.Contains(ip) {
+			b := ip.As16()
+			ip = netip.AddrFrom4([4]byte(b[12:]))
+			break
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, p := range internalPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+var unfurlClient = &http.Client{
+	Timeout: unfurlTimeout,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: unfurlTimeout, Control: publicOnly}).DialContext,
+		TLSHandshakeTimeout: unfurlTimeout,
+		MaxIdleConns:        10,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return errors.New("too many redirects")
+		}
+		return nil
+	},
+}
+
+type cachedPreview struct {
+	preview *LinkPreview
+	expires time.Time
+}
+
+var previews = struct {
+	sync.Mutex
+	byURL map[string]cachedPreview
+	// fetching makes those asking for a link being fetched wait for it
+	// rather than fetch it again.
+	fetching singleflight.Group
+}{byURL: make(map[string]cachedPreview)}
+
+// unfurlJob asks for a preview of link to follow the message ref in room.
+type unfurlJob struct {
+	h               *Hub
+	link, ref, room string
+}
+
+var (
+	unfurlJobs     = make(chan unfurlJob, unfurlQueue)
+	startUnfurling sync.Once
+)
+
+// unfurl sends a preview of the first link in msg, if any, once it has been
+// fetched.
+func (h *Hub) unfurl(msg *Message) {
+	if !*unfurlLinks || encryptedRoom(msg.Room) || msg.ID == "" {
+		return
+	}
+	link := linkPattern.FindString(msg.Body)
+	if link == "" {
+		return
+	}
+	if !strings.Contains(link, "://") {
+		link = "https://" + link
+	}
+
+	startUnfurling.Do(func() {
+		for range unfurlWorkers {
+			go unfurler()
+		}
+	})
+	select {
+	case unfurlJobs <- unfurlJob{h, link, msg.ID, msg.Room}:
+	default:
+		log.Printf("Too many links to preview, skipping %s", link)
+	}
+}
+
+// unfurler fetches the previews of the links queued in unfurlJobs and
+// sends them.
+func unfurler() {
+	for job := range unfurlJobs {
+		p, err := preview(job.link)
+		if err != nil {
+			log.Printf("Cannot preview %s: %v", job.link, err)
+			continue
+		}
+		if p != nil {
+			job.h.broadcast(&Message{Type: typePreview, Author: "Server", Room: job.room, Ref: job.ref, Preview: p})
+		}
+	}
+}
+
+// preview returns what link says about itself, from the cache when it was
+// fetched recently. Failed fetches are cached as nil.
+func preview(link string) (*LinkPreview, error) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("not an http link")
+	}
+	link = u.String()
+
+	now := time.Now()
+	previews.Lock()
+	cached, ok := previews.byURL[link]
+	previews.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.preview, nil
+	}
+
+	v, err, _ := previews.fetching.Do(link, func() (any, error) {
+		p, err := fetchPreview(link)
+
+		previews.Lock()
+		if len(previews.byURL) >= unfurlCacheSize {
+			for u, c := range previews.byURL {
+				if now.After(c.expires) || len(previews.byURL) >= unfurlCacheSize {
+					delete(previews.byURL, u)
+				}
+			}
+		}
+		previews.byURL[link] = cachedPreview{p, now.Add(unfurlCacheTTL)}
+		previews.Unlock()
+		return p, err
+	})
+	return v.(*LinkPreview), err
+}
+
+func fetchPreview(link string) (*LinkPreview, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), unfurlTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := unfurlClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != "text/html" {
+		return nil, nil
+	}
+
+	p := parsePreview(io.LimitReader(resp.Body, unfurlMaxBody))
+	if p.Title == "" && p.Description == "" && p.Image == "" {
+		return nil, nil
+	}
+	p.URL = link
+	if p.Image != "" {
+		if img, err := resp.Request.URL.Parse(p.Image); err == nil && (img.Scheme == "https" || img.Scheme == "http") {
+			p.Image = img.String()
+		} else {
+			p.Image = ""
+		}
+	}
+	return p, nil
+}
+
+// parsePreview reads the title, description and image of a page from its
+// Open Graph tags, falling back to <title> and the description meta tag.
+func parsePreview(r io.Reader) *LinkPreview {
+	p := &LinkPreview{}
+	var title string
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if p.Title == "" {
+				p.Title = strings.TrimSpace(title)
+			}
+			return p
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "title":
+				if z.Next() == html.TextToken {
+					title = z.Token().Data
+				}
+			case "meta":
+				var key, content string
+				for _, a := range t.Attr {
+					switch a.Key {
+					case "property", "name":
+						key = strings.ToLower(a.Val)
+					case "content":
+						content = strings.TrimSpace(a.Val)
+					}
+				}
+				switch key {
+				case "og:title":
+					p.Title = content
+				case "og:description":
+					p.Description = content
+				case "description":
+					if p.Description == "" {
+						p.Description = content
+					}
+				case "og:image":
+					p.Image = content
+				}
+			}
+
+		case html.EndTagToken:
+			if z.Token().Data == "head" {
+				if p.Title == "" {
+					p.Title = strings.TrimSpace(title)
+				}
+				return p
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+//go:build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Zero-downtime restarts: on SIGUSR2 the running process starts a new copy
+// of its binary and hands it every listening socket. Once the new process
+// reports it is ready, the old one stops accepting connections and exits
+// after its clients have gone or the drain timeout has passed.
+
+const (
+	upgradeListenersEnv = "WS_UPGRADE_LISTENERS"
+	upgradeReadyEnv     = "WS_UPGRADE_READY_FD"
+)
+
+var inherited = inheritUpgradeSockets()
+
+// inheritUpgradeSockets picks up the sockets handed over by the process we
+// replace, keyed by the listener they belong to.
+func inheritUpgradeSockets() map[string]net.Listener {
+	defer os.Unsetenv(upgradeListenersEnv)
+
+	var names []string
+	if err := json.Unmarshal([]byte(os.Getenv(upgradeListenersEnv)), &names); err != nil {
+		return nil
+	}
+
+	sockets := make(map[string]net.Listener)
+	for i, name := range names {
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Cannot take over socket of %s: %v", name, err)
+			continue
+		}
+		sockets[name] = ln
+	}
+	return sockets
+}
+
+// upgraded reports whether this process took over from an older one.
+func upgraded() bool {
+	return len(inherited) > 0
+}
+
+func upgradeListener(name string) net.Listener {
+	return inherited[name]
+}
+
+// inheritedListeners returns the listener specs the previous process was
+// serving, for when no -listen flags are given.
+func inheritedListeners() []string {
+	var names []string
+	for name := range inherited {
+		if strings.HasPrefix(name, "grpc://") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// upgradeReady tells the process we replace that all sockets are bound.
+func upgradeReady() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	os.Unsetenv(upgradeReadyEnv)
+	if err != nil {
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// waitForUpgrade blocks until a new process took over the sockets after a
+// SIGUSR2. A failed upgrade is logged and the current process keeps serving.
+func waitForUpgrade(sockets map[string]net.Listener) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2)
+
+	for range sig {
+		log.Println("Upgrading binary")
+		err := upgrade(sockets)
+		if err == nil {
+			signal.Stop(sig)
+			return
+		}
+		log.Println("Upgrade failed:", err)
+	}
+}
+
+func upgrade(sockets map[string]net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for name, ln := range sockets {
+		filer, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("cannot hand over socket of %s", name)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+	encoded, _ := json.Marshal(names)
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		upgradeListenersEnv+"="+string(encoded),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFdsStart+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := ready.Read(buf)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(*upgradeTimeout):
+		err = errors.New("timed out waiting for the new process")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	// The socket files now belong to the new process.
+	for _, ln := range sockets {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
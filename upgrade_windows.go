@@ -0,0 +1,18 @@
+package main
+
+import "net"
+
+// Binary upgrades rely on passing file descriptors to a child process and
+// are not available on Windows.
+
+func upgraded() bool { return false }
+
+func upgradeListener(name string) net.Listener { return nil }
+
+func inheritedListeners() []string { return nil }
+
+func upgradeReady() {}
+
+func waitForUpgrade(sockets map[string]net.Listener) {
+	select {}
+}
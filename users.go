@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxProfileField = 200
+
+// user is what GET /users/{id} returns: the profile and when the user was
+// last active.
+type user struct {
+	*Profile
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// usersHandler serves GET, PUT and DELETE /users/{id}. Users may only
+// change their own profile; deleting all data of a user is also open to
+// admins.
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/users/")
+	if user, ok := strings.CutSuffix(id, "/digest"); ok {
+		digestHandler(w, r, user)
+		return
+	}
+	if id == "" || strings.Contains(id, "/") {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p, err := dataStore().Profile(r.Context(), id)
+		if err != nil {
+			log.Println("Profile lookup failed:", err)
+			httpError(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		seen, err := dataStore().LastSeen(r.Context(), id)
+		if err != nil {
+			log.Println("Last seen lookup failed:", err)
+			httpError(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if p == nil && seen.IsZero() {
+			httpError(w, r, "Not found", http.StatusNotFound)
+			return
+		}
+		if p == nil {
+			p = &Profile{ID: id}
+		}
+		u := user{Profile: p}
+		if !seen.IsZero() {
+			u.LastSeen = &seen
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(u)
+
+	case http.MethodPut:
+		if requestIdentity(r) != id {
+			httpError(w, r, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var p Profile
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&p); err != nil {
+			httpError(w, r, "Invalid profile", decodeStatus(err))
+			return
+		}
+		avatar, ok := cleanAvatarURL(p.AvatarURL)
+		if !validProfileField(p.DisplayName) || !validProfileField(p.Status) || !ok {
+			httpError(w, r, "Invalid profile", http.StatusBadRequest)
+			return
+		}
+		p.ID, p.DisplayName, p.Status, p.AvatarURL = id, sanitizeText(p.DisplayName), sanitizeText(p.Status), avatar
+		if err := dataStore().SaveProfile(r.Context(), &p); err != nil {
+			log.Println("Cannot save profile:", err)
+			httpError(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for _, h := range allHubs() {
+			h.setStatus(id, p.Status)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+
+	case http.MethodDelete:
+		// Users are erased from every tenant, which only admins of the
+		// default tenant manage.
+		if requestIdentity(r) != id && (sessionRole(r) != adminRole || requestTenant(r) != "") {
+			httpError(w, r, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err := eraseUser(r.Context(), id); err != nil {
+			log.Println("Cannot erase user data:", err)
+			httpError(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Println("Erased data of", id)
+		auditAction(requestActor(r), "erase-user", id, "")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// eraseUser removes everything kept about a user: their profile, last
+// activity, digest address, nickname reservations, read receipts,
+// scheduled messages and the messages they sent, under their identity or
+// any of their nicknames.
+func eraseUser(ctx context.Context, id string) error {
+	if err := dataStore().DeleteProfile(ctx, id); err != nil {
+		return err
+	}
+	if err := dataStore().DeleteLastSeen(ctx, id); err != nil {
+		return err
+	}
+	if err := dataStore().SaveDigestEmail(ctx, id, ""); err != nil {
+		return err
+	}
+	if _, _, err := dataStore().TakeDigest(ctx, id); err != nil {
+		return err
+	}
+
+	// The nicknames are those reserved for the user and those their
+	// clients go by, which without reservations are the only ones known.
+	names := map[string]bool{id: true}
+	for _, h := range allHubs() {
+		for _, nick := range h.nicks(id) {
+			names[nick] = true
+		}
+	}
+	if store := nickBackend(); store != nil {
+		nicks, err := store.release(ctx, id)
+		if err != nil {
+			return err
+		}
+		for _, nick := range nicks {
+			names[nick] = true
+		}
+	}
+	// Messages under the names the server uses are not the user's, even
+	// when their identity happens to be one.
+	named := func(name string) bool {
+		return (names[name] || names[strings.ToLower(name)]) && !serverAuthor(name)
+	}
+	by := func(msg *Message) bool {
+		return named(msg.Author) || (msg.Profile != nil && msg.Profile.ID == id)
+	}
+
+	if err := dataStore().DeleteReceipts(ctx, named); err != nil {
+		return err
+	}
+	if _, err := purgeScheduled(ctx, func(s *scheduledMessage) bool { return named(s.Owner) || by(&s.Msg) }); err != nil {
+		return err
+	}
+	if err := dataStore().DeleteMessages(ctx, by); err != nil {
+		return err
+	}
+	for _, h := range allHubs() {
+		h.erase(id, by)
+	}
+	return nil
+}
+
+// digestSettings is the body of /users/{id}/digest.
+type digestSettings struct {
+	Email string `json:"email"`
+}
+
+// digestHandler serves GET, PUT and DELETE /users/{id}/digest, where users
+// opt in to emails of what they missed by giving an address, and out by
+// deleting it.
+func digestHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if id == "" || strings.Contains(id, "/") {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if requestIdentity(r) != id {
+		httpError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var s digestSettings
+	switch r.Method {
+	case http.MethodGet:
+		email, err := dataStore().DigestEmail(r.Context(), id)
+		if err != nil {
+			log.Println("Digest email lookup failed:", err)
+			httpError(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		s.Email = email
+
+	case http.MethodPut:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&s); err != nil {
+			httpError(w, r, "Invalid digest settings", decodeStatus(err))
+			return
+		}
+		a, err := mail.ParseAddress(s.Email)
+		if err != nil || a.Name != "" || len(s.Email) > 254 {
+			httpError(w, r, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		if err := dataStore().SaveDigestEmail(r.Context(), id, a.Address); err != nil {
+			log.Println("Cannot save digest email:", err)
+			httpError(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		s.Email = a.Address
+
+	case http.MethodDelete:
+		if err := dataStore().SaveDigestEmail(r.Context(), id, ""); err != nil {
+			log.Println("Cannot save digest email:", err)
+			httpError(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		clearDigest(id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func validProfileField(s string) bool {
+	return utf8.RuneCountInString(s) <= maxProfileField
+}
+
+// cleanAvatarURL returns s, an http or https URL, in its escaped form, and
+// whether it is one. Quotes, angle brackets and spaces are refused, as the
+// escaped form keeps those of the query.
+func cleanAvatarURL(s string) (string, bool) {
+	if s == "" {
+		return "", true
+	}
+	if len(s) > 2048 || strings.ContainsAny(s, "\"'<>\\ \t\r\n") {
+		return "", false
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		return "", false
+	}
+	return u.String(), true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+var vhostFile = flag.String("vhosts", "", "JSON file configuring websocket clients by the host they connect to, e.g. {\"chat.acme.com\": {\"tenant\": \"acme\", \"allowedOrigins\": [\"https://acme.com\"], \"requireLogin\": true, \"rateLimit\": 5}}; settings left out fall back to the server's")
+
+// vhost configures the websocket clients connecting through one host name.
+// Unset fields leave the server's settings in effect.
+type vhost struct {
+	// Tenant serves the host's requests in a tenant's namespace, see
+	// resolveTenant.
+	Tenant         string   `json:"tenant"`
+	AllowedOrigins []string `json:"allowedOrigins"`
+	RequireLogin   *bool    `json:"requireLogin"`
+	RateLimit      *float64 `json:"rateLimit"`
+	RateBurst      *int     `json:"rateBurst"`
+	MaxMessageSize *int     `json:"maxMessageSize"`
+}
+
+var (
+	vhostsOnce sync.Once
+	vhosts     map[string]*vhost
+)
+
+// loadVhosts reads -vhosts, keyed by lower case host name.
+func loadVhosts() map[string]*vhost {
+	vhostsOnce.Do(func() {
+		vhosts = make(map[string]*vhost)
+		if *vhostFile == "" {
+			return
+		}
+		data, err := os.ReadFile(*vhostFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var byHost map[string]*vhost
+		if err := json.Unmarshal(data, &byHost); err != nil {
+			log.Fatalf("invalid vhosts %s: %v", *vhostFile, err)
+		}
+		for host, v := range byHost {
+			if err := v.validate(); err != nil {
+				log.Fatalf("invalid vhost %s: %v", host, err)
+			}
+			vhosts[strings.ToLower(host)] = v
+		}
+		log.Printf("Loaded %d virtual hosts", len(vhosts))
+	})
+	return vhosts
+}
+
+func (v *vhost) validate() error {
+	if v == nil {
+		return errors.New("missing configuration")
+	}
+	if !knownTenant(v.Tenant) {
+		return fmt.Errorf("unknown tenant %q", v.Tenant)
+	}
+	if (v.RateLimit != nil && *v.RateLimit < 0) || (v.MaxMessageSize != nil && *v.MaxMessageSize < 0) {
+		return errors.New("rate limit and message size must not be negative")
+	}
+	if v.RateBurst != nil && *v.RateBurst < 1 {
+		return errors.New("burst must be at least 1")
+	}
+	for _, o := range v.AllowedOrigins {
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid origin %q", o)
+		}
+	}
+	return nil
+}
+
+// lookupVhost returns the configuration of the Host header host, or nil
+// when it has none.
+func lookupVhost(host string) *vhost {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return loadVhosts()[strings.ToLower(host)]
+}
+
+// originAllowed reports whether websocket clients of v may connect from
+// origin.
+func (v *vhost) originAllowed(s *settings, origin string) bool {
+	if v == nil || v.AllowedOrigins == nil {
+		return s.originAllowed(origin)
+	}
+	return originListed(v.AllowedOrigins, origin)
+}
+
+// requiresLogin reports whether websocket clients of v must be logged in.
+func (v *vhost) requiresLogin() bool {
+	if v == nil || v.RequireLogin == nil {
+		return *requireLogin
+	}
+	return *v.RequireLogin
+}
+
+// limits returns the message size and rate limits of v's clients.
+func (v *vhost) limits(s *settings) (maxSize int, rate float64, burst int) {
+	maxSize, rate, burst = s.MaxMessageSize, s.RateLimit, s.RateBurst
+	if v == nil {
+		return
+	}
+	if v.MaxMessageSize != nil {
+		maxSize = *v.MaxMessageSize
+	}
+	if v.RateLimit != nil {
+		rate = *v.RateLimit
+	}
+	if v.RateBurst != nil {
+		burst = *v.RateBurst
+	}
+	return
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var webhookFile = flag.String("webhooks", "", "JSON file of the integrations that may post to /hooks/{name}, e.g. {\"deploys\": {\"style\": \"github\", \"secret\": \"...\", \"room\": \"ops\"}}; style is github, slack or stripe and says how posts are signed, tenant is the one of -tenants the integration posts to, the default one when left out")
+
+// webhook is an integration posting to /hooks/{name}. Posts not signed
+// with its secret the way its style says are refused.
+type webhook struct {
+	Style  string `json:"style"`
+	Secret string `json:"secret"`
+	// Room and Author are where the messages go and who they are from,
+	// the name of the integration by default.
+	Room   string `json:"room"`
+	Author string `json:"author"`
+	// Tenant is the only one the integration posts to.
+	Tenant string `json:"tenant"`
+}
+
+var (
+	webhooksOnce sync.Once
+	webhooks     map[string]*webhook
+)
+
+// githubDeliveryWindow is how long GitHub delivery IDs are remembered.
+// GitHub posts are not timestamped, and deliveries can be redelivered for
+// three days, so they are refused as replays for as long.
+const githubDeliveryWindow = 72 * time.Hour
+
+var githubDeliveries = nonceCache{keep: githubDeliveryWindow, seen: make(map[string]time.Time)}
+
+func loadWebhooks() map[string]*webhook {
+	webhooksOnce.Do(func() {
+		webhooks = make(map[string]*webhook)
+		if *webhookFile == "" {
+			return
+		}
+		data, err := os.ReadFile(*webhookFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &webhooks); err != nil {
+			log.Fatalf("invalid webhooks %s: %v", *webhookFile, err)
+		}
+		for name, hook := range webhooks {
+			switch {
+			case hook == nil || hook.Secret == "":
+				log.Fatalf("webhook %s has no secret", name)
+			case hook.Style != "github" && hook.Style != "slack" && hook.Style != "stripe":
+				log.Fatalf("webhook %s has unknown style %q, expected github, slack or stripe", name, hook.Style)
+			case !knownTenant(hook.Tenant):
+				log.Fatalf("webhook %s has unknown tenant %q", name, hook.Tenant)
+			}
+			if hook.Author == "" {
+				hook.Author = name
+			}
+		}
+	})
+	return webhooks
+}
+
+// verify checks the signature of a post with body, returning why it is
+// refused.
+func (hook *webhook) verify(r *http.Request, body []byte) error {
+	switch hook.Style {
+	case "github":
+		// X-Hub-Signature-256: sha256=HMAC(body). GitHub retries and
+		// redeliveries reuse the delivery ID, so posts need one and each
+		// is taken once. It is not signed, so neither is a signed body
+		// posted again under another ID.
+		sig, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok || !hook.signed(sig, body) {
+			return errors.New("invalid signature")
+		}
+		id := r.Header.Get("X-GitHub-Delivery")
+		if id == "" || len(id) > maxNonceLength {
+			return errors.New("missing delivery ID")
+		}
+		now := time.Now()
+		if !githubDeliveries.add("id:"+id, now) || !githubDeliveries.add("sig:"+sig, now) {
+			return errors.New("replayed delivery")
+		}
+	case "slack":
+		// X-Slack-Signature: v0=HMAC("v0:" timestamp ":" body).
+		timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+		sig, ok := strings.CutPrefix(r.Header.Get("X-Slack-Signature"), "v0=")
+		if !ok || !hook.signed(sig, []byte("v0:"+timestamp+":"+string(body))) {
+			return errors.New("invalid signature")
+		}
+		return checkWebhookTime(timestamp)
+	case "stripe":
+		// Stripe-Signature: t=timestamp,v1=HMAC(timestamp "." body), with
+		// one v1 per secret in use.
+		var timestamp string
+		var sigs []string
+		for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+			k, v, _ := strings.Cut(part, "=")
+			switch k {
+			case "t":
+				timestamp = v
+			case "v1":
+				sigs = append(sigs, v)
+			}
+		}
+		signed := false
+		for _, sig := range sigs {
+			signed = signed || hook.signed(sig, []byte(timestamp+"."+string(body)))
+		}
+		if !signed {
+			return errors.New("invalid signature")
+		}
+		return checkWebhookTime(timestamp)
+	}
+	return nil
+}
+
+// signed reports whether sig is the hex encoded HMAC-SHA256 of payload
+// with the secret of hook.
+func (hook *webhook) signed(sig string, payload []byte) bool {
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write(payload)
+	return hmac.Equal(want, mac.Sum(nil))
+}
+
+// checkWebhookTime refuses signed timestamps, in Unix seconds, further
+// than broadcastMaxSkew from now.
+func checkWebhookTime(timestamp string) error {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > broadcastMaxSkew || skew < -broadcastMaxSkew {
+		return errors.New("stale request")
+	}
+	return nil
+}
+
+// webhookText is what a post says: its text field, as in Slack style
+// incoming webhooks, or else the kind of event it reports.
+func webhookText(r *http.Request, body []byte) string {
+	var payload struct {
+		Text string `json:"text"`
+		Type string `json:"type"`
+	}
+	json.Unmarshal(body, &payload)
+	switch {
+	case payload.Text != "":
+		return payload.Text
+	case r.Header.Get("X-GitHub-Event") == "ping":
+	case r.Header.Get("X-GitHub-Event") != "":
+		return r.Header.Get("X-GitHub-Event") + " event"
+	case payload.Type != "":
+		return payload.Type + " event"
+	}
+	return ""
+}
+
+// webhookHandler serves POST /hooks/{name}, broadcasting what a signed
+// post of the integration says to its room.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/hooks/")
+	hook := loadWebhooks()[name]
+	if hook == nil || hook.Tenant != requestTenant(r) {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	if err != nil {
+		httpError(w, r, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := hook.verify(r, body); err != nil {
+		log.Printf("Refused webhook post to %s from %s: %v", r.URL.Path, clientIP(r), err)
+		httpError(w, r, "Missing or invalid request signature", http.StatusUnauthorized)
+		return
+	}
+
+	text := webhookText(r, body)
+	if text == "" {
+		// Nothing to tell, such as GitHub's ping.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	auditAction(hook.Author, "webhook", hook.Room, text)
+	d := hubFor(r).broadcast(&Message{Author: hook.Author, Body: text, Room: hook.Room, RequestID: requestID(r), hook: name})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hexHMAC(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// githubPost returns a post signed the way GitHub signs them.
+func githubPost(secret, delivery, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/hooks/deploys", strings.NewReader(body))
+	r.Header.Set("X-Hub-Signature-256", "sha256="+hexHMAC(secret, body))
+	if delivery != "" {
+		r.Header.Set("X-GitHub-Delivery", delivery)
+	}
+	return r
+}
+
+func TestWebhookVerifyGitHub(t *testing.T) {
+	hook := &webhook{Style: "github", Secret: "s3cret"}
+	// Deliveries are remembered by every test, so these are unique.
+	id := func(name string) string { return name + "-" + strconv.FormatInt(time.Now().UnixNano(), 36) }
+	body := `{"zen":"` + id("body") + `"}`
+	unnamed := `{"zen":"` + id("unnamed") + `"}`
+
+	if err := hook.verify(githubPost("s3cret", id("first"), body), []byte(body)); err != nil {
+		t.Fatalf("signed delivery refused: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		body string
+	}{
+		{"wrong secret", githubPost("other", id("secret"), body), body},
+		{"body changed", githubPost("s3cret", id("changed"), body), body + " "},
+		{"no delivery ID", githubPost("s3cret", "", unnamed), unnamed},
+		{"delivery ID too long", githubPost("s3cret", strings.Repeat("d", maxNonceLength+1), body+"\n"), body + "\n"},
+		{"redelivered body", githubPost("s3cret", id("again"), body), body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := hook.verify(tt.r, []byte(tt.body)); err == nil {
+				t.Error("post accepted")
+			}
+		})
+	}
+}
+
+func TestWebhookVerifyGitHubRefusesReplayedDeliveryID(t *testing.T) {
+	hook := &webhook{Style: "github", Secret: "s3cret"}
+	delivery := "replayed-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	first, second := `{"n":1,"d":"`+delivery+`"}`, `{"n":2,"d":"`+delivery+`"}`
+	if err := hook.verify(githubPost("s3cret", delivery, first), []byte(first)); err != nil {
+		t.Fatalf("signed delivery refused: %v", err)
+	}
+	if err := hook.verify(githubPost("s3cret", delivery, second), []byte(second)); err == nil {
+		t.Error("delivery ID accepted twice")
+	}
+}
+
+func TestWebhookVerifySlack(t *testing.T) {
+	hook := &webhook{Style: "slack", Secret: "s3cret"}
+	body := "payload=hello"
+	post := func(at time.Time, secret string) *http.Request {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		r := httptest.NewRequest(http.MethodPost, "/hooks/alerts", strings.NewReader(body))
+		r.Header.Set("X-Slack-Request-Timestamp", timestamp)
+		r.Header.Set("X-Slack-Signature", "v0="+hexHMAC(secret, "v0:"+timestamp+":"+body))
+		return r
+	}
+
+	if err := hook.verify(post(time.Now(), "s3cret"), []byte(body)); err != nil {
+		t.Errorf("signed post refused: %v", err)
+	}
+	if err := hook.verify(post(time.Now(), "other"), []byte(body)); err == nil {
+		t.Error("post with the wrong secret accepted")
+	}
+	if err := hook.verify(post(time.Now().Add(-2*broadcastMaxSkew), "s3cret"), []byte(body)); err == nil {
+		t.Error("stale post accepted")
+	}
+}
+
+func TestWebhookVerifyStripe(t *testing.T) {
+	hook := &webhook{Style: "stripe", Secret: "s3cret"}
+	body := `{"type":"charge.succeeded"}`
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	valid := hexHMAC("s3cret", timestamp+"."+body)
+	other := hexHMAC("old-secret", timestamp+"."+body)
+
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"signed", "t=" + timestamp + ",v1=" + valid, true},
+		{"one of several secrets", "t=" + timestamp + ",v1=" + other + ",v1=" + valid, true},
+		{"wrong secret", "t=" + timestamp + ",v1=" + other, false},
+		{"no signature", "t=" + timestamp, false},
+		{"timestamp changed", "t=" + timestamp + "1,v1=" + valid, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/hooks/billing", strings.NewReader(body))
+			r.Header.Set("Stripe-Signature", tt.header)
+			if err := hook.verify(r, []byte(body)); (err == nil) != tt.ok {
+				t.Errorf("verify returned %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
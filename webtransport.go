@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+	"golang.org/x/net/websocket"
+)
+
+// wtConn carries v2 envelopes over a WebTransport session. In stream mode
+// the client opens one bidirectional stream of newline-delimited JSON
+// messages; in datagram mode every datagram holds a single JSON message and
+// delivery is unreliable.
+type wtConn struct {
+	session *webtransport.Session
+	stream  *webtransport.Stream
+	dec     *json.Decoder
+}
+
+func (c *wtConn) Send(msg *Message) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if _, err := encodeJSONV2(buf, msg); err != nil {
+		return err
+	}
+	if c.stream != nil {
+		buf.WriteByte('\n')
+		_, err := c.stream.Write(buf.Bytes())
+		return err
+	}
+	// SendDatagram copies the payload into its own frame.
+	return c.session.SendDatagram(buf.Bytes())
+}
+
+func (c *wtConn) Close() error {
+	return c.session.CloseWithError(0, "closed by server")
+}
+
+func (c *wtConn) Receive(msg *Message) error {
+	var data []byte
+	if c.stream != nil {
+		var raw json.RawMessage
+		if err := c.dec.Decode(&raw); err != nil {
+			return io.EOF
+		}
+		data = raw
+	} else {
+		var err error
+		if data, err = c.session.ReceiveDatagram(c.session.Context()); err != nil {
+			return io.EOF
+		}
+	}
+	return jsonV2Unmarshal(data, websocket.TextFrame, msg)
+}
+
+func serveWebTransport(addr, certFile, keyFile string) *webtransport.Server {
+	mux := http.NewServeMux()
+	s := &webtransport.Server{H3: &http3.Server{Addr: addr, Handler: resolveTenant(mux)}}
+
+	mux.Handle("/wt", refuseWhileDraining(refuseWhileOverloaded(admitConnections(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := s.Upgrade(w, r)
+		if err != nil {
+			log.Println("WebTransport upgrade failed:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		onWtConnect(session, r)
+	})))))
+
+	go func() {
+		err := s.ListenAndServeTLS(certFile, keyFile)
+		// UDP sockets are not handed over on upgrades; wait for the old
+		// process to let go of the port.
+		for i := 0; i < 10 && upgraded() && errors.Is(err, syscall.EADDRINUSE); i++ {
+			time.Sleep(time.Second)
+			err = s.ListenAndServeTLS(certFile, keyFile)
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return s
+}
+
+func onWtConnect(session *webtransport.Session, r *http.Request) {
+	defer session.CloseWithError(0, "")
+	defer recoverPanic("WebTransport session")
+
+	conn := &wtConn{session: session}
+	if r.URL.Query().Get("mode") != "datagram" {
+		stream, err := session.AcceptStream(session.Context())
+		if err != nil {
+			return
+		}
+		conn.stream = stream
+		conn.dec = json.NewDecoder(stream)
+	}
+
+	client := NewClient(conn)
+	client.hub = hubFor(r)
+	client.meta = clientMeta(r.URL.Query(), r.Header.Values)
+	client.locale = requestLocale(r)
+	client.heartbeatEvery = negotiateHeartbeat(r)
+	if err := register(session.Context(), client, r.URL.Query().Get("nick")); err != nil {
+		refuse(client, err)
+		return
+	}
+	defer client.hub.removeClient(client)
+	client.listen(session.Context())
+}
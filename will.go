@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+// A client may leave a last will: a message published to its rooms when its
+// connection drops without it saying goodbye first. Sending typeWill again
+// replaces the will, typeDisconnect withdraws it before a clean close. Wills
+// are checked like messages when set, and published like them too.
+const (
+	typeWill       = "will"
+	typeDisconnect = "disconnect"
+)
+
+func (h *Hub) setWill(client *Client, will *Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if will == nil || will.Body == "" {
+		client.will = nil
+		return
+	}
+	client.will = &Message{Type: typeMessage, Body: will.Body}
+}
+
+// publishWill publishes the will of a client that has just been removed,
+// to every room it was in or to everyone when it joined none. Encrypted
+// rooms are left out, the will is not ciphertext.
+func (h *Hub) publishWill(client *Client) {
+	h.mu.Lock()
+	will := client.will
+	client.will = nil
+	var rooms []string
+	for room := range client.rooms {
+		if !hasWildcard(room) && !encryptedRoom(room) {
+			rooms = append(rooms, room)
+		}
+	}
+	h.mu.Unlock()
+
+	if will == nil {
+		return
+	}
+	if len(rooms) == 0 {
+		rooms = []string{""}
+	}
+	for _, room := range rooms {
+		client.publish(&Message{Type: will.Type, Body: will.Body, Room: room}, time.Time{})
+	}
+}